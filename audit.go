@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+// Outcomes recorded in the audit log
+const (
+	outcomeOK            = "ok"
+	outcomeFailed        = "failed"
+	outcomeRejected      = "rejected"
+	outcomeUnauthorized  = "unauthorized"
+	outcomeRateLimited   = "rate_limited"
+	outcomeLimitExceeded = "limit_exceeded" // Stopped by one of its resource limits
+)
+
+const defaultAuditMaxSizeMB = 10
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Provider   string    `json:"provider"`
+	Caller     string    `json:"caller"`
+	Command    string    `json:"command"`
+	Args       []string  `json:"args,omitempty"`
+	Argv       []string  `json:"argv,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	ExitCode   int       `json:"exitCode"`
+	DurationMs int64     `json:"durationMs"`
+	OutputSize int       `json:"outputSize"`
+}
+
+// newAuditEntry returns an entry describing the attempt made by a message
+func newAuditEntry(m messaging.Message) auditEntry {
+	return auditEntry{
+		Time:      time.Now(),
+		RequestID: m.RequestID,
+		Provider:  m.Provider,
+		Caller:    m.User,
+		Command:   m.Command,
+		Args:      m.Args,
+	}
+}
+
+// auditEntry returns the entry of a message with the values of the
+// sensitive args of its command redacted, even when it's refused before
+// running
+func (d *dispatcher) auditEntry(m messaging.Message) auditEntry {
+	entry := newAuditEntry(m)
+	if c, ok := d.commands.Get(m.Command); ok {
+		entry.Args = redactArgs(c, m.Args)
+	}
+	return entry
+}
+
+// relayAuditEntry returns the entry of a command relayed to host, its args
+// redacted as the agent defines them, or all of them until the agent
+// listed its commands
+func (d *dispatcher) relayAuditEntry(m messaging.Message, host string) auditEntry {
+	entry := newAuditEntry(m)
+	entry.Command = m.Command + "@" + host
+	if c, ok := d.fleet.command(host, m.Command); ok {
+		entry.Args = redactArgs(c, m.Args)
+	} else {
+		entry.Args = redactAll(m.Args)
+	}
+	return entry
+}
+
+// auditLog is an append-only JSON lines file rotated by size. A nil
+// *auditLog is valid and discards every record.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newAuditLog(cfg AuditConfig) (*auditLog, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	maxSizeMB := cfg.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultAuditMaxSizeMB
+	}
+	a := &auditLog{
+		path:       cfg.File,
+		maxSize:    int64(maxSizeMB) << 20,
+		maxBackups: cfg.MaxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("audit log: %w", err)
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts audit.log.N to audit.log.N+1, dropping the oldest backup,
+// and starts a new file
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		return err
+	}
+	if a.maxBackups <= 0 {
+		if err := os.Remove(a.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return a.open()
+	}
+	for i := a.maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", a.path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", a.path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Record appends an entry to the log. Failures are logged but never stop
+// the command from being served.
+func (a *auditLog) Record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("audit log: encoding failed", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		// A previous rotation failed half way: try to reopen the file
+		if err := a.open(); err != nil {
+			slog.Error("audit log: reopen failed", "error", err)
+			return
+		}
+	}
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			slog.Error("audit log: rotation failed", "error", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		slog.Error("audit log: write failed", "error", err)
+	}
+}
+
+// Recent returns up to n of the newest entries of the current file,
+// oldest first
+func (a *auditLog) Recent(n int) ([]auditEntry, error) {
+	if a == nil || n <= 0 {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			slog.Warn("error closing file", "file", a.path, "error", err)
+		}
+	}()
+
+	entries := make([]auditEntry, 0, n)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if len(entries) == n {
+			entries = entries[1:]
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuditLog(t *testing.T, cfg AuditConfig) *auditLog {
+	t.Helper()
+	if cfg.File == "" {
+		cfg.File = filepath.Join(t.TempDir(), "audit.jsonl")
+	}
+	a, err := newAuditLog(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = a.Close() })
+	return a
+}
+
+func TestAuditLog_RecordAndRecent(t *testing.T) {
+	a := newTestAuditLog(t, AuditConfig{})
+
+	for _, name := range []string{"a", "b", "c"} {
+		a.Record(auditEntry{Command: name, Outcome: outcomeOK})
+	}
+
+	entries, err := a.Recent(2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "b", entries[0].Command)
+	assert.Equal(t, "c", entries[1].Command)
+	assert.False(t, entries[1].Time.IsZero())
+
+	entries, err = a.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+}
+
+func TestAuditLog_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a := newTestAuditLog(t, AuditConfig{File: path, MaxBackups: 2})
+	a.maxSize = 200 // a couple of entries per file
+
+	for i := 0; i < 10; i++ {
+		a.Record(auditEntry{Command: "status", Outcome: outcomeOK, Provider: "telegram"})
+	}
+
+	_, err := os.Stat(path + ".1")
+	require.NoError(t, err)
+	_, err = os.Stat(path + ".2")
+	require.NoError(t, err)
+	_, err = os.Stat(path + ".3")
+	require.True(t, errors.Is(err, os.ErrNotExist), "only maxBackups files are kept")
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(200))
+}
+
+func TestAuditLog_Nil(t *testing.T) {
+	a, err := newAuditLog(AuditConfig{})
+	require.NoError(t, err)
+	require.Nil(t, a)
+
+	// A disabled audit log discards everything
+	a.Record(auditEntry{Command: "status"})
+	entries, err := a.Recent(10)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.NoError(t, a.Close())
+}
+
+func TestDispatcher_Audit(t *testing.T) {
+	a := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"echo": {Command: "echo %s", Args: []string{"text"}},
+			"fail": {Command: "error"},
+		}),
+		executor: &mockExecutor{},
+		audit:    a,
+		admins:   []Recipient{{ChatID: 1}},
+	}
+
+	_, _ = d.run(messaging.Message{Command: "echo", Args: []string{"hi"}, Provider: "telegram", User: "777"})
+	_, _ = d.run(messaging.Message{Command: "fail", Provider: "signal", User: "+1555"})
+	_, _ = d.run(messaging.Message{Command: "echo", Provider: "http", User: "10.0.0.2"})
+	_, _ = d.run(messaging.Message{Command: "nope", Provider: "http", User: "10.0.0.2"})
+	require.Equal(t, "Command not allowed", chatReply(d, messaging.Message{Command: "audit", ChatID: 2}))
+
+	entries, err := a.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+
+	assert.Equal(t, outcomeOK, entries[0].Outcome)
+	assert.Equal(t, "telegram", entries[0].Provider)
+	assert.Equal(t, "777", entries[0].Caller)
+	assert.Equal(t, []string{"hi"}, entries[0].Args)
+	assert.Equal(t, []string{"echo", "hi"}, entries[0].Argv)
+	assert.Equal(t, len("echo hi"), entries[0].OutputSize)
+
+	assert.Equal(t, outcomeFailed, entries[1].Outcome)
+	assert.Equal(t, -1, entries[1].ExitCode)
+	assert.Equal(t, "assert.AnError general error for testing", entries[1].Error)
+
+	assert.Equal(t, outcomeRejected, entries[2].Outcome)
+	assert.Equal(t, "mismatch between command definition args=1 and number of args=0", entries[2].Error)
+	assert.Equal(t, outcomeRejected, entries[3].Outcome)
+	assert.Equal(t, "command not supported", entries[3].Error)
+	assert.Equal(t, outcomeUnauthorized, entries[4].Outcome)
+
+	reply := chatReply(d, messaging.Message{Command: "audit", Args: []string{"2"}, ChatID: 1})
+	assert.Contains(t, reply, "/nope rejected")
+	assert.Contains(t, reply, "/audit unauthorized")
+	assert.NotContains(t, reply, "/fail")
+}
+
+func TestHttpAudit(t *testing.T) {
+	a := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"status": {Command: "uptime"}}),
+		executor: &mockExecutor{},
+		audit:    a,
+	}
+	cfg := &Config{Httpd: HttpdConfig{AuthToken: "secret"}}
+	mux := setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+	req.Header.Set("Authorization", "Token secret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/audit?n=5", nil)
+	req.Header.Set("Authorization", "Token secret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	var entries []auditEntry
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, outcomeUnauthorized, entries[0].Outcome)
+	assert.Equal(t, "192.0.2.1", entries[0].Caller)
+	assert.Equal(t, "status", entries[0].Command)
+	assert.Equal(t, outcomeOK, entries[1].Outcome)
+	assert.Equal(t, "http", entries[1].Provider)
+
+	// Scoped tokens can't read the log of the other commands
+	req = withIdentity(httptest.NewRequest(http.MethodGet, "/audit", nil), &httpIdentity{Name: "ci", Commands: []string{"status"}})
+	rr = httptest.NewRecorder()
+	(&httpAuditHandler{audit: a}).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rpi-bot/client"
+)
+
+var (
+	errMissingToken     = errors.New("missing token")
+	errInvalidToken     = errors.New("invalid token")
+	errTokenExpired     = errors.New("token expired")
+	errSourceNotAllowed = errors.New("source address not allowed")
+	errBadSignature     = errors.New("invalid signature")
+	errStaleTimestamp   = errors.New("stale timestamp")
+	errReusedNonce      = errors.New("reused nonce")
+)
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+// httpIdentity is an authenticated HTTP client and the commands it may run
+type httpIdentity struct {
+	Name     string
+	Commands []string // Empty for every command
+}
+
+func (i *httpIdentity) allows(command string) bool {
+	return len(i.Commands) == 0 || slices.Contains(i.Commands, command)
+}
+
+type identityKey struct{}
+
+// identityFromRequest returns the identity the request was authenticated
+// with, or nil
+func identityFromRequest(r *http.Request) *httpIdentity {
+	identity, _ := r.Context().Value(identityKey{}).(*httpIdentity)
+	return identity
+}
+
+func withIdentity(r *http.Request, identity *httpIdentity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+}
+
+// httpCaller returns the caller identity recorded for a request: its
+// authenticated identity if any, the client IP address otherwise
+func httpCaller(r *http.Request) string {
+	if identity := identityFromRequest(r); identity != nil {
+		return identity.Name
+	}
+	return remoteHost(r)
+}
+
+// apiToken is a parsed named token of the HTTP API
+type apiToken struct {
+	name     string
+	secret   []byte
+	commands []string
+	expires  time.Time // Zero for no expiry
+	sources  []*net.IPNet
+	hmac     bool // Only accepted as a request signing key
+}
+
+// parseAPIToken checks the restrictions of a configured token
+func parseAPIToken(name string, t APIToken) (apiToken, error) {
+	token := apiToken{name: name, secret: []byte(t.Token), commands: t.Commands, hmac: t.HMAC}
+	if t.Token == "" {
+		return token, errors.New("empty token")
+	}
+	if t.Expires != "" {
+		expires, err := parseExpiry(t.Expires)
+		if err != nil {
+			return token, err
+		}
+		token.expires = expires
+	}
+	for _, source := range t.Sources {
+		network, err := parseSource(source)
+		if err != nil {
+			return token, err
+		}
+		token.sources = append(token.sources, network)
+	}
+	return token, nil
+}
+
+// parseExpiry accepts an RFC 3339 time or a date, which expires at the end
+// of that day in UTC
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expires %q, use 2006-01-02 or RFC 3339", s)
+	}
+	return t.AddDate(0, 0, 1), nil
+}
+
+// parseSource accepts a CIDR or a single IP address
+func parseSource(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %q", s)
+	}
+	return network, nil
+}
+
+func (t apiToken) allowsSource(host string) bool {
+	if len(t.sources) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.sources {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpAuth authenticates HTTP API requests by client certificate or token
+type httpAuth struct {
+	// legacy is the single authToken, which doesn't identify its callers
+	legacy  []byte
+	tokens  []apiToken
+	clients map[string]TLSClient
+	// dispatcher records the rejected requests, may be nil
+	dispatcher *dispatcher
+	now        func() time.Time
+	maxSkew    time.Duration
+	nonces     *nonceCache
+	// lockout blocks clients after repeated failures, nil if disabled
+	lockout *lockout
+}
+
+func newHTTPAuth(cfg HttpdConfig, d *dispatcher) *httpAuth {
+	maxSkew := time.Duration(cfg.MaxClockSkewSeconds) * time.Second
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxClockSkew
+	}
+	a := &httpAuth{
+		clients:    cfg.TLS.Clients,
+		dispatcher: d,
+		now:        time.Now,
+		maxSkew:    maxSkew,
+		nonces:     newNonceCache(),
+		lockout:    newLockout(cfg.Lockout),
+	}
+	if token, ok := GetSecret("HTTP_TOKEN_AUTH", cfg.AuthToken); ok && token != "" {
+		a.legacy = []byte(token)
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Tokens)) {
+		token, err := parseAPIToken(name, cfg.Tokens[name])
+		if err != nil {
+			// Rejected by the config validation, never reached in practice
+			slog.Error("httpd: ignoring token", "token", name, "error", err)
+			continue
+		}
+		a.tokens = append(a.tokens, token)
+	}
+	return a
+}
+
+// open reports whether no credential is configured, leaving the API
+// unauthenticated
+func (a *httpAuth) open() bool {
+	return a.legacy == nil && len(a.tokens) == 0 && len(a.clients) == 0
+}
+
+// authenticate returns the identity of the request, nil for the legacy
+// token or an open API
+func (a *httpAuth) authenticate(r *http.Request) (*httpIdentity, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if tlsClient, ok := a.clients[cn]; ok {
+			name := tlsClient.Identity
+			if name == "" {
+				name = cn
+			}
+			return &httpIdentity{Name: name, Commands: tlsClient.Commands}, nil
+		}
+	}
+	if a.open() {
+		return nil, nil
+	}
+	if r.Header.Get(client.HeaderSignature) != "" {
+		return a.verifySignature(r)
+	}
+
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+	if !ok || presented == "" {
+		return nil, errMissingToken
+	}
+	secret := []byte(presented)
+
+	// Every token is compared, in constant time, so the response time
+	// doesn't tell which one nearly matched
+	var match *apiToken
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(secret, a.tokens[i].secret) == 1 && !a.tokens[i].hmac {
+			match = &a.tokens[i]
+		}
+	}
+	legacy := a.legacy != nil && subtle.ConstantTimeCompare(secret, a.legacy) == 1
+	switch {
+	case match != nil:
+		return a.identity(match, r)
+	case legacy:
+		return nil, nil
+	}
+	return nil, errInvalidToken
+}
+
+// identity checks the restrictions of the token a request authenticated with
+func (a *httpAuth) identity(t *apiToken, r *http.Request) (*httpIdentity, error) {
+	if !t.expires.IsZero() && !a.now().Before(t.expires) {
+		return nil, fmt.Errorf("%w: %s", errTokenExpired, t.name)
+	}
+	if !t.allowsSource(remoteHost(r)) {
+		return nil, fmt.Errorf("%w: %s", errSourceNotAllowed, t.name)
+	}
+	return &httpIdentity{Name: t.name, Commands: t.commands}, nil
+}
+
+// verifySignature authenticates a request signed with the secret of a
+// named token, see the client package. Timestamps outside maxSkew and
+// nonces already seen are rejected, so captured requests can't be replayed.
+func (a *httpAuth) verifySignature(r *http.Request) (*httpIdentity, error) {
+	name := r.Header.Get(client.HeaderKey)
+	var t *apiToken
+	for i := range a.tokens {
+		if a.tokens[i].name == name {
+			t = &a.tokens[i]
+		}
+	}
+	if t == nil {
+		return nil, fmt.Errorf("%w: unknown key %q", errBadSignature, name)
+	}
+
+	rawTimestamp := r.Header.Get(client.HeaderTimestamp)
+	nonce := r.Header.Get(client.HeaderNonce)
+	if nonce == "" {
+		return nil, fmt.Errorf("%w: missing nonce", errBadSignature)
+	}
+	expected := client.Signature(string(t.secret), client.StringToSign(r.Method, r.URL, rawTimestamp, nonce))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(r.Header.Get(client.HeaderSignature)))) {
+		return nil, fmt.Errorf("%w: %s", errBadSignature, name)
+	}
+
+	unix, err := strconv.ParseInt(rawTimestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid timestamp", errBadSignature)
+	}
+	now := a.now()
+	timestamp := time.Unix(unix, 0)
+	if timestamp.Before(now.Add(-a.maxSkew)) || timestamp.After(now.Add(a.maxSkew)) {
+		return nil, fmt.Errorf("%w: %s", errStaleTimestamp, name)
+	}
+	// A nonce only needs to be remembered while its timestamp is accepted
+	if !a.nonces.use(name+":"+nonce, timestamp.Add(a.maxSkew), now) {
+		return nil, fmt.Errorf("%w: %s", errReusedNonce, name)
+	}
+	return a.identity(t, r)
+}
+
+// nonceCache remembers the nonces of signed requests until they expire
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: map[string]time.Time{}}
+}
+
+// use records a nonce, returning false if it was already used
+func (c *nonceCache) use(nonce string, expires time.Time, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+// reject records a request refused before authenticating
+func (a *httpAuth) reject(r *http.Request, err error) {
+	if a.dispatcher == nil {
+		return
+	}
+	a.dispatcher.reject(auditEntry{
+		Time:      time.Now(),
+		RequestID: newRequestID(),
+		Provider:  "http",
+		Caller:    remoteHost(r),
+		Command:   strings.TrimPrefix(r.URL.Path, "/cmd/"),
+	}, outcomeUnauthorized, err)
+}
+
+// authMiddleware rejects unauthenticated requests with 401, and clients
+// locked out after too many failures with 429, and passes the identity of
+// the others on to next
+func authMiddleware(auth *httpAuth, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := remoteHost(r)
+		var limitErr *rateLimitError
+		if err := auth.lockout.check(host, auth.now()); errors.As(err, &limitErr) {
+			auth.reject(r, fmt.Errorf("locked out: %w", err))
+			writeRateLimited(w, limitErr)
+			return
+		}
+		identity, err := auth.authenticate(r)
+		if err != nil {
+			auth.lockout.fail(host, auth.now())
+			auth.reject(r, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		auth.lockout.succeed(host)
+		if identity != nil {
+			r = withIdentity(r, identity)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"rpi-bot/client"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPAuth_Authenticate(t *testing.T) {
+	auth := newHTTPAuth(HttpdConfig{
+		AuthToken: "legacy-secret",
+		Tokens: map[string]APIToken{
+			"ci":      {Token: "ci-secret", Commands: []string{"deploy"}, Sources: []string{"10.0.0.0/8", "192.168.1.20"}},
+			"old":     {Token: "old-secret", Expires: "2026-01-31"},
+			"monitor": {Token: "monitor-secret", Expires: "2026-03-01T12:00:00Z"},
+		},
+	}, nil)
+	auth.now = func() time.Time { return time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name         string
+		header       string
+		remoteAddr   string
+		wantIdentity *httpIdentity
+		wantErr      error
+	}{
+		{name: "missing token", wantErr: errMissingToken},
+		{name: "wrong scheme", header: "Bearer ci-secret", wantErr: errMissingToken},
+		{name: "invalid token", header: "Token nope", wantErr: errInvalidToken},
+		{name: "token prefix", header: "Token ci-secre", wantErr: errInvalidToken},
+		{name: "legacy token is anonymous", header: "Token legacy-secret"},
+		{
+			name:         "named token from allowed network",
+			header:       "Token ci-secret",
+			remoteAddr:   "10.1.2.3:5000",
+			wantIdentity: &httpIdentity{Name: "ci", Commands: []string{"deploy"}},
+		},
+		{
+			name:         "named token from allowed address",
+			header:       "Token ci-secret",
+			remoteAddr:   "192.168.1.20:5000",
+			wantIdentity: &httpIdentity{Name: "ci", Commands: []string{"deploy"}},
+		},
+		{name: "named token from other address", header: "Token ci-secret", remoteAddr: "192.168.1.21:5000", wantErr: errSourceNotAllowed},
+		{name: "expired at the end of the day", header: "Token old-secret", wantErr: errTokenExpired},
+		{name: "not expired yet", header: "Token monitor-secret", wantIdentity: &httpIdentity{Name: "monitor"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/cmd/deploy", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			identity, err := auth.authenticate(req)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantIdentity, identity)
+		})
+	}
+}
+
+func TestHTTPAuth_Open(t *testing.T) {
+	identity, err := newHTTPAuth(HttpdConfig{}, nil).authenticate(httptest.NewRequest(http.MethodGet, "/cmd/status", nil))
+	require.NoError(t, err)
+	assert.Nil(t, identity)
+
+	t.Setenv("HTTP_TOKEN_AUTH", "from-env")
+	_, err = newHTTPAuth(HttpdConfig{}, nil).authenticate(httptest.NewRequest(http.MethodGet, "/cmd/status", nil))
+	require.ErrorIs(t, err, errMissingToken)
+}
+
+func TestHttpNamedTokens(t *testing.T) {
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"deploy": {Command: "deploy"},
+			"reboot": {Command: "reboot"},
+		}),
+		executor: &mockExecutor{},
+		audit:    audit,
+	}
+	cfg := &Config{Httpd: HttpdConfig{Tokens: map[string]APIToken{
+		"ci":      {Token: "ci-secret", Commands: []string{"deploy"}},
+		"retired": {Token: "retired-secret", Expires: "2020-01-01"},
+	}}}
+	mux := setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil)
+
+	serve := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Token "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, serve("/cmd/deploy", "ci-secret"))
+	assert.Equal(t, http.StatusForbidden, serve("/cmd/reboot", "ci-secret"))
+	assert.Equal(t, http.StatusUnauthorized, serve("/cmd/deploy", "retired-secret"))
+
+	entries, err := audit.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, []string{"ci", "deploy", outcomeOK}, []string{entries[0].Caller, entries[0].Command, entries[0].Outcome})
+	assert.Equal(t, []string{"ci", "reboot", outcomeUnauthorized}, []string{entries[1].Caller, entries[1].Command, entries[1].Outcome})
+	assert.Equal(t, outcomeUnauthorized, entries[2].Outcome)
+	assert.Equal(t, "token expired: retired", entries[2].Error)
+}
+
+func TestHTTPAuth_Signature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	auth := newHTTPAuth(HttpdConfig{
+		Tokens: map[string]APIToken{
+			"cron": {Token: "cron-secret", HMAC: true, Commands: []string{"df"}},
+			"ci":   {Token: "ci-secret", Sources: []string{"10.0.0.0/8"}},
+		},
+		MaxClockSkewSeconds: 60,
+	}, nil)
+	auth.now = func() time.Time { return now }
+
+	signed := func(path, key, secret string, at time.Time) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, client.Sign(req, key, secret, at))
+		return req
+	}
+
+	req := signed("/cmd/df?path=/", "cron", "cron-secret", now.Add(-30*time.Second))
+	identity, err := auth.authenticate(req)
+	require.NoError(t, err)
+	assert.Equal(t, &httpIdentity{Name: "cron", Commands: []string{"df"}}, identity)
+
+	_, err = auth.authenticate(req)
+	require.ErrorIs(t, err, errReusedNonce, "replayed request")
+
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		wantErr error
+	}{
+		{
+			name:    "stale timestamp",
+			req:     func() *http.Request { return signed("/cmd/df", "cron", "cron-secret", now.Add(-2*time.Minute)) },
+			wantErr: errStaleTimestamp,
+		},
+		{
+			name:    "timestamp in the future",
+			req:     func() *http.Request { return signed("/cmd/df", "cron", "cron-secret", now.Add(2*time.Minute)) },
+			wantErr: errStaleTimestamp,
+		},
+		{
+			name:    "wrong secret",
+			req:     func() *http.Request { return signed("/cmd/df", "cron", "guess", now) },
+			wantErr: errBadSignature,
+		},
+		{
+			name:    "unknown key",
+			req:     func() *http.Request { return signed("/cmd/df", "nobody", "cron-secret", now) },
+			wantErr: errBadSignature,
+		},
+		{
+			name: "tampered query",
+			req: func() *http.Request {
+				req := signed("/cmd/df?path=/", "cron", "cron-secret", now)
+				req.URL.RawQuery = "path=/etc"
+				return req
+			},
+			wantErr: errBadSignature,
+		},
+		{
+			name: "tampered timestamp",
+			req: func() *http.Request {
+				req := signed("/cmd/df", "cron", "cron-secret", now.Add(-2*time.Minute))
+				req.Header.Set(client.HeaderTimestamp, "1700000000")
+				return req
+			},
+			wantErr: errBadSignature,
+		},
+		{
+			name: "signing key used as a token",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/cmd/df", nil)
+				req.Header.Set("Authorization", "Token cron-secret")
+				return req
+			},
+			wantErr: errInvalidToken,
+		},
+		{
+			name:    "token restrictions apply",
+			req:     func() *http.Request { return signed("/cmd/df", "ci", "ci-secret", now) },
+			wantErr: errSourceNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := auth.authenticate(tt.req())
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestHttpSignedClient(t *testing.T) {
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"df": {Command: "df %s", Args: []string{"path"}}}),
+		executor: &mockExecutor{},
+	}
+	cfg := &Config{Httpd: HttpdConfig{Tokens: map[string]APIToken{"cron": {Token: "cron-secret", HMAC: true}}}}
+	srv := httptest.NewServer(setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil))
+	defer srv.Close()
+
+	out, err := client.New(srv.URL, "cron", "cron-secret").Run(context.Background(), "df", url.Values{"path": {"/"}})
+	require.NoError(t, err)
+	assert.Equal(t, "df /", out)
+
+	_, err = client.New(srv.URL, "cron", "wrong").Run(context.Background(), "df", url.Values{"path": {"/"}})
+	require.EqualError(t, err, "401 Unauthorized: unauthorized")
+}
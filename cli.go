@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+const cliUsage = `Usage: rpi-bot [flags] [command] [args]
+
+Commands:
+  serve                        run the bot, the default
+  validate                     validate the config file
+  list                         print the configured commands
+  run <command> [args]         run a configured command locally
+  send <recipient> [text]      send text, or stdin, to a configured recipient
+  call <url> <command> [args]  run a command on a remote bot, see call -help
+
+Flags:
+`
+
+// subcommand describes what a subcommand expects on the command line
+type subcommand struct {
+	usage       string
+	minArgs     int
+	needsConfig bool
+	ownFlags    bool // Its flags aren't the bot's, it parses them itself
+}
+
+var subcommands = map[string]subcommand{
+	"serve":    {needsConfig: true},
+	"validate": {needsConfig: true},
+	"list":     {needsConfig: true},
+	"run":      {usage: "<command> [args]", minArgs: 1, needsConfig: true},
+	"send":     {usage: "<recipient> [text]", minArgs: 1, needsConfig: true},
+	"call":     {ownFlags: true},
+}
+
+// cliCommandError is a command run from the command line that failed,
+// worded like the chat reply
+type cliCommandError struct {
+	command string
+	err     error
+}
+
+func (e *cliCommandError) Error() string { return replyText(e.command, "", e.err) }
+func (e *cliCommandError) Unwrap() error { return e.err }
+
+// cliExitStatus returns the status to exit with after err: the one of the
+// command that failed, 1 otherwise
+func cliExitStatus(err error) int {
+	if code := exitCode(err); code > 0 {
+		return code
+	}
+	return 1
+}
+
+// runSubcommand runs any subcommand but serve
+func runSubcommand(flags cliFlags, stdin io.Reader, stdout io.Writer) error {
+	if flags.command == "call" {
+		return cliCall(flags.args, stdout)
+	}
+	cfg, err := loadConfig(flags.configPath, flags.provider)
+	if err != nil {
+		return err
+	}
+	switch flags.command {
+	case "validate":
+		_, err := fmt.Fprintf(stdout, "%s: config OK\n", flags.configPath)
+		return err
+	case "list":
+		return cliList(cfg, stdout)
+	case "run":
+		audit, err := newAuditLog(cfg.Audit)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = audit.Close() }()
+		d := &dispatcher{
+			commands: newCommandTable(cfg.Commands),
+			executor: &executor{cgroup: cfg.Executor.Cgroup},
+			audit:    audit,
+		}
+		return cliRun(d, flags.args, stdout)
+	case "send":
+		return cliSend(cfg, flags.args, stdin)
+	}
+	return fmt.Errorf("unknown command %q", flags.command)
+}
+
+// cliList prints the configured commands, their args and what they run
+func cliList(cfg *Config, w io.Writer) error {
+	table := newCommandTable(cfg.Commands)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range table.Names() {
+		c, _ := table.Get(name)
+		args := make([]string, len(c.Args))
+		for i, arg := range c.Args {
+			args[i] = "<" + arg + ">"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, strings.Join(args, " "), c.Command)
+	}
+	return tw.Flush()
+}
+
+// cliRun runs a configured command through the dispatcher, audited as the
+// local user, and prints its output
+func cliRun(d *dispatcher, args []string, w io.Writer) error {
+	m := messaging.Message{
+		Type:      messaging.Command,
+		Command:   args[0],
+		Args:      args[1:],
+		Provider:  "cli",
+		User:      localUser(),
+		RequestID: newRequestID(),
+	}
+	output, err := d.run(m)
+	if err != nil {
+		return &cliCommandError{command: m.Command, err: err}
+	}
+	_, err = io.WriteString(w, output)
+	return err
+}
+
+// localUser returns the name of the user running the bot
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// cliSend sends a message to a configured recipient, through its
+// notification sink or the configured provider. Without text in args, it is
+// read from stdin.
+func cliSend(cfg *Config, args []string, stdin io.Reader) error {
+	r, ok := cfg.Recipients[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown recipient %q", args[0])
+	}
+	text := strings.Join(args[1:], " ")
+	if text == "" {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		text = strings.TrimSpace(string(b))
+	}
+	if text == "" {
+		return errors.New("nothing to send")
+	}
+
+	sink, err := recipientSink(r)
+	if err != nil {
+		return err
+	}
+	var sender messaging.MessageSender
+	if sink == nil {
+		sr, err := MessagingFactory(cfg)
+		if err != nil {
+			return err
+		}
+		sender = sr
+	}
+	return notifyRecipient(sender, r, "rpi-bot", text)
+}
+
+// cliCall runs a command on a remote bot through its HTTP API, passing the
+// positional args by name like fleet mode
+func cliCall(args []string, w io.Writer) error {
+	var agent FleetAgent
+	fs := flag.NewFlagSet("call", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: rpi-bot call [flags] <url> <command> [args]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&agent.Token, "token", os.Getenv("RPI_BOT_TOKEN"), "API token, $RPI_BOT_TOKEN by default")
+	fs.StringVar(&agent.Key, "key", os.Getenv("RPI_BOT_KEY"), "HMAC key, $RPI_BOT_KEY by default")
+	fs.StringVar(&agent.Secret, "secret", os.Getenv("RPI_BOT_SECRET"), "HMAC secret, $RPI_BOT_SECRET by default")
+	fs.StringVar(&agent.CAFile, "cafile", "", "CA certificate of the bot")
+	fs.StringVar(&agent.CertFile, "cert", "", "client certificate, for mutual TLS")
+	fs.StringVar(&agent.KeyFile, "certkey", "", "key of the client certificate")
+	timeout := fs.Duration("timeout", defaultFleetTimeoutSeconds*time.Second, "time to wait for the reply")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("usage: rpi-bot call [flags] <url> <command> [args]")
+	}
+	if !agent.hasCredentials() {
+		return errors.New("call needs -token, or -key and -secret")
+	}
+	agent.URL = fs.Arg(0)
+	c, err := agentClient(agent)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	command := fs.Arg(1)
+	output, err := (&fleetAgent{client: c}).run(ctx, command, fs.Args()[2:])
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("no reply within %s", *timeout)
+	}
+	if err != nil {
+		return &cliCommandError{command: command, err: err}
+	}
+	_, err = io.WriteString(w, output)
+	return err
+}
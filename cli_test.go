@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    cliFlags
+		wantErr string
+	}{
+		{name: "serve by default", args: []string{"-config", path}, want: cliFlags{configPath: path, command: "serve"}},
+		{
+			name: "check",
+			args: []string{"-config", path, "-check"},
+			want: cliFlags{configPath: path, check: true, command: "validate"},
+		},
+		{
+			name: "flags after the subcommand",
+			args: []string{"run", "-config", path, "df", "-h"},
+			want: cliFlags{configPath: path, command: "run", args: []string{"df", "-h"}},
+		},
+		{
+			name: "call parses its own flags",
+			args: []string{"call", "-token", "x", "http://pi:8080", "uptime"},
+			want: cliFlags{configPath: "./config.yaml", command: "call", args: []string{"-token", "x", "http://pi:8080", "uptime"}},
+		},
+		{name: "missing args", args: []string{"-config", path, "send"}, wantErr: "usage: rpi-bot send <recipient> [text]"},
+		{name: "unknown subcommand", args: []string{"-config", path, "start"}, wantErr: `unknown command "start"`},
+		{name: "missing config", args: []string{"list"}, wantErr: "config.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, err := ParseFlags(tt.args)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, flags)
+		})
+	}
+}
+
+func TestCliList(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, cliList(&Config{Commands: map[string]Command{
+		"uptime": {Command: "uptime"},
+		"df":     {Command: "df -h %s", Args: []string{"path"}},
+	}}, &out))
+	assert.Equal(t, "df      <path>  df -h %s\nuptime          uptime\n", out.String())
+}
+
+func TestCliRun(t *testing.T) {
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"df": {Command: "df %s", Args: []string{"path"}}}),
+		executor: &mockExecutor{},
+		audit:    audit,
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, cliRun(d, []string{"df", "/home"}, &out))
+	assert.Equal(t, "df /home", out.String())
+
+	err := cliRun(d, []string{"df"}, &out)
+	assert.EqualError(t, err, "Command formatting failed: mismatch between command definition args=1 and number of args=0")
+	assert.Equal(t, 1, cliExitStatus(err))
+	assert.EqualError(t, cliRun(d, []string{"reboot"}, &out), "Command not supported")
+
+	entries, err := audit.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "cli", entries[0].Provider)
+	assert.Equal(t, localUser(), entries[0].Caller)
+	assert.Equal(t, outcomeOK, entries[0].Outcome)
+}
+
+func TestCliRun_ExitStatus(t *testing.T) {
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"fail": {Command: "fail"}}),
+		executor: &mockExitExecutor{},
+	}
+	err := cliRun(d, []string{"fail"}, io.Discard)
+	require.Error(t, err)
+	assert.Equal(t, 3, cliExitStatus(err))
+}
+
+// mockExitExecutor fails like a command exiting with status 3
+type mockExitExecutor struct{}
+
+func (e *mockExitExecutor) execCommand(string, Command) (string, error) {
+	return "", exec.Command("sh", "-c", "exit 3").Run()
+}
+
+func TestCliSend(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = append(got, string(body))
+	}))
+	defer srv.Close()
+	cfg := &Config{Recipients: map[string]Recipient{
+		"hooks": {Webhook: &WebhookSinkConfig{URL: srv.URL, Body: "{{.Title}}: {{.Message}}"}},
+		"ops":   {ChatID: 42},
+	}}
+
+	require.NoError(t, cliSend(cfg, []string{"hooks", "disk", "full"}, strings.NewReader("")))
+	require.NoError(t, cliSend(cfg, []string{"hooks"}, strings.NewReader("from stdin\n")))
+	assert.Equal(t, []string{"rpi-bot: disk full", "rpi-bot: from stdin"}, got)
+
+	assert.EqualError(t, cliSend(cfg, []string{"hooks"}, strings.NewReader("")), "nothing to send")
+	assert.EqualError(t, cliSend(cfg, []string{"admins", "hi"}, nil), `unknown recipient "admins"`)
+	// Chat recipients need the provider
+	assert.ErrorIs(t, cliSend(cfg, []string{"ops", "hi"}, nil), errNoProvider)
+}
+
+func TestCliCall(t *testing.T) {
+	srv := newTestAgent(t, map[string]Command{
+		"df":     {Command: "df %s", Args: []string{"path"}},
+		"reboot": {Command: "reboot"},
+	})
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		wantErr string
+	}{
+		{name: "positional args", args: []string{"-token", "agent-secret", srv.URL, "df", "/home"}, want: "df /home"},
+		{
+			name:    "missing args",
+			args:    []string{"-token", "agent-secret", srv.URL, "df"},
+			wantErr: "Command formatting failed: mismatch between command definition args=1 and number of args=0",
+		},
+		{name: "not allowed", args: []string{"-token", "agent-secret", srv.URL, "reboot"}, wantErr: "Command not supported"},
+		{name: "bad token", args: []string{"-token", "nope", srv.URL, "df", "/"}, wantErr: "Command df failed: 401"},
+		{name: "no credentials", args: []string{srv.URL, "df", "/"}, wantErr: "call needs -token, or -key and -secret"},
+		{name: "missing command", args: []string{"-token", "agent-secret", srv.URL}, wantErr: "usage: rpi-bot call"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RPI_BOT_TOKEN", "")
+			var out bytes.Buffer
+			err := cliCall(tt.args, &out)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Package client calls the rpi-bot HTTP API, signing requests with HMAC-SHA256
+// so a captured request can't be replayed.
+//
+// A signed request carries the key name, a Unix timestamp, a random nonce
+// and the hex HMAC-SHA256 of StringToSign in the X-Signature-* headers:
+//
+//	c := client.New("https://raspberrypi:8443", "cron", secret)
+//	out, err := c.Run(ctx, "df", url.Values{"path": {"/"}})
+//
+// A Client without a secret sends its API token instead.
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers of a signed request
+const (
+	HeaderKey       = "X-Signature-Key"
+	HeaderTimestamp = "X-Signature-Timestamp"
+	HeaderNonce     = "X-Signature-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+// StringToSign returns the canonical form of a request covered by the
+// signature: method, path, sorted query, timestamp and nonce, one per line
+func StringToSign(method string, u *url.URL, timestamp string, nonce string) string {
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		u.EscapedPath(),
+		u.Query().Encode(),
+		timestamp,
+		nonce,
+	}, "\n")
+}
+
+// Signature returns the hex HMAC-SHA256 of message with secret
+func Signature(secret string, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign adds the signature headers to req, signed at time now
+func Sign(req *http.Request, key string, secret string, now time.Time) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	req.Header.Set(HeaderKey, key)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, Signature(secret, StringToSign(req.Method, req.URL, timestamp, nonce)))
+	return nil
+}
+
+// Client runs commands through the HTTP API with signed requests, or with
+// Token if Secret is empty
+type Client struct {
+	BaseURL    string
+	Key        string
+	Secret     string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// CommandInfo describes a command of the bot, as listed by `/commands`
+type CommandInfo struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"` // Query parameter names, in placeholder order
+	// The args redacted in logs, which callers should keep out of theirs
+	Sensitive []string `json:"sensitive,omitempty"`
+}
+
+// New returns a Client using http.DefaultClient
+func New(baseURL string, key string, secret string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Key: key, Secret: secret, HTTPClient: http.DefaultClient}
+}
+
+// NewWithToken returns a Client sending an API token, using http.DefaultClient
+func NewWithToken(baseURL string, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token, HTTPClient: http.DefaultClient}
+}
+
+// Run executes a command with its args and returns its output
+func (c *Client) Run(ctx context.Context, command string, args url.Values) (string, error) {
+	body, err := c.get(ctx, "/cmd/"+url.PathEscape(command), args)
+	return string(body), err
+}
+
+// Commands returns the commands the client may run, sorted by name
+func (c *Client) Commands(ctx context.Context) ([]CommandInfo, error) {
+	body, err := c.get(ctx, "/commands", nil)
+	if err != nil {
+		return nil, err
+	}
+	var commands []CommandInfo
+	if err := json.Unmarshal(body, &commands); err != nil {
+		return nil, fmt.Errorf("invalid command list: %w", err)
+	}
+	return commands, nil
+}
+
+// get sends an authenticated GET request and returns the body of a 200 response
+func (c *Client) get(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Secret != "" {
+		if err := Sign(req, c.Key, c.Secret, time.Now()); err != nil {
+			return nil, err
+		}
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.Token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status, Message: strings.TrimSpace(string(body))}
+	}
+	return body, nil
+}
+
+// StatusError is the error of a request the bot answered with a status
+// other than 200
+type StatusError struct {
+	Code    int
+	Status  string // As "400 Bad Request"
+	Message string // The body of the response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStringToSign(t *testing.T) {
+	u, err := url.Parse("https://pi:8443/cmd/df?path=%2Fhome&b=2&a=1")
+	require.NoError(t, err)
+	assert.Equal(t,
+		"GET\n/cmd/df\na=1&b=2&path=%2Fhome\n1700000000\nabc",
+		StringToSign("get", u, "1700000000", "abc"),
+	)
+}
+
+func TestSign(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+	now := time.Unix(1700000000, 0)
+	require.NoError(t, Sign(req, "cron", "secret", now))
+
+	assert.Equal(t, "cron", req.Header.Get(HeaderKey))
+	assert.Equal(t, "1700000000", req.Header.Get(HeaderTimestamp))
+	nonce := req.Header.Get(HeaderNonce)
+	assert.Len(t, nonce, 32)
+	assert.Equal(t,
+		Signature("secret", "GET\n/cmd/status\n\n1700000000\n"+nonce),
+		req.Header.Get(HeaderSignature),
+	)
+
+	other := httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+	require.NoError(t, Sign(other, "cron", "secret", now))
+	assert.NotEqual(t, nonce, other.Header.Get(HeaderNonce), "every request gets a new nonce")
+}
+
+func TestClient_Run(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sig := Signature("secret", StringToSign(r.Method, r.URL, r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce)))
+		if r.Header.Get(HeaderSignature) != sig {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(r.URL.Path + " " + r.URL.Query().Get("path")))
+	}))
+	defer srv.Close()
+
+	out, err := New(srv.URL+"/", "cron", "secret").Run(context.Background(), "df", url.Values{"path": {"/"}})
+	require.NoError(t, err)
+	assert.Equal(t, "/cmd/df /", out)
+
+	_, err = New(srv.URL, "cron", "wrong").Run(context.Background(), "df", nil)
+	require.EqualError(t, err, "401 Unauthorized: unauthorized")
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusUnauthorized, statusErr.Code)
+}
+
+func TestClient_Commands(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/commands" || r.Header.Get("Authorization") != "Token abc" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"name":"df","args":["path"]},{"name":"uptime","args":[]}]`))
+	}))
+	defer srv.Close()
+
+	commands, err := NewWithToken(srv.URL, "abc").Commands(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []CommandInfo{{Name: "df", Args: []string{"path"}}, {Name: "uptime", Args: []string{}}}, commands)
+
+	_, err = NewWithToken(srv.URL, "wrong").Commands(context.Background())
+	require.EqualError(t, err, "401 Unauthorized: unauthorized")
+}
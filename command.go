@@ -1,35 +1,145 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"maps"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"os/exec"
 	"rpi-bot/messaging"
 )
 
+// commandWaitDelay is how long the output of a command is read after it
+// exits, while processes it started in the background keep it open
+const commandWaitDelay = time.Second
+
+// commandExecutor runs a formatted command line with the working
+// directory, environment and user of its definition
 type commandExecutor interface {
-	execCommand(command string) (string, error)
+	execCommand(command string, c Command) (string, error)
 }
 
-type executor struct{}
+type executor struct {
+	// cgroup is the delegated cgroup v2 directory memory limits are
+	// enforced in, rlimits are used if empty
+	cgroup string
+}
 
-func (e *executor) execCommand(command string) (string, error) {
+func (e *executor) execCommand(command string, c Command) (string, error) {
 	parsedCommand := strings.Split(command, " ")
 	if len(parsedCommand) == 0 {
 		return "", fmt.Errorf("empty command")
 	}
 
 	cmd := exec.Command(parsedCommand[0], parsedCommand[1:]...)
+	cmd.Dir = c.Workdir
+	cmd.Env = commandEnv(c, os.Environ())
+	var cred *credential
+	if c.User != "" || c.Group != "" {
+		resolved, err := lookupCredential(c.User, c.Group)
+		if err != nil {
+			return "", err
+		}
+		cred = &resolved
+	}
+	useCgroup := c.Limits.MemoryMB > 0 && e.cgroup != ""
+	switch {
+	case c.sandboxed(useCgroup):
+		// The trampoline switches user itself, after setting up mounts
+		if err := sandboxCommand(cmd, c, cred, useCgroup); err != nil {
+			return "", err
+		}
+	case cred != nil:
+		attr, err := credentialAttr(*cred)
+		if err != nil {
+			return "", err
+		}
+		cmd.SysProcAttr = attr
+	}
+	var cg *commandCgroup
+	if useCgroup {
+		var err error
+		if cg, err = newCommandCgroup(e.cgroup, c.Limits.MemoryMB); err != nil {
+			return "", err
+		}
+		defer cg.remove()
+		cg.attach(cmd)
+	}
 
-	output, err := cmd.CombinedOutput()
+	// The processes the command starts are killed with it: they would
+	// otherwise keep its output open, and Wait blocked
+	setProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
 
-	log.Printf("Executed command %s. result: %s. Err %s", command, output, err)
-	if err != nil {
+	// The output isn't logged: it may contain secrets. The dispatcher logs
+	// its size instead
+	output := &outputBuffer{max: c.Limits.OutputBytes}
+	output.exceeded = func() { killProcessGroup(cmd) }
+	cmd.Stdout, cmd.Stderr = output, output
+	err := cmd.Run()
+	// Like the cgroup, what the command left running in the background is
+	// killed. Its output so far is the command's.
+	killProcessGroup(cmd)
+	if errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	switch {
+	case output.overflowed():
+		return "", outputLimitError(c.Limits.OutputBytes)
+	case err != nil && cg != nil && cg.oomKilled():
+		return "", &limitError{limit: fmt.Sprintf("memory limit of %d MB", c.Limits.MemoryMB)}
+	case err != nil && cpuLimitExceeded(cmd.ProcessState, c.Limits.CPUSeconds):
+		return "", &limitError{limit: fmt.Sprintf("cpu time limit of %ds", c.Limits.CPUSeconds)}
+	case err != nil:
 		return "", err
 	}
-	return string(output), nil
+	return output.String(), nil
+}
+
+// commandEnv returns the environment of a command: the bot's environment,
+// or only its inheritEnv variables with clearEnv, plus the command's env
+func commandEnv(c Command, environ []string) []string {
+	if !c.ClearEnv && len(c.Env) == 0 {
+		// nil makes exec inherit the environment as is
+		return nil
+	}
+	env := make([]string, 0, len(environ)+len(c.Env))
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := c.Env[name]; ok {
+			continue
+		}
+		if !c.ClearEnv || slices.Contains(c.InheritEnv, name) {
+			env = append(env, kv)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Env)) {
+		env = append(env, name+"="+c.Env[name])
+	}
+	return env
+}
+
+// checkArgs checks the values of the args of c. The formatted command line
+// is split on spaces, so a value with whitespace would add args to the
+// command: only the configured allowed values may have some.
+func checkArgs(c Command, args []string) error {
+	for i, name := range c.Args {
+		values := c.ArgSpecs[name].Values
+		switch {
+		case len(values) > 0 && !slices.Contains(values, args[i]):
+			return fmt.Errorf("%s must be one of %s", name, strings.Join(values, ", "))
+		case len(values) == 0 && strings.ContainsFunc(args[i], unicode.IsSpace):
+			return fmt.Errorf("%s must not contain whitespace", name)
+		}
+	}
+	return nil
 }
 
 func createCommand(c Command, m messaging.Message) (string, error) {
@@ -40,6 +150,10 @@ func createCommand(c Command, m messaging.Message) (string, error) {
 		)
 	}
 
+	if err := checkArgs(c, m.Args); err != nil {
+		return "", err
+	}
+
 	placeholderCount := strings.Count(c.Command, "%s")
 
 	if placeholderCount != len(c.Args) {
@@ -61,3 +175,61 @@ func createCommand(c Command, m messaging.Message) (string, error) {
 
 	return fmt.Sprintf(c.Command, iface...), nil
 }
+
+// credential is the identity a command runs as
+type credential struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups"` // Supplementary groups, nil to keep the bot's
+}
+
+// lookupCredential resolves the user and group, names or numeric ids, a
+// command runs as. Without a group the user's primary group is used,
+// without a user the bot's.
+func lookupCredential(userName, groupName string) (credential, error) {
+	var cred credential
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return cred, fmt.Errorf("unknown user %q", userName)
+			}
+		}
+		if cred.UID, err = parseID(u.Uid); err != nil {
+			return cred, err
+		}
+		if cred.GID, err = parseID(u.Gid); err != nil {
+			return cred, err
+		}
+		cred.Groups = []uint32{}
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := parseID(id); err == nil {
+					cred.Groups = append(cred.Groups, gid)
+				}
+			}
+		}
+	} else {
+		cred.UID, cred.GID = uint32(os.Getuid()), uint32(os.Getgid())
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return cred, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		if cred.GID, err = parseID(g.Gid); err != nil {
+			return cred, err
+		}
+	}
+	return cred, nil
+}
+
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported user or group id %q", id)
+	}
+	return uint32(n), nil
+}
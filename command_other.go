@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+func credentialAttr(credential) (*syscall.SysProcAttr, error) {
+	return nil, errors.New("running commands as another user is not supported on this platform")
+}
+
+func setProcessGroup(*exec.Cmd) {}
+
+// killProcessGroup kills the command only, without process groups
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
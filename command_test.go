@@ -1,9 +1,16 @@
 package main
 
 import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
 	"rpi-bot/messaging"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -116,6 +123,44 @@ func TestCreateCommand(t *testing.T) {
 			expectError: true,
 			errorMsg:    "mismatch between placeholders (%s)=0 and number of args=1",
 		},
+		{
+			name: "Allowed value",
+			commandDef: Command{
+				Command:  "systemctl restart %s",
+				Args:     []string{"service"},
+				ArgSpecs: map[string]ArgSpec{"service": {Values: []string{"nginx", "ssh"}}},
+			},
+			message:     messaging.Message{Args: []string{"ssh"}},
+			expectedCmd: "systemctl restart ssh",
+		},
+		{
+			name: "Value not allowed",
+			commandDef: Command{
+				Command:  "systemctl restart %s",
+				Args:     []string{"service"},
+				ArgSpecs: map[string]ArgSpec{"service": {Values: []string{"nginx", "ssh"}}},
+			},
+			message:     messaging.Message{Args: []string{"docker"}},
+			expectError: true,
+			errorMsg:    "service must be one of nginx, ssh",
+		},
+		{
+			name:        "Value with whitespace",
+			commandDef:  Command{Command: "ping -c 1 %s", Args: []string{"host"}},
+			message:     messaging.Message{Args: []string{"8.8.8.8 -f"}},
+			expectError: true,
+			errorMsg:    "host must not contain whitespace",
+		},
+		{
+			name: "Allowed value with whitespace",
+			commandDef: Command{
+				Command:  "echo %s",
+				Args:     []string{"greeting"},
+				ArgSpecs: map[string]ArgSpec{"greeting": {Values: []string{"good morning"}}},
+			},
+			message:     messaging.Message{Args: []string{"good morning"}},
+			expectedCmd: "echo good morning",
+		},
 	}
 	for _, tt := range tests {
 		tt := tt // capture range variable
@@ -132,3 +177,118 @@ func TestCreateCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestCommandEnv(t *testing.T) {
+	environ := []string{"PATH=/usr/bin", "HOME=/home/bot", "TELEGRAM_APITOKEN=secret"}
+	tests := []struct {
+		name    string
+		command Command
+		want    []string
+	}{
+		{name: "inherited as is", command: Command{}, want: nil},
+		{
+			name:    "env added and overridden",
+			command: Command{Env: map[string]string{"HOME": "/srv", "MODE": "prod"}},
+			want:    []string{"PATH=/usr/bin", "TELEGRAM_APITOKEN=secret", "HOME=/srv", "MODE=prod"},
+		},
+		{name: "cleared", command: Command{ClearEnv: true}, want: []string{}},
+		{
+			name: "cleared with allowlist",
+			command: Command{
+				ClearEnv:   true,
+				InheritEnv: []string{"PATH"},
+				Env:        map[string]string{"MODE": "prod"},
+			},
+			want: []string{"PATH=/usr/bin", "MODE=prod"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, commandEnv(tt.command, environ))
+		})
+	}
+}
+
+func TestExecutor_WorkdirAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	e := &executor{}
+
+	output, err := e.execCommand("pwd", Command{Workdir: dir})
+	require.NoError(t, err)
+	resolved, err := filepath.EvalSymlinks(dir)
+	require.NoError(t, err)
+	assert.Equal(t, resolved, strings.TrimSpace(output))
+
+	t.Setenv("RPI_BOT_LEAKED", "secret")
+	output, err = e.execCommand("env", Command{
+		ClearEnv:   true,
+		InheritEnv: []string{"PATH"},
+		Env:        map[string]string{"GREETING": "hello"},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, output, "GREETING=hello")
+	assert.Contains(t, output, "PATH=")
+	assert.NotContains(t, output, "RPI_BOT_LEAKED")
+}
+
+func TestLookupCredential(t *testing.T) {
+	current, err := user.Current()
+	require.NoError(t, err)
+
+	cred, err := lookupCredential(current.Username, "")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(os.Getuid()), cred.UID)
+	assert.NotNil(t, cred.Groups, "the user's supplementary groups are set")
+
+	byID, err := lookupCredential(current.Uid, current.Gid)
+	require.NoError(t, err)
+	assert.Equal(t, cred.UID, byID.UID)
+	assert.Equal(t, uint32(os.Getgid()), byID.GID)
+
+	groupOnly, err := lookupCredential("", current.Gid)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(os.Getuid()), groupOnly.UID)
+	assert.Nil(t, groupOnly.Groups, "the bot's supplementary groups are kept")
+
+	_, err = lookupCredential("surely-not-a-user", "")
+	assert.EqualError(t, err, `unknown user "surely-not-a-user"`)
+	_, err = lookupCredential("", "surely-not-a-group")
+	assert.EqualError(t, err, `unknown group "surely-not-a-group"`)
+}
+
+func TestExecutor_RunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running as another user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	output, err := (&executor{}).execCommand("id -u", Command{User: "nobody"})
+	require.NoError(t, err)
+	assert.Equal(t, nobody.Uid, strings.TrimSpace(output))
+}
+
+func TestExecutor_BackgroundProcesses(t *testing.T) {
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755))
+		return path
+	}
+	e := &executor{}
+
+	// A process left in the background doesn't hold the reply
+	start := time.Now()
+	output, err := e.execCommand(script("detach.sh", "sleep 30 &\necho started\n"), Command{})
+	require.NoError(t, err)
+	assert.Equal(t, "started\n", output)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// Nor one started by a command stopped at its output limit
+	start = time.Now()
+	var limitErr *limitError
+	_, err = e.execCommand(script("flood.sh", "sleep 30 &\nyes\n"), Command{Limits: CommandLimits{OutputBytes: 1000}})
+	require.True(t, errors.As(err, &limitErr), "got %v", err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// credentialAttr switches the command to another user, which requires the
+// bot to run as root or with CAP_SETUID and CAP_SETGID
+func credentialAttr(cred credential) (*syscall.SysProcAttr, error) {
+	return &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid:         cred.UID,
+		Gid:         cred.GID,
+		Groups:      cred.Groups,
+		NoSetGroups: cred.Groups == nil,
+	}}, nil
+}
+
+// setProcessGroup starts the command in a process group of its own, so the
+// processes it starts can be killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the process group of a started command
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+
+	"rpi-bot/messaging"
+)
+
+const (
+	defaultDiscoveryService         = "_rpi-bot._tcp"
+	defaultDiscoveryIntervalSeconds = 60
+	// discoveryDomain is the mDNS domain services are advertised in
+	discoveryDomain = "local."
+)
+
+// discoveryQueryTimeout is how long a browse waits for answers
+var discoveryQueryTimeout = 3 * time.Second
+
+// commandsHash identifies a command table, so bots serving the same
+// commands can be told apart from the others at a glance
+func commandsHash(t *commandTable) string {
+	h := sha256.New()
+	for _, name := range t.Names() {
+		c, _ := t.Get(name)
+		fmt.Fprintf(h, "%s\x00%s\n", name, strings.Join(c.Args, "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// discoveryInstance returns the name the bot is advertised as, its
+// hostname unless configured
+func discoveryInstance(cfg DiscoveryConfig) (string, error) {
+	if cfg.Instance != "" {
+		return cfg.Instance, nil
+	}
+	return os.Hostname()
+}
+
+// advertisedZone answers the mDNS queries for the bot's service, with the
+// hash of the current command table so reloads are advertised too
+type advertisedZone struct {
+	instance string
+	service  string
+	port     int
+	ips      []net.IP
+	scheme   string
+	commands *commandTable
+
+	mu   sync.Mutex
+	hash string
+	svc  *mdns.MDNSService
+}
+
+func (z *advertisedZone) Records(q dns.Question) []dns.RR {
+	svc, err := z.current()
+	if err != nil {
+		slog.Error("mdns: error building the service records", "error", err)
+		return nil
+	}
+	return svc.Records(q)
+}
+
+// current returns the service records of the current command table
+func (z *advertisedZone) current() (*mdns.MDNSService, error) {
+	hash := commandsHash(z.commands)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.svc != nil && z.hash == hash {
+		return z.svc, nil
+	}
+	txt := []string{"commands=" + hash, "scheme=" + z.scheme}
+	svc, err := mdns.NewMDNSService(z.instance, z.service, discoveryDomain, z.instance+"."+discoveryDomain, z.port, z.ips, txt)
+	if err != nil {
+		return nil, err
+	}
+	z.hash, z.svc = hash, svc
+	return svc, nil
+}
+
+// newAdvertisedZone returns the zone advertising the HTTP server of cfg
+func newAdvertisedZone(cfg *Config, commands *commandTable) (*advertisedZone, error) {
+	instance, err := discoveryInstance(cfg.Discovery)
+	if err != nil {
+		return nil, err
+	}
+	host, portStr, err := net.SplitHostPort(cfg.Httpd.Addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = []net.IP{ip}
+	} else if ips, err = localIPs(); err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if cfg.Httpd.TLS.enabled() {
+		scheme = "https"
+	}
+	return &advertisedZone{
+		instance: instance,
+		service:  cmp.Or(cfg.Discovery.Service, defaultDiscoveryService),
+		port:     port,
+		ips:      ips,
+		scheme:   scheme,
+		commands: commands,
+	}, nil
+}
+
+// localIPs returns the addresses of the interfaces that are up, loopback
+// excluded: the hostname often resolves to 127.0.1.1 on Raspberry Pi OS
+func localIPs() ([]net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no network address to advertise")
+	}
+	return ips, nil
+}
+
+// Advertise announces the HTTP server on the local network until ctx is done
+func Advertise(ctx context.Context, cfg *Config, commands *commandTable, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	zone, err := newAdvertisedZone(cfg, commands)
+	if err != nil {
+		slog.Error("mdns: not advertising", "error", err)
+		return
+	}
+	server, err := mdns.NewServer(&mdns.Config{Zone: zone})
+	if err != nil {
+		slog.Error("mdns: not advertising", "error", err)
+		return
+	}
+	slog.Info("mdns: advertising", "instance", zone.instance, "service", zone.service, "port", zone.port)
+	<-ctx.Done()
+	if err := server.Shutdown(); err != nil {
+		slog.Error("mdns: shutdown error", "error", err)
+	}
+}
+
+// peer is a bot found on the local network
+type peer struct {
+	Host     string // The instance name it is advertised as
+	URL      string // Of its HTTP API
+	Commands string // Hash of its command table
+	LastSeen time.Time
+}
+
+// discovery browses the local network for the other bots. A nil
+// *discovery is valid and finds nothing.
+type discovery struct {
+	service  string
+	self     string // The bot's own instance, skipped
+	interval time.Duration
+	// query runs a browse, mdns.Query but in tests
+	query func(*mdns.QueryParam) error
+
+	mu    sync.Mutex
+	peers map[string]peer // By host
+}
+
+func newDiscovery(cfg DiscoveryConfig) *discovery {
+	d := &discovery{
+		service:  cmp.Or(cfg.Service, defaultDiscoveryService),
+		interval: time.Duration(cmp.Or(cfg.IntervalSeconds, defaultDiscoveryIntervalSeconds)) * time.Second,
+		query:    mdns.Query,
+		peers:    map[string]peer{},
+	}
+	if cfg.Advertise {
+		d.self, _ = discoveryInstance(cfg)
+	}
+	return d
+}
+
+// browse queries the network once, adding the bots that answer and
+// forgetting the ones that haven't for three intervals
+func (d *discovery) browse(now time.Time) error {
+	entries := make(chan *mdns.ServiceEntry, 32)
+	params := mdns.DefaultParams(d.service)
+	params.Entries = entries
+	params.Timeout = discoveryQueryTimeout
+	// Without IPv6 multicast on the network, the client logs an error every
+	// time. The answers still carry the IPv6 addresses.
+	params.DisableIPv6 = true
+	err := d.query(params)
+	close(entries)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for e := range entries {
+		if p, ok := parsePeer(e, d.service, now); ok && p.Host != d.self {
+			d.peers[p.Host] = p
+		}
+	}
+	for host, p := range d.peers {
+		if now.Sub(p.LastSeen) > 3*d.interval {
+			delete(d.peers, host)
+		}
+	}
+	return err
+}
+
+// parsePeer converts an answer to a browse, with the TXT fields set by
+// advertisedZone
+func parsePeer(e *mdns.ServiceEntry, service string, now time.Time) (peer, bool) {
+	suffix := "." + strings.Trim(service, ".") + "." + discoveryDomain
+	host, ok := strings.CutSuffix(e.Name, suffix)
+	if !ok || host == "" {
+		return peer{}, false
+	}
+	// The instance name is escaped in DNS presentation format
+	host = strings.ReplaceAll(host, `\`, "")
+	ip := e.AddrV4
+	if ip == nil {
+		ip = e.AddrV6
+	}
+	if ip == nil || e.Port == 0 {
+		return peer{}, false
+	}
+	p := peer{Host: host, LastSeen: now}
+	scheme := "http"
+	for _, field := range e.InfoFields {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "commands":
+			p.Commands = value
+		case "scheme":
+			scheme = value
+		}
+	}
+	p.URL = scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(e.Port))
+	return p, true
+}
+
+// Run browses the network every interval until ctx is done
+func (d *discovery) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.browse(time.Now()); err != nil {
+			slog.Warn("mdns: browse failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Peers returns the bots found, sorted by host
+func (d *discovery) Peers() []peer {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := make([]peer, 0, len(d.peers))
+	for _, p := range d.peers {
+		peers = append(peers, p)
+	}
+	slices.SortFunc(peers, func(a, b peer) int { return strings.Compare(a.Host, b.Host) })
+	return peers
+}
+
+// lookup returns the bot found as host
+func (d *discovery) lookup(host string) (peer, bool) {
+	if d == nil {
+		return peer{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.peers[host]
+	return p, ok
+}
+
+// hostsCommand implements `/hosts`, listing the bots found on the network
+func hostsCommand(d *dispatcher, _ messaging.Message) (string, error) {
+	if d.discovery == nil {
+		return "", errors.New("discovery is not enabled")
+	}
+	peers := d.discovery.Peers()
+	if len(peers) == 0 {
+		return "No bots found", nil
+	}
+	now := time.Now()
+	var b strings.Builder
+	for _, p := range peers {
+		fmt.Fprintf(&b, "%s %s commands=%s seen %s ago\n",
+			p.Host, p.URL, p.Commands, now.Sub(p.LastSeen).Round(time.Second))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/pem"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rpi-bot/messaging"
+)
+
+func TestCommandsHash(t *testing.T) {
+	table := newCommandTable(map[string]Command{
+		"df":     {Command: "df %s", Args: []string{"path"}},
+		"uptime": {Command: "uptime"},
+	})
+	hash := commandsHash(table)
+	assert.Len(t, hash, 12)
+	// Only names and args count, not what runs
+	assert.Equal(t, hash, commandsHash(newCommandTable(map[string]Command{
+		"df":     {Command: "df -h %s", Args: []string{"path"}},
+		"uptime": {Command: "uptime -p"},
+	})))
+	assert.NotEqual(t, hash, commandsHash(newCommandTable(map[string]Command{
+		"df":     {Command: "df %s", Args: []string{"mount"}},
+		"uptime": {Command: "uptime"},
+	})))
+}
+
+func TestAdvertisedZone(t *testing.T) {
+	commands := newCommandTable(map[string]Command{"uptime": {Command: "uptime"}})
+	zone, err := newAdvertisedZone(&Config{
+		Httpd:     HttpdConfig{Enabled: true, Addr: "192.168.1.20:8443", TLS: TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}},
+		Discovery: DiscoveryConfig{Advertise: true, Instance: "pi-garage"},
+	}, commands)
+	require.NoError(t, err)
+
+	records := zone.Records(dns.Question{Name: "_rpi-bot._tcp.local.", Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+	require.NotEmpty(t, records)
+	assert.Equal(t, "pi-garage._rpi-bot._tcp.local.", records[0].(*dns.PTR).Ptr)
+
+	txt := func() []string {
+		records := zone.Records(dns.Question{Name: "pi-garage._rpi-bot._tcp.local.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET})
+		require.Len(t, records, 1)
+		return records[0].(*dns.TXT).Txt
+	}
+	assert.Equal(t, []string{"commands=" + commandsHash(commands), "scheme=https"}, txt())
+	// A reload is advertised at once
+	commands.Swap(map[string]Command{"df": {Command: "df %s", Args: []string{"path"}}})
+	assert.Equal(t, []string{"commands=" + commandsHash(commands), "scheme=https"}, txt())
+}
+
+// fakeBrowse returns a query answering with entries
+func fakeBrowse(entries ...*mdns.ServiceEntry) func(*mdns.QueryParam) error {
+	return func(params *mdns.QueryParam) error {
+		for _, e := range entries {
+			params.Entries <- e
+		}
+		return nil
+	}
+}
+
+func TestDiscovery_Browse(t *testing.T) {
+	d := newDiscovery(DiscoveryConfig{Browse: true, Advertise: true, Instance: "pi-attic"})
+	d.query = fakeBrowse(
+		&mdns.ServiceEntry{
+			Name: "pi-garage._rpi-bot._tcp.local.", AddrV4: net.ParseIP("192.168.1.20"), Port: 8443,
+			InfoFields: []string{"commands=0123456789ab", "scheme=https"},
+		},
+		&mdns.ServiceEntry{Name: `pi\ kitchen._rpi-bot._tcp.local.`, AddrV6: net.ParseIP("fd00::21"), Port: 8080},
+		// Itself, another service and an answer without an address
+		&mdns.ServiceEntry{Name: "pi-attic._rpi-bot._tcp.local.", AddrV4: net.ParseIP("192.168.1.22"), Port: 8080},
+		&mdns.ServiceEntry{Name: "printer._ipp._tcp.local.", AddrV4: net.ParseIP("192.168.1.30"), Port: 631},
+		&mdns.ServiceEntry{Name: "pi-cellar._rpi-bot._tcp.local.", Port: 8080},
+	)
+	now := time.Now()
+	require.NoError(t, d.browse(now))
+	assert.Equal(t, []peer{
+		{Host: "pi kitchen", URL: "http://[fd00::21]:8080", LastSeen: now},
+		{Host: "pi-garage", URL: "https://192.168.1.20:8443", Commands: "0123456789ab", LastSeen: now},
+	}, d.Peers())
+
+	// Bots that stop answering are forgotten after three intervals
+	d.query = fakeBrowse()
+	require.NoError(t, d.browse(now.Add(3*d.interval)))
+	assert.Len(t, d.Peers(), 2)
+	require.NoError(t, d.browse(now.Add(3*d.interval+time.Second)))
+	assert.Empty(t, d.Peers())
+}
+
+func TestDiscoveredAgents(t *testing.T) {
+	shed := httptest.NewTLSServer(testAgentHandler(map[string]Command{"uptime": {Command: "uptime"}}))
+	defer shed.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: shed.Certificate().Raw}), 0o600))
+	u, err := url.Parse(shed.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	disc := newDiscovery(DiscoveryConfig{Browse: true})
+	// The advertised scheme is ignored, credentials only go over TLS
+	disc.query = fakeBrowse(&mdns.ServiceEntry{
+		Name: "pi-shed._rpi-bot._tcp.local.", AddrV4: net.ParseIP(u.Hostname()), Port: port,
+		InfoFields: []string{"commands=0123456789ab", "scheme=http"},
+	})
+	require.NoError(t, disc.browse(time.Now()))
+
+	// Without credentials, discovered bots are only listed
+	f, err := newFleet(FleetConfig{}, disc)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+	d := &dispatcher{commands: newCommandTable(nil), discovery: disc}
+	reply := chatReply(d, messaging.Message{Type: messaging.Command, Command: "hosts"})
+	assert.Equal(t, "pi-shed http://"+u.Host+" commands=0123456789ab seen 0s ago\n", reply)
+	// Nor without a CA to verify them
+	f, err = newFleet(FleetConfig{Discovered: FleetAgent{Token: "agent-secret"}}, disc)
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	f, err = newFleet(FleetConfig{Discovered: FleetAgent{Token: "agent-secret", CAFile: caFile}}, disc)
+	require.NoError(t, err)
+	d.fleet = f
+	assert.Equal(t, "uptime", chatReply(d, messaging.Message{Type: messaging.Command, Command: "uptime@pi-shed"}))
+	reply = chatReply(d, messaging.Message{Type: messaging.Command, Command: "all", Args: []string{"uptime"}})
+	assert.Equal(t, "[pi-shed]\nuptime\n", reply)
+}
+
+func TestDiscoveredAgents_UntrustedCertificate(t *testing.T) {
+	impostor := httptest.NewTLSServer(testAgentHandler(map[string]Command{"uptime": {Command: "uptime"}}))
+	defer impostor.Close()
+	// A certificate for the same address, of another CA
+	otherCA, _, err := generateSelfSigned([]string{"127.0.0.1"}, time.Now())
+	require.NoError(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, otherCA, 0o600))
+	u, err := url.Parse(impostor.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.NoError(t, err)
+
+	disc := newDiscovery(DiscoveryConfig{Browse: true})
+	disc.query = fakeBrowse(&mdns.ServiceEntry{Name: "pi-shed._rpi-bot._tcp.local.", AddrV4: net.ParseIP(u.Hostname()), Port: port})
+	require.NoError(t, disc.browse(time.Now()))
+	f, err := newFleet(FleetConfig{Discovered: FleetAgent{Token: "agent-secret", CAFile: caFile}}, disc)
+	require.NoError(t, err)
+	d := &dispatcher{commands: newCommandTable(nil), discovery: disc, fleet: f}
+	reply := chatReply(d, messaging.Message{Type: messaging.Command, Command: "uptime@pi-shed"})
+	assert.Contains(t, reply, "certificate")
+}
+
+func TestHostsCommand_NoDiscovery(t *testing.T) {
+	d := &dispatcher{commands: newCommandTable(nil)}
+	assert.Equal(t, "Command hosts failed: discovery is not enabled",
+		chatReply(d, messaging.Message{Type: messaging.Command, Command: "hosts"}))
+}
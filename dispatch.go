@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+var (
+	errUnknownCommand = errors.New("command not supported")
+	errBusy           = errors.New("too many commands running")
+	// errCommandNotAllowed is returned when the caller may not run the command
+	errCommandNotAllowed = errors.New("command not allowed")
+)
+
+// formatError is returned when the command line can't be built from the message
+type formatError struct {
+	err error
+}
+
+func (e *formatError) Error() string { return e.err.Error() }
+func (e *formatError) Unwrap() error { return e.err }
+
+// execError is returned when the executed command fails
+type execError struct {
+	command string
+	err     error
+}
+
+func (e *execError) Error() string { return fmt.Sprintf("Command %s failed: %v", e.command, e.err) }
+func (e *execError) Unwrap() error { return e.err }
+
+// dispatcher is the single path every provider, the HTTP API and webhooks
+// use to run configured commands, so each attempt is handled and audited
+// the same way
+type dispatcher struct {
+	commands *commandTable
+	executor commandExecutor
+	audit    *auditLog
+	history  *historyStore
+	metrics  *botMetrics
+	health   *healthMonitor
+	limits   *rateLimiter
+	fleet    *fleet // Agents commands are relayed to, nil if not a controller
+	// discovery lists the bots found on the network, nil if not browsing
+	discovery *discovery
+	// prompts holds the chat conversations asking for missing args, nil to
+	// reply with an error instead
+	prompts *promptStore
+	admins  []Recipient
+	// slots bounds the commands running at once, nil for no limit
+	slots   chan struct{}
+	running atomic.Int32
+}
+
+// newSlots returns the semaphore limiting concurrent commands to max,
+// or nil if max isn't positive
+func newSlots(max int) chan struct{} {
+	if max <= 0 {
+		return nil
+	}
+	return make(chan struct{}, max)
+}
+
+// acquire takes an execution slot without waiting
+func (d *dispatcher) acquire() bool {
+	if d.slots == nil {
+		return true
+	}
+	select {
+	case d.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *dispatcher) release() {
+	if d.slots != nil {
+		<-d.slots
+	}
+}
+
+// run looks up the command requested by the message, formats it with the
+// message args and executes it
+func (d *dispatcher) run(m messaging.Message) (string, error) {
+	entry := d.auditEntry(m)
+
+	// Unknown commands count against the global and caller limits too, a
+	// flood of them still costs a reply each
+	c, ok := d.commands.Get(m.Command)
+	if err := d.limits.allow(m, c, time.Now()); err != nil {
+		d.reject(entry, outcomeRateLimited, err)
+		return "", err
+	}
+	if !ok {
+		d.reject(entry, outcomeRejected, errUnknownCommand)
+		return "", errUnknownCommand
+	}
+
+	fmtCommand, err := createCommand(c, m)
+	if err != nil {
+		d.reject(entry, outcomeRejected, err)
+		return "", &formatError{err: err}
+	}
+	entry.Argv = redactArgv(c, m.Args, strings.Split(fmtCommand, " "))
+	if !d.acquire() {
+		d.reject(entry, outcomeRejected, errBusy)
+		return "", errBusy
+	}
+	logger := messageLogger(m)
+	logger.Debug("executing command", "argv", entry.Argv)
+
+	start := time.Now()
+	d.metrics.started()
+	d.running.Add(1)
+	output, err := d.executor.execCommand(fmtCommand, c)
+	d.running.Add(-1)
+	d.metrics.finished()
+	d.release()
+	elapsed := time.Since(start)
+	entry.DurationMs = elapsed.Milliseconds()
+	entry.OutputSize = len(output)
+	var limitErr *limitError
+	if errors.As(err, &limitErr) {
+		entry.Outcome = outcomeLimitExceeded
+		entry.Error = err.Error()
+		entry.ExitCode = -1
+	} else if err != nil {
+		entry.Outcome = outcomeFailed
+		entry.Error = err.Error()
+		entry.ExitCode = exitCode(err)
+	} else {
+		entry.Outcome = outcomeOK
+	}
+	logger.Info("command executed",
+		"outcome", entry.Outcome, "exit_code", entry.ExitCode,
+		"duration_ms", entry.DurationMs, "output_size", entry.OutputSize,
+	)
+	d.record(entry, elapsed)
+	d.recordHistory(m, entry, output)
+
+	if err != nil {
+		return "", &execError{command: fmtCommand, err: err}
+	}
+	return output, nil
+}
+
+// recordHistory stores an execution so it can be looked up and rerun later.
+// Like the audit log, it doesn't keep the values of sensitive args.
+func (d *dispatcher) recordHistory(m messaging.Message, entry auditEntry, output string) {
+	_, err := d.history.Add(historyEntry{
+		Time:     entry.Time,
+		Provider: m.Provider,
+		Caller:   m.User,
+		Chat:     chatKey(m),
+		Command:  m.Command,
+		Args:     entry.Args,
+		Output:   output,
+		Error:    entry.Error,
+		ExitCode: entry.ExitCode,
+	})
+	if err != nil {
+		messageLogger(m).Error("error storing history", "error", err)
+	}
+}
+
+// reject records an attempt that was refused before executing anything
+func (d *dispatcher) reject(entry auditEntry, outcome string, reason error) {
+	entry.Outcome = outcome
+	entry.Error = reason.Error()
+	entry.ExitCode = -1
+	slog.Warn("command refused",
+		"request_id", entry.RequestID, "provider", entry.Provider, "caller", entry.Caller,
+		"command", entry.Command, "outcome", outcome, "reason", reason,
+	)
+	d.record(entry, 0)
+}
+
+// record writes an attempt to the audit log and the metrics
+func (d *dispatcher) record(entry auditEntry, elapsed time.Duration) {
+	d.audit.Record(entry)
+	d.metrics.observe(d.commandLabel(entry.Command), entry, elapsed)
+}
+
+// isAdmin reports whether the message comes from one of the admin recipients
+func (d *dispatcher) isAdmin(m messaging.Message) bool {
+	for _, r := range d.admins {
+		if (r.ChatID != 0 && r.ChatID == m.ChatID) || (r.Source != "" && r.Source == m.Source) ||
+			(r.Room != "" && r.Room == m.Room) || (r.Topic != "" && r.Topic == m.Topic) ||
+			(r.Email != "" && strings.EqualFold(r.Email, m.Email)) || (r.Channel != "" && r.Channel == m.Channel) ||
+			(r.Console != "" && m.Provider == "console" && r.Console == m.User) {
+			return true
+		}
+	}
+	return false
+}
+
+// exitCode returns the exit status of a failed command, or -1 if it
+// didn't get to run
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// adminRecipients resolves the admin recipient names of the config
+func adminRecipients(cfg *Config) []Recipient {
+	admins := make([]Recipient, 0, len(cfg.Admins))
+	for _, name := range cfg.Admins {
+		if r, ok := cfg.Recipients[name]; ok {
+			admins = append(admins, r)
+		}
+	}
+	return admins
+}
+
+// builtinCommand is a chat command implemented by the bot itself
+type builtinCommand struct {
+	adminOnly bool
+	run       func(d *dispatcher, m messaging.Message) (string, error)
+}
+
+// builtins take precedence over configured commands, which can't reuse their
+// names. They are set in init, the commands they run look them up.
+var builtins map[string]builtinCommand
+
+func init() {
+	builtins = map[string]builtinCommand{
+		"all":     {run: allCommand},
+		"audit":   {adminOnly: true, run: auditCommand},
+		"cancel":  {run: cancelCommand},
+		"history": {run: historyCommand},
+		"hosts":   {run: hostsCommand},
+		"last":    {run: lastCommand},
+		"rerun":   {run: rerunCommand},
+	}
+}
+
+// parseCount parses the optional `[n]` argument of builtin commands
+func parseCount(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid count %q", args[0])
+	}
+	return n, nil
+}
+
+// auditCommand implements `/audit [n]`, listing the most recent audit entries
+func auditCommand(d *dispatcher, m messaging.Message) (string, error) {
+	if d.audit == nil {
+		return "", errors.New("audit log is not enabled")
+	}
+	n, err := parseCount(m.Args, 10)
+	if err != nil {
+		return "", err
+	}
+	entries, err := d.audit.Recent(n)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "No audit entries", nil
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s %s %s /%s %s",
+			e.Time.Format(time.RFC3339), e.Provider, e.Caller, e.Command, e.Outcome)
+		if e.Outcome == outcomeOK || e.Outcome == outcomeFailed || e.Outcome == outcomeLimitExceeded {
+			fmt.Fprintf(&b, " exit=%d %dms", e.ExitCode, e.DurationMs)
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"cmp"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+// Defaults of the email provider
+const (
+	defaultEmailMailbox      = "INBOX"
+	defaultEmailPollInterval = 30 * time.Second
+	defaultIMAPSecurity      = "tls"
+	defaultSMTPSecurity      = "starttls"
+)
+
+// mailSecurities are the accepted security settings of the mail servers
+var mailSecurities = []string{"", "tls", "starttls", "none"}
+
+// emailOptions resolves the email configuration, applying the defaults
+func emailOptions(cfg EmailConfig) messaging.EmailOptions {
+	imapPassword, _ := GetSecret("EMAIL_IMAP_PASSWORD", cfg.IMAP.Password)
+	smtpPassword, _ := GetSecret("EMAIL_SMTP_PASSWORD", cfg.SMTP.Password)
+	pollInterval := time.Duration(cfg.PollIntervalSeconds) * time.Second
+	if pollInterval <= 0 {
+		pollInterval = defaultEmailPollInterval
+	}
+	return messaging.EmailOptions{
+		IMAP: messaging.MailServer{
+			Addr:     cfg.IMAP.Addr,
+			Username: cfg.IMAP.Username,
+			Password: imapPassword,
+			Security: cmp.Or(cfg.IMAP.Security, defaultIMAPSecurity),
+		},
+		SMTP: messaging.MailServer{
+			Addr:     cfg.SMTP.Addr,
+			Username: cfg.SMTP.Username,
+			Password: smtpPassword,
+			Security: cmp.Or(cfg.SMTP.Security, defaultSMTPSecurity),
+		},
+		Mailbox:      cmp.Or(cfg.Mailbox, defaultEmailMailbox),
+		From:         cmp.Or(cfg.From, cfg.IMAP.Username),
+		PollInterval: pollInterval,
+		Idle:         cfg.Idle,
+		Senders:      cfg.Senders,
+		Secret:       cfg.Secret,
+		RequireDKIM:  cfg.RequireDKIM,
+		AuthservID:   cfg.AuthservID,
+	}
+}
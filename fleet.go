@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"rpi-bot/client"
+	"rpi-bot/messaging"
+)
+
+const defaultFleetTimeoutSeconds = 30
+
+var errUnknownHost = errors.New("unknown host")
+
+// fleet relays commands to agent bots through their HTTP API, making this
+// bot the controller holding the chat connection. A nil *fleet is valid and
+// has no agents.
+type fleet struct {
+	agents  map[string]*fleetAgent // By host name
+	timeout time.Duration          // Per agent, listing its commands included
+
+	// discovery finds the agents that aren't configured, called with the
+	// discovered credentials. Both are nil to only relay to agents.
+	discovery  *discovery
+	discovered *FleetAgent
+	mu         sync.Mutex
+	found      map[string]*fleetAgent // Discovered agents by URL
+}
+
+// fleetAgent is an agent bot and the command table it last listed
+type fleetAgent struct {
+	client *client.Client
+
+	mu       sync.Mutex
+	commands map[string]client.CommandInfo // Nil until listed
+}
+
+// newFleet returns the fleet of agents of the config and, with
+// credentials and a CA for them, of the bots disc finds. It is nil without
+// either.
+func newFleet(cfg FleetConfig, disc *discovery) (*fleet, error) {
+	relayDiscovered := disc != nil && cfg.Discovered.hasCredentials() && cfg.Discovered.CAFile != ""
+	if len(cfg.Agents) == 0 && !relayDiscovered {
+		return nil, nil
+	}
+	timeout := cfg.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultFleetTimeoutSeconds
+	}
+	f := &fleet{
+		agents:  make(map[string]*fleetAgent, len(cfg.Agents)),
+		timeout: time.Duration(timeout) * time.Second,
+	}
+	for host, a := range cfg.Agents {
+		c, err := agentClient(a)
+		if err != nil {
+			return nil, fmt.Errorf("fleet.agents %q: %w", host, err)
+		}
+		f.agents[host] = &fleetAgent{client: c}
+	}
+	if relayDiscovered {
+		f.discovery, f.discovered = disc, &cfg.Discovered
+		f.found = map[string]*fleetAgent{}
+	}
+	return f, nil
+}
+
+// hasCredentials reports whether the agent has a token or a signing key
+func (a FleetAgent) hasCredentials() bool {
+	return a.Token != "" || a.Secret != ""
+}
+
+// agentClient returns the HTTP API client of an agent, signing requests
+// if it has an HMAC secret
+func agentClient(a FleetAgent) (*client.Client, error) {
+	c := client.NewWithToken(a.URL, a.Token)
+	if a.Secret != "" {
+		c = client.New(a.URL, a.Key, a.Secret)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if a.CAFile != "" {
+		pool, err := loadCertPool(a.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if a.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	c.HTTPClient = &http.Client{Transport: transport}
+	return c, nil
+}
+
+// hosts returns the host names of the agents, configured and discovered,
+// sorted
+func (f *fleet) hosts() []string {
+	if f == nil {
+		return nil
+	}
+	hosts := slices.Collect(maps.Keys(f.agents))
+	for _, p := range f.discovery.Peers() {
+		if _, ok := f.agents[p.Host]; !ok {
+			hosts = append(hosts, p.Host)
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// agent returns the agent of host, configured or discovered
+func (f *fleet) agent(host string) (*fleetAgent, error) {
+	if f == nil {
+		return nil, errUnknownHost
+	}
+	if agent, ok := f.agents[host]; ok {
+		return agent, nil
+	}
+	p, ok := f.discovery.lookup(host)
+	if !ok {
+		return nil, errUnknownHost
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// By URL: a host moving to another address gets a new client
+	if agent, ok := f.found[p.URL]; ok {
+		return agent, nil
+	}
+	// Anyone on the network can advertise a bot: the credentials only go
+	// over TLS, to a bot with a certificate of the configured CA, whatever
+	// scheme it advertises
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = "https"
+	cfg := *f.discovered
+	cfg.URL = u.String()
+	c, err := agentClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	agent := &fleetAgent{client: c}
+	f.found[p.URL] = agent
+	return agent, nil
+}
+
+// args returns the arg names of a command of the agent. The command table
+// is listed again when the command isn't in it or refresh is set, the agent
+// may have reloaded its config since.
+func (a *fleetAgent) args(ctx context.Context, command string, refresh bool) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, ok := a.commands[command]; ok && !refresh {
+		return c.Args, nil
+	}
+	list, err := a.client.Commands(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.commands = make(map[string]client.CommandInfo, len(list))
+	for _, c := range list {
+		a.commands[c.Name] = c
+	}
+	c, ok := a.commands[command]
+	if !ok {
+		return nil, errUnknownCommand
+	}
+	return c.Args, nil
+}
+
+// command returns the args of a command of the agent of host as last
+// listed, without listing them
+func (f *fleet) command(host, name string) (Command, bool) {
+	agent, err := f.agent(host)
+	if err != nil {
+		return Command{}, false
+	}
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	c, ok := agent.commands[name]
+	if !ok {
+		return Command{}, false
+	}
+	return Command{Args: c.Args, SensitiveArgs: c.Sensitive}, true
+}
+
+// run executes a command on the agent of host, within the fleet timeout
+func (f *fleet) run(ctx context.Context, host, command string, args []string) (string, error) {
+	agent, err := f.agent(host)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	output, err := agent.run(ctx, command, args)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "", fmt.Errorf("no reply within %s", f.timeout)
+	}
+	return output, err
+}
+
+// run executes a command on the agent, passing the positional args of the
+// chat message as the named query parameters the agent expects
+func (a *fleetAgent) run(ctx context.Context, command string, args []string) (string, error) {
+	names, err := a.args(ctx, command, false)
+	if err != nil {
+		return "", err
+	}
+	if len(names) != len(args) {
+		// The args may have changed on the agent since listed
+		if names, err = a.args(ctx, command, true); err != nil {
+			return "", err
+		}
+	}
+	if len(names) != len(args) {
+		// The agent would refuse it the same way, see createCommand
+		return "", &formatError{err: fmt.Errorf(
+			"mismatch between command definition args=%d and number of args=%d",
+			len(names), len(args),
+		)}
+	}
+	if err := checkArgs(Command{Args: names}, args); err != nil {
+		return "", &formatError{err: err}
+	}
+	query := url.Values{}
+	for i, name := range names {
+		query.Set(name, args[i])
+	}
+	output, err := a.client.Run(ctx, command, query)
+	var statusErr *client.StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == http.StatusBadRequest {
+		// Also the answer to args the agent doesn't expect: list them again
+		// for the next run
+		_, _ = a.args(ctx, command, true)
+	}
+	return output, err
+}
+
+// relay runs `/command@host` on an agent, rate limited and audited like a
+// local command
+func (d *dispatcher) relay(m messaging.Message, host string) (string, error) {
+	if err := d.limits.allow(m, Command{}, time.Now()); err != nil {
+		d.reject(d.relayAuditEntry(m, host), outcomeRateLimited, err)
+		return "", err
+	}
+	return d.relayTo(m, host)
+}
+
+// relayTo runs a command on an agent, without checking the rate limits
+func (d *dispatcher) relayTo(m messaging.Message, host string) (string, error) {
+	start := time.Now()
+	output, err := d.fleet.run(context.Background(), host, m.Command, m.Args)
+	elapsed := time.Since(start)
+	// After running, the agent has listed its commands
+	entry := d.relayAuditEntry(m, host)
+	var fmtErr *formatError
+	switch {
+	case errors.Is(err, errUnknownHost), errors.Is(err, errUnknownCommand), errors.As(err, &fmtErr):
+		d.reject(entry, outcomeRejected, err)
+		return "", err
+	case err != nil:
+		entry.Outcome = outcomeFailed
+		entry.Error = err.Error()
+		entry.ExitCode = -1
+	default:
+		entry.Outcome = outcomeOK
+	}
+	entry.DurationMs = elapsed.Milliseconds()
+	entry.OutputSize = len(output)
+	messageLogger(m).Info("command relayed",
+		"host", host, "outcome", entry.Outcome, "duration_ms", entry.DurationMs, "output_size", entry.OutputSize,
+	)
+	d.record(entry, elapsed)
+	return output, err
+}
+
+// allCommand implements `/all <command> [args]`, running the command on
+// every agent at once and replying with the output of each host
+func allCommand(d *dispatcher, m messaging.Message) (string, error) {
+	hosts := d.fleet.hosts()
+	if len(hosts) == 0 {
+		return "", errors.New("fleet mode is not enabled")
+	}
+	if len(m.Args) == 0 {
+		return "", errors.New("usage: /all <command> [args]")
+	}
+	if err := d.limits.allow(m, Command{}, time.Now()); err != nil {
+		// The args are for the agents, which define the sensitive ones
+		entry := newAuditEntry(m)
+		entry.Args = append(m.Args[:1:1], redactAll(m.Args[1:])...)
+		d.reject(entry, outcomeRateLimited, err)
+		return "", err
+	}
+	relayed := m
+	relayed.Command, relayed.Args = m.Args[0], m.Args[1:]
+
+	replies := make([]string, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output, err := d.relayTo(relayed, host)
+			replies[i] = replyText(relayed.Command+"@"+host, output, err)
+		}()
+	}
+	wg.Wait()
+
+	var b strings.Builder
+	for i, host := range hosts {
+		fmt.Fprintf(&b, "[%s]\n%s\n", host, strings.TrimRight(replies[i], "\n"))
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rpi-bot/messaging"
+)
+
+// newTestAgent serves the HTTP API of an agent bot allowing the
+// "controller" token to run df and uptime
+func newTestAgent(t *testing.T, commands map[string]Command) *httptest.Server {
+	srv := httptest.NewServer(testAgentHandler(commands))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testAgentHandler is the HTTP API of newTestAgent
+func testAgentHandler(commands map[string]Command) http.Handler {
+	d := &dispatcher{commands: newCommandTable(commands), executor: &mockExecutor{}}
+	cfg := &Config{Httpd: HttpdConfig{Tokens: map[string]APIToken{
+		"controller": {Token: "agent-secret", Commands: []string{"df", "uptime"}},
+	}}}
+	return setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil)
+}
+
+func TestHttpCommandsHandler(t *testing.T) {
+	srv := newTestAgent(t, map[string]Command{
+		"df":     {Command: "df %s", Args: []string{"path"}},
+		"reboot": {Command: "reboot"},
+		"uptime": {Command: "uptime"},
+	})
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/commands", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Token agent-secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	// reboot isn't allowed to the token
+	assert.JSONEq(t, `[{"name":"df","args":["path"]},{"name":"uptime","args":[]}]`, string(body))
+
+	resp, err = http.Get(srv.URL + "/commands")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestFleet(t *testing.T) {
+	garage := newTestAgent(t, map[string]Command{
+		"df":     {Command: "df %s", Args: []string{"path"}, SensitiveArgs: []string{"path"}},
+		"uptime": {Command: "uptime"},
+	})
+	kitchen := newTestAgent(t, map[string]Command{"uptime": {Command: "uptime -p"}})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	f, err := newFleet(FleetConfig{Agents: map[string]FleetAgent{
+		"pi-garage":  {URL: garage.URL, Token: "agent-secret"},
+		"pi-kitchen": {URL: kitchen.URL, Token: "agent-secret"},
+		"pi-attic":   {URL: slow.URL, Token: "agent-secret"},
+	}}, nil)
+	require.NoError(t, err)
+	f.timeout = 200 * time.Millisecond
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{commands: newCommandTable(nil), executor: &mockExecutor{}, audit: audit, fleet: f}
+
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+		want    string
+	}{
+		{name: "positional args", command: "df@pi-garage", args: []string{"/home"}, want: "df /home"},
+		{name: "unknown host", command: "df@pi-cellar", args: []string{"/"}, want: "Unknown host"},
+		{name: "unknown command", command: "df@pi-kitchen", args: []string{"/"}, want: "Command not supported"},
+		{
+			name:    "missing args",
+			command: "df@pi-garage",
+			want:    "Command formatting failed: mismatch between command definition args=1 and number of args=0",
+		},
+		{name: "timeout", command: "uptime@pi-attic", want: "Command uptime@pi-attic failed: no reply within 200ms"},
+		{
+			name:    "every host",
+			command: "all",
+			args:    []string{"uptime"},
+			want: "[pi-attic]\nCommand uptime@pi-attic failed: no reply within 200ms\n" +
+				"[pi-garage]\nuptime\n" +
+				"[pi-kitchen]\nuptime -p\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := messaging.Message{Type: messaging.Command, Command: tt.command, Args: tt.args, Provider: "telegram", User: "42"}
+			assert.Equal(t, tt.want, chatReply(d, m))
+		})
+	}
+
+	// Relayed commands are audited by the controller too, one entry per host
+	entries, err := audit.Recent(20)
+	require.NoError(t, err)
+	outcomes := map[string]string{}
+	for _, e := range entries {
+		assert.Equal(t, "42", e.Caller)
+		outcomes[e.Command] = e.Outcome
+		// The agent defines the sensitive args, all are redacted while unknown
+		for _, arg := range e.Args {
+			assert.Equal(t, redacted, arg, e.Command)
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"df@pi-cellar":      outcomeRejected,
+		"df@pi-garage":      outcomeRejected, // The missing args attempt, after the first one
+		"df@pi-kitchen":     outcomeRejected,
+		"uptime@pi-attic":   outcomeFailed,
+		"uptime@pi-garage":  outcomeOK,
+		"uptime@pi-kitchen": outcomeOK,
+	}, outcomes)
+}
+
+func TestFleet_ReloadedAgent(t *testing.T) {
+	commands := newCommandTable(map[string]Command{"df": {Command: "df %s", Args: []string{"path"}}})
+	agent := &dispatcher{commands: commands, executor: &mockExecutor{}}
+	cfg := &Config{Httpd: HttpdConfig{Tokens: map[string]APIToken{
+		"controller": {Token: "agent-secret", Commands: []string{"df"}},
+	}}}
+	srv := httptest.NewServer(setupMux(cfg, &httpCommandHandler{dispatcher: agent}, nil))
+	defer srv.Close()
+
+	f, err := newFleet(FleetConfig{Agents: map[string]FleetAgent{
+		"pi-garage": {URL: srv.URL, Token: "agent-secret"},
+	}}, nil)
+	require.NoError(t, err)
+	d := &dispatcher{commands: newCommandTable(nil), executor: &mockExecutor{}, fleet: f}
+	df := func(args ...string) string {
+		m := messaging.Message{Type: messaging.Command, Command: "df@pi-garage", Args: args, Provider: "telegram", User: "42"}
+		return chatReply(d, m)
+	}
+	require.Equal(t, "df /", df("/"))
+
+	// An arg added on the agent: the arg count mismatch lists them again
+	commands.Swap(map[string]Command{"df": {Command: "df %s %s", Args: []string{"flags", "path"}}})
+	assert.Equal(t, "df -h /", df("-h", "/"))
+
+	// An arg renamed: the agent refuses the first run
+	commands.Swap(map[string]Command{"df": {Command: "df %s %s", Args: []string{"options", "dir"}}})
+	assert.Equal(t, `Command df@pi-garage failed: 400 Bad Request: missing required query parameter "options"`, df("-h", "/"))
+	assert.Equal(t, "df -h /", df("-h", "/"))
+}
+
+func TestAllCommand_NoFleet(t *testing.T) {
+	d := &dispatcher{commands: newCommandTable(nil)}
+	m := messaging.Message{Type: messaging.Command, Command: "all", Args: []string{"uptime"}}
+	assert.Equal(t, "Command all failed: fleet mode is not enabled", chatReply(d, m))
+	// Without a fleet, @ isn't routed
+	m = messaging.Message{Type: messaging.Command, Command: "uptime@pi-garage"}
+	assert.Equal(t, "Command not supported", chatReply(d, m))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthStarting = "starting" // No successful poll yet
+	healthBusy     = "busy"     // Every executor slot taken
+
+	defaultMaxPollAge = 60 * time.Second
+)
+
+// healthMonitor tracks the messaging providers to report whether the bot
+// is ready to serve. A nil *healthMonitor is valid and watches nothing.
+type healthMonitor struct {
+	maxPollAge time.Duration
+
+	mu          sync.Mutex
+	providers   map[string]messaging.MessageClient
+	watched     map[string]time.Time
+	lastMessage map[string]time.Time
+}
+
+func newHealthMonitor(cfg HealthConfig) *healthMonitor {
+	maxPollAge := time.Duration(cfg.MaxPollAgeSeconds) * time.Second
+	if maxPollAge <= 0 {
+		maxPollAge = defaultMaxPollAge
+	}
+	return &healthMonitor{
+		maxPollAge:  maxPollAge,
+		providers:   map[string]messaging.MessageClient{},
+		watched:     map[string]time.Time{},
+		lastMessage: map[string]time.Time{},
+	}
+}
+
+// watchProvider includes a messaging client in the readiness checks
+func (h *healthMonitor) watchProvider(name string, client messaging.MessageClient) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.providers[name] = client
+	h.watched[name] = time.Now()
+}
+
+// messageReceived records the time a provider last delivered a message
+func (h *healthMonitor) messageReceived(provider string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastMessage[provider] = time.Now()
+}
+
+// providerHealth is the readiness detail of a messaging provider
+type providerHealth struct {
+	Name        string     `json:"name"`
+	Status      string     `json:"status"`
+	Connected   *bool      `json:"connected,omitempty"`
+	LastPoll    *time.Time `json:"lastPoll,omitempty"`
+	LastMessage *time.Time `json:"lastMessage,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+}
+
+// executorHealth is the readiness detail of the command executor
+type executorHealth struct {
+	Status        string `json:"status"`
+	Running       int    `json:"running"`
+	MaxConcurrent int    `json:"maxConcurrent,omitempty"`
+}
+
+// readiness is the body of /health/ready
+type readiness struct {
+	Status    string           `json:"status"`
+	Providers []providerHealth `json:"providers"`
+	Executor  executorHealth   `json:"executor"`
+}
+
+// check reports the state of every watched provider, sorted by name
+func (h *healthMonitor) check(now time.Time) []providerHealth {
+	if h == nil {
+		return []providerHealth{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	checks := make([]providerHealth, 0, len(h.providers))
+	for name, client := range h.providers {
+		p := providerHealth{Name: name, Status: healthOK}
+		if last, ok := h.lastMessage[name]; ok {
+			p.LastMessage = &last
+		}
+		if reporter, ok := client.(messaging.StatusReporter); ok {
+			connected := reporter.Connected()
+			p.Connected = &connected
+			if !connected {
+				p.Status, p.Reason = healthDegraded, "not connected"
+			}
+		}
+		if reporter, ok := client.(messaging.ActivityReporter); ok {
+			last := reporter.LastActivity()
+			switch {
+			case !last.IsZero():
+				p.LastPoll = &last
+				if p.Status == healthOK && now.Sub(last) > h.maxPollAge {
+					p.Status, p.Reason = healthDegraded, "no successful poll within "+h.maxPollAge.String()
+				}
+			case p.Status == healthOK && now.Sub(h.watched[name]) > h.maxPollAge:
+				// Never polled: starting up until the first poll is overdue
+				p.Status, p.Reason = healthDegraded, "no successful poll since start"
+			case p.Status == healthOK:
+				p.Status = healthStarting
+			}
+		}
+		checks = append(checks, p)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
+
+// readiness reports whether the providers are up. A busy executor is
+// reported but doesn't fail readiness: commands are refused until a slot
+// frees up, restarting the bot wouldn't help.
+func (d *dispatcher) readiness() readiness {
+	r := readiness{
+		Status:    healthOK,
+		Providers: d.health.check(time.Now()),
+		Executor: executorHealth{
+			Status:        healthOK,
+			Running:       int(d.running.Load()),
+			MaxConcurrent: cap(d.slots),
+		},
+	}
+	if d.slots != nil && len(d.slots) == cap(d.slots) {
+		r.Executor.Status = healthBusy
+	}
+	for _, p := range r.Providers {
+		if p.Status == healthDegraded {
+			r.Status = healthDegraded
+		}
+	}
+	return r
+}
+
+// httpReadyHandler serves /health/ready, answering 503 when degraded so
+// supervisors can restart a broken bot
+type httpReadyHandler struct {
+	dispatcher *dispatcher
+}
+
+func (h *httpReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ready := h.dispatcher.readiness()
+	if ready.Status != healthOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, ready)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pollingClient is a MessageClient reporting its connection state and
+// last successful poll
+type pollingClient struct {
+	MockMessageClient
+	up       bool
+	lastPoll time.Time
+}
+
+func (c *pollingClient) Connected() bool         { return c.up }
+func (c *pollingClient) LastActivity() time.Time { return c.lastPoll }
+
+// blockingExecutor runs commands until release is closed
+type blockingExecutor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (e *blockingExecutor) execCommand(command string, _ Command) (string, error) {
+	e.started <- struct{}{}
+	<-e.release
+	return command, nil
+}
+
+func TestHealthMonitor_Check(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		client     messaging.MessageClient
+		watched    time.Time
+		wantStatus string
+		wantReason string
+	}{
+		{name: "no status reported", client: new(MockMessageClient), wantStatus: healthOK},
+		{name: "connected", client: &connectedClient{up: true}, wantStatus: healthOK},
+		{name: "disconnected", client: &connectedClient{up: false}, wantStatus: healthDegraded, wantReason: "not connected"},
+		{name: "recent poll", client: &pollingClient{up: true, lastPoll: now.Add(-5 * time.Second)}, wantStatus: healthOK},
+		{
+			name:       "stale poll",
+			client:     &pollingClient{up: true, lastPoll: now.Add(-2 * time.Minute)},
+			wantStatus: healthDegraded,
+			wantReason: "no successful poll within 1m0s",
+		},
+		{name: "never polled", client: &pollingClient{up: true}, wantStatus: healthStarting},
+		{
+			name:       "never polled since start",
+			client:     &pollingClient{up: true},
+			watched:    now.Add(-2 * time.Minute),
+			wantStatus: healthDegraded,
+			wantReason: "no successful poll since start",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHealthMonitor(HealthConfig{})
+			h.watchProvider("telegram", tt.client)
+			if !tt.watched.IsZero() {
+				h.watched["telegram"] = tt.watched
+			}
+			checks := h.check(now)
+			require.Len(t, checks, 1)
+			assert.Equal(t, tt.wantStatus, checks[0].Status)
+			assert.Equal(t, tt.wantReason, checks[0].Reason)
+		})
+	}
+}
+
+func TestHttpReady(t *testing.T) {
+	client := &pollingClient{up: true, lastPoll: time.Now()}
+	health := newHealthMonitor(HealthConfig{MaxPollAgeSeconds: 30})
+	health.watchProvider("telegram", client)
+	health.messageReceived("telegram")
+
+	exec := &blockingExecutor{started: make(chan struct{}), release: make(chan struct{})}
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"status": {Command: "uptime"}}),
+		executor: exec,
+		health:   health,
+		slots:    newSlots(1),
+	}
+	mux := setupMux(&Config{}, &httpCommandHandler{dispatcher: d}, nil)
+
+	ready := func() (int, readiness) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+		var body readiness
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		return rr.Code, body
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rr.Body.String())
+
+	code, body := ready()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOK, body.Status)
+	require.Len(t, body.Providers, 1)
+	assert.NotNil(t, body.Providers[0].LastPoll)
+	assert.NotNil(t, body.Providers[0].LastMessage)
+	assert.Equal(t, executorHealth{Status: healthOK, MaxConcurrent: 1}, body.Executor)
+
+	// A running command takes the only slot: the executor is busy, but
+	// the bot is still ready
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = d.run(messaging.Message{Command: "status"})
+	}()
+	<-exec.started
+
+	code, body = ready()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOK, body.Status)
+	assert.Equal(t, executorHealth{Status: healthBusy, Running: 1, MaxConcurrent: 1}, body.Executor)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/cmd/status", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "commands are refused while saturated")
+	assert.Equal(t, "Too many commands running, retry later", chatReply(d, messaging.Message{Command: "status"}))
+
+	close(exec.release)
+	wg.Wait()
+
+	// The provider stops polling
+	client.up = false
+	code, body = ready()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not connected", body.Providers[0].Reason)
+	assert.Equal(t, healthOK, body.Executor.Status)
+}
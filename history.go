@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+
+	"rpi-bot/messaging"
+)
+
+var historyBucket = []byte("executions")
+
+const (
+	defaultHistoryMaxEntries = 1000
+	// maxHistoryOutput caps the output stored for each execution
+	maxHistoryOutput = 64 * 1024
+)
+
+// historyEntry is a stored command execution
+type historyEntry struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Provider string    `json:"provider"`
+	Caller   string    `json:"caller"`
+	Chat     string    `json:"chat,omitempty"`
+	Command  string    `json:"command"`
+	Args     []string  `json:"args,omitempty"`
+	Output   string    `json:"output"`
+	Error    string    `json:"error,omitempty"`
+	ExitCode int       `json:"exitCode"`
+}
+
+// historyStore keeps executions and their outputs in an embedded bbolt
+// database. A nil *historyStore is valid and stores nothing.
+type historyStore struct {
+	db         *bolt.DB
+	maxEntries int
+	maxAge     time.Duration
+}
+
+func newHistoryStore(cfg HistoryConfig) (*historyStore, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	db, err := bolt.Open(cfg.File, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultHistoryMaxEntries
+	}
+	return &historyStore{
+		db:         db,
+		maxEntries: maxEntries,
+		maxAge:     time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+	}, nil
+}
+
+// chatKey identifies the conversation a message belongs to, so chat users
+// only see the history of their own chat
+func chatKey(m messaging.Message) string {
+	switch {
+	case m.ChatID != 0:
+		return fmt.Sprintf("%s:%d", m.Provider, m.ChatID)
+	case m.Source != "":
+		return m.Provider + ":" + m.Source
+	case m.Room != "":
+		return m.Provider + ":" + m.Room
+	case m.Topic != "":
+		return m.Provider + ":" + m.Topic
+	case m.Email != "":
+		return m.Provider + ":" + m.Email
+	case m.Channel != "":
+		return m.Provider + ":" + m.Channel
+	case m.Session != "":
+		// Console sessions come and go, the history is the local user's
+		return m.Provider + ":" + m.User
+	}
+	return ""
+}
+
+func idKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// Add stores an execution, assigns its ID and applies the retention limits
+func (h *historyStore) Add(e historyEntry) (uint64, error) {
+	if h == nil {
+		return 0, nil
+	}
+	if len(e.Output) > maxHistoryOutput {
+		// Cut at a rune boundary, JSON would mangle a split rune
+		cut := maxHistoryOutput
+		for cut > 0 && !utf8.RuneStart(e.Output[cut]) {
+			cut--
+		}
+		e.Output = e.Output[:cut]
+	}
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(idKey(id), value); err != nil {
+			return err
+		}
+		return h.prune(b)
+	})
+	return e.ID, err
+}
+
+// prune removes the oldest entries beyond maxEntries or older than maxAge
+func (h *historyStore) prune(b *bolt.Bucket) error {
+	c := b.Cursor()
+	count := 0
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		count++
+	}
+	excess := count - h.maxEntries
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		if excess <= 0 {
+			if h.maxAge == 0 {
+				return nil
+			}
+			var e historyEntry
+			if err := json.Unmarshal(v, &e); err == nil && time.Since(e.Time) <= h.maxAge {
+				return nil
+			}
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		excess--
+	}
+	return nil
+}
+
+// Recent returns up to n of the newest entries, newest first. If chat is
+// set only the entries of that conversation are returned.
+func (h *historyStore) Recent(n int, chat string) ([]historyEntry, error) {
+	return h.find(n, func(e historyEntry) bool {
+		return chat == "" || e.Chat == chat
+	})
+}
+
+// RecentAllowed returns up to n of the newest entries of the commands
+// allowed reports true for, newest first
+func (h *historyStore) RecentAllowed(n int, allowed func(command string) bool) ([]historyEntry, error) {
+	return h.find(n, func(e historyEntry) bool {
+		return allowed(e.Command)
+	})
+}
+
+// Last returns the newest execution of a command
+func (h *historyStore) Last(command string, chat string) (historyEntry, bool, error) {
+	entries, err := h.find(1, func(e historyEntry) bool {
+		return e.Command == command && (chat == "" || e.Chat == chat)
+	})
+	if err != nil || len(entries) == 0 {
+		return historyEntry{}, false, err
+	}
+	return entries[0], true, nil
+}
+
+// Get returns the execution with the given ID
+func (h *historyStore) Get(id uint64) (historyEntry, bool, error) {
+	var e historyEntry
+	if h == nil {
+		return e, false, nil
+	}
+	var found bool
+	err := h.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(historyBucket).Get(idKey(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &e)
+	})
+	return e, found, err
+}
+
+func (h *historyStore) find(n int, match func(historyEntry) bool) ([]historyEntry, error) {
+	if h == nil || n <= 0 {
+		return nil, nil
+	}
+	var entries []historyEntry
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < n; k, v = c.Prev() {
+			var e historyEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				slog.Warn("history: skipping corrupted entry", "error", err)
+				continue
+			}
+			if match(e) {
+				entries = append(entries, e)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (h *historyStore) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+var (
+	errHistoryDisabled = errors.New("history is not enabled")
+	// errSensitiveRerun is returned for the executions stored without the
+	// values of their sensitive args
+	errSensitiveRerun = errors.New("sensitive args aren't stored, send the command again")
+)
+
+// historyCommand implements `/history [n]`
+func historyCommand(d *dispatcher, m messaging.Message) (string, error) {
+	if d.history == nil {
+		return "", errHistoryDisabled
+	}
+	n, err := parseCount(m.Args, 10)
+	if err != nil {
+		return "", err
+	}
+	entries, err := d.history.Recent(n, chatKey(m))
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "No history", nil
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(formatHistoryEntry(e))
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// lastCommand implements `/last <command>`, replying with its latest output
+func lastCommand(d *dispatcher, m messaging.Message) (string, error) {
+	if d.history == nil {
+		return "", errHistoryDisabled
+	}
+	if len(m.Args) != 1 {
+		return "", errors.New("usage: /last <command>")
+	}
+	e, ok, err := d.history.Last(m.Args[0], chatKey(m))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return fmt.Sprintf("No history for %s", m.Args[0]), nil
+	}
+	return formatHistoryEntry(e) + "\n" + e.Output, nil
+}
+
+// rerunCommand implements `/rerun <id>`, running a stored execution again
+// through the regular command path
+func rerunCommand(d *dispatcher, m messaging.Message) (string, error) {
+	if d.history == nil {
+		return "", errHistoryDisabled
+	}
+	if len(m.Args) != 1 {
+		return "", errors.New("usage: /rerun <id>")
+	}
+	e, err := d.lookupHistory(m.Args[0], chatKey(m))
+	if err != nil {
+		return "", err
+	}
+	if slices.Contains(e.Args, redacted) {
+		return "", errSensitiveRerun
+	}
+	rerun := m
+	rerun.Command = e.Command
+	rerun.Args = e.Args
+	return d.run(rerun)
+}
+
+// lookupHistory returns the entry with the given ID if it belongs to chat
+func (d *dispatcher) lookupHistory(rawID string, chat string) (historyEntry, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(rawID, "#"), 10, 64)
+	if err != nil {
+		return historyEntry{}, fmt.Errorf("invalid id %q", rawID)
+	}
+	e, ok, err := d.history.Get(id)
+	if err != nil {
+		return historyEntry{}, err
+	}
+	if !ok || (chat != "" && e.Chat != chat) {
+		return historyEntry{}, fmt.Errorf("no history entry #%d", id)
+	}
+	return e, nil
+}
+
+func formatHistoryEntry(e historyEntry) string {
+	status := "ok"
+	if e.Error != "" {
+		status = fmt.Sprintf("failed (exit=%d)", e.ExitCode)
+	}
+	command := strings.Join(append([]string{"/" + e.Command}, e.Args...), " ")
+	return fmt.Sprintf("#%d %s %s %s", e.ID, e.Time.Format(time.RFC3339), command, status)
+}
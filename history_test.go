@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHistory(t *testing.T, cfg HistoryConfig) *historyStore {
+	t.Helper()
+	cfg.File = filepath.Join(t.TempDir(), "history.db")
+	h, err := newHistoryStore(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = h.Close() })
+	return h
+}
+
+func TestHistoryStore(t *testing.T) {
+	h := newTestHistory(t, HistoryConfig{})
+
+	id1, err := h.Add(historyEntry{Time: time.Now(), Chat: "telegram:1", Command: "status", Output: "up 1 day"})
+	require.NoError(t, err)
+	_, err = h.Add(historyEntry{Time: time.Now(), Chat: "telegram:2", Command: "status", Output: "up 2 days"})
+	require.NoError(t, err)
+	id3, err := h.Add(historyEntry{Time: time.Now(), Chat: "telegram:1", Command: "disk", Output: "50%"})
+	require.NoError(t, err)
+
+	entries, err := h.Recent(10, "telegram:1")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, id3, entries[0].ID, "newest first")
+	assert.Equal(t, id1, entries[1].ID)
+
+	entries, err = h.Recent(10, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	e, ok, err := h.Last("status", "telegram:1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "up 1 day", e.Output)
+
+	e, ok, err = h.Last("status", "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "up 2 days", e.Output)
+
+	_, ok, err = h.Last("reboot", "")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	e, ok, err = h.Get(id3)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "disk", e.Command)
+}
+
+func TestHistoryStore_Retention(t *testing.T) {
+	h := newTestHistory(t, HistoryConfig{MaxEntries: 3, MaxAgeDays: 1})
+
+	_, err := h.Add(historyEntry{Time: time.Now().Add(-48 * time.Hour), Command: "old"})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := h.Add(historyEntry{Time: time.Now(), Command: "new"})
+		require.NoError(t, err)
+	}
+
+	entries, err := h.Recent(10, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, e := range entries {
+		assert.Equal(t, "new", e.Command)
+	}
+	assert.Equal(t, uint64(6), entries[0].ID)
+}
+
+func TestHistoryStore_TruncatedOutput(t *testing.T) {
+	h := newTestHistory(t, HistoryConfig{})
+
+	// The 3-byte rune straddles the limit
+	output := strings.Repeat("a", maxHistoryOutput-1) + "€" + "tail"
+	id, err := h.Add(historyEntry{Time: time.Now(), Command: "status", Output: output})
+	require.NoError(t, err)
+
+	e, ok, err := h.Get(id)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, strings.Repeat("a", maxHistoryOutput-1), e.Output)
+	assert.True(t, utf8.ValidString(e.Output))
+}
+
+func TestHistoryChatCommands(t *testing.T) {
+	h := newTestHistory(t, HistoryConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"echo": {Command: "echo %s", Args: []string{"text"}},
+		}),
+		executor: &mockExecutor{},
+		history:  h,
+	}
+	alice := messaging.Message{Type: messaging.Command, Provider: "telegram", ChatID: 1}
+	bob := messaging.Message{Type: messaging.Command, Provider: "telegram", ChatID: 2}
+
+	msg := alice
+	msg.Command, msg.Args = "echo", []string{"hello"}
+	require.Equal(t, "echo hello", chatReply(d, msg))
+
+	msg = alice
+	msg.Command = "history"
+	assert.Regexp(t, `^#1 \S+ /echo hello ok\n$`, chatReply(d, msg))
+
+	msg = bob
+	msg.Command = "history"
+	assert.Equal(t, "No history", chatReply(d, msg))
+
+	msg = alice
+	msg.Command, msg.Args = "last", []string{"echo"}
+	assert.Regexp(t, `^#1 \S+ /echo hello ok\necho hello$`, chatReply(d, msg))
+
+	msg = alice
+	msg.Command, msg.Args = "rerun", []string{"1"}
+	assert.Equal(t, "echo hello", chatReply(d, msg))
+
+	// Other chats can't rerun someone else's command
+	msg = bob
+	msg.Command, msg.Args = "rerun", []string{"1"}
+	assert.Equal(t, "Command rerun failed: no history entry #1", chatReply(d, msg))
+
+	msg = alice
+	msg.Command, msg.Args = "rerun", []string{"abc"}
+	assert.Equal(t, `Command rerun failed: invalid id "abc"`, chatReply(d, msg))
+
+	entries, err := h.Recent(10, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "the rerun is stored as a new execution")
+}
+
+func TestHttpHistory(t *testing.T) {
+	h := newTestHistory(t, HistoryConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"status": {Command: "uptime"}}),
+		executor: &mockExecutor{},
+		history:  h,
+	}
+	mux := setupMux(&Config{}, &httpCommandHandler{dispatcher: d}, nil)
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		return rr
+	}
+
+	require.Equal(t, http.StatusOK, serve("/cmd/status").Code)
+
+	rr := serve("/history")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var entries []historyEntry
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "uptime", entries[0].Output)
+	assert.Equal(t, "http", entries[0].Provider)
+
+	rr = serve("/last/status")
+	require.Equal(t, http.StatusOK, rr.Code)
+	var last historyEntry
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &last))
+	assert.Equal(t, uint64(1), last.ID)
+
+	require.Equal(t, http.StatusNotFound, serve("/last/disk").Code)
+
+	rr = serve("/rerun/1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "uptime", rr.Body.String())
+
+	require.Equal(t, http.StatusNotFound, serve("/rerun/42").Code)
+
+	// Scoped tokens only see the commands they may run
+	scoped := func(url string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		mux.ServeHTTP(rr, withIdentity(r, &httpIdentity{Name: "ci", Commands: []string{"deploy"}}))
+		return rr
+	}
+	rr = scoped("/history")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &entries))
+	assert.Empty(t, entries)
+	assert.Equal(t, http.StatusForbidden, scoped("/last/status").Code)
+}
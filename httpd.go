@@ -2,78 +2,134 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 
 	"fmt"
-	"log"
+	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 
+	"rpi-bot/client"
 	"rpi-bot/messaging"
 	"time"
 )
 
-func authMiddleware(token string, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if token != "" && auth != "Token "+token {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+// remoteHost returns the IP address of the HTTP client
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
-func setupMux(cfg *Config, commandHandler *httpCommandHandler) http.Handler {
+
+func setupMux(
+	cfg *Config,
+	commandHandler *httpCommandHandler,
+	webhookHandlers []*webhookHandler,
+) http.Handler {
 	mux := http.NewServeMux()
+	d := commandHandler.dispatcher
+	audit := d.audit
+	httpAuth := newHTTPAuth(cfg.Httpd, d)
+	auth := func(next http.Handler) http.Handler {
+		return authMiddleware(httpAuth, next)
+	}
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
-	cmdHandler := authMiddleware(cfg.Httpd.AuthToken, http.HandlerFunc(commandHandler.ServeHTTP))
-	mux.Handle("/cmd/", cmdHandler)
+	// Unauthenticated, for supervisors and orchestrators
+	mux.HandleFunc("/health/live", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": healthOK})
+	})
+	mux.Handle("/health/ready", &httpReadyHandler{dispatcher: d})
+	mux.Handle("/cmd/", auth(commandHandler))
+	// The command table, for fleet controllers
+	mux.Handle("/commands", auth(&httpCommandsHandler{dispatcher: d}))
+
+	if audit != nil {
+		mux.Handle("/audit", auth(&httpAuditHandler{audit: audit}))
+	}
+
+	if d.history != nil {
+		historyHandler := &httpHistoryHandler{dispatcher: d}
+		for _, path := range []string{"/history", "/last/", "/rerun/"} {
+			mux.Handle(path, auth(historyHandler))
+		}
+	}
+
+	// Metrics are only served here when they don't have their own listener
+	if cfg.Metrics.Enabled && cfg.Metrics.Addr == "" && d.metrics != nil {
+		mux.Handle("/metrics", auth(d.metrics.handler()))
+	}
+
+	// Webhooks carry their own per-route authentication
+	for _, h := range webhookHandlers {
+		mux.Handle(h.route.Path, h)
+	}
 
 	return mux
 }
 
-func HttpServer(ctx context.Context, cfg *Config, executor commandExecutor, wg *sync.WaitGroup) {
+func HttpServer(
+	ctx context.Context,
+	cfg *Config,
+	d *dispatcher,
+	sender messaging.MessageSender,
+	wg *sync.WaitGroup,
+) {
 	defer wg.Done()
 
-	authToken, _ := GetSecret("HTTP_TOKEN_AUTH", cfg.Httpd.AuthToken)
-	commandHandler := &httpCommandHandler{
-		commands:  cfg.Commands,
-		authToken: authToken,
-		executor:  executor,
-	}
+	commandHandler := &httpCommandHandler{dispatcher: d}
 	httpSrv := &http.Server{
 		Addr:    cfg.Httpd.Addr,
-		Handler: setupMux(cfg, commandHandler),
+		Handler: setupMux(cfg, commandHandler, newWebhookHandlers(cfg, d, sender)),
+	}
+	tlsEnabled := cfg.Httpd.TLS.enabled()
+	if tlsEnabled {
+		tlsCfg, err := serverTLSConfig(cfg.Httpd.TLS)
+		if err != nil {
+			slog.Error("HTTP server not started", "error", err)
+			return
+		}
+		httpSrv.TLSConfig = tlsCfg
 	}
 	// Gracefully shut down HTTP server on context cancel
 	go func() {
 		<-ctx.Done()
-		log.Println("Shutting down HTTP server")
+		slog.Info("Shutting down HTTP server")
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := httpSrv.Shutdown(shutdownCtx); err != nil {
-			log.Printf("HTTP server Shutdown error: %v", err)
+			slog.Error("HTTP server shutdown error", "error", err)
 		}
 	}()
 
 	// httpSrv.ListenAndServe returns err when server stops or fails
 
-	log.Println("Starting httpd server")
-	if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	slog.Info("Starting httpd server", "addr", cfg.Httpd.Addr, "tls", tlsEnabled)
+	var err error
+	if tlsEnabled {
+		// The certificate comes from TLSConfig.GetCertificate
+		err = httpSrv.ListenAndServeTLS("", "")
+	} else {
+		err = httpSrv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		// If it's ErrServerClosed, that means Shutdown() was called.
-		log.Printf("HTTP server ListenAndServe(): %v", err)
+		slog.Error("HTTP server ListenAndServe()", "error", err)
 	}
 
 }
 
 type httpCommandHandler struct {
-	commands  map[string]Command
-	authToken string
-	executor  commandExecutor
+	dispatcher *dispatcher
 }
 
 func (h *httpCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -83,8 +139,20 @@ func (h *httpCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmdDef, ok := h.commands[cmdName]
+	msg := messaging.Message{
+		Command:   cmdName,
+		Provider:  "http",
+		User:      httpCaller(r),
+		RequestID: newRequestID(),
+	}
+	if identity := identityFromRequest(r); identity != nil && !identity.allows(cmdName) {
+		h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeUnauthorized, errCommandNotAllowed)
+		http.Error(w, errCommandNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	cmdDef, ok := h.dispatcher.commands.Get(cmdName)
 	if !ok {
+		h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeRejected, errUnknownCommand)
 		http.Error(w, fmt.Sprintf("unknown command %q", cmdName), http.StatusNotFound)
 		return
 	}
@@ -94,25 +162,36 @@ func (h *httpCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	for _, argKey := range cmdDef.Args {
 		v := query.Get(argKey)
 		if v == "" {
-			http.Error(
-				w,
-				fmt.Sprintf("missing required query parameter %q", argKey),
-				http.StatusBadRequest,
-			)
+			err := fmt.Errorf("missing required query parameter %q", argKey)
+			h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeRejected, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		values = append(values, v)
 	}
-	msg := messaging.Message{Command: cmdName, Args: values}
-	fullCmd, err := createCommand(cmdDef, msg)
+	msg.Args = values
+
+	output, err := h.dispatcher.run(msg)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		var execErr *execError
+		var limitErr *rateLimitError
+		var stopped *limitError
+		switch {
+		case errors.As(err, &limitErr):
+			writeRateLimited(w, limitErr)
+		case errors.Is(err, errUnknownCommand):
+			http.Error(w, fmt.Sprintf("unknown command %q", cmdName), http.StatusNotFound)
+		case errors.Is(err, errBusy):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errors.As(err, &stopped):
+			http.Error(w, stopped.Error(), http.StatusUnprocessableEntity)
+		case errors.As(err, &execErr):
+			http.Error(w, execErr.err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	}
-	output, err := h.executor.execCommand(fullCmd)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	}
 	w.Header().Set("Content-Type", "text/plain")
 	_, err = fmt.Fprint(w, output)
 
@@ -120,3 +199,156 @@ func (h *httpCommandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+type httpCommandsHandler struct {
+	dispatcher *dispatcher
+}
+
+// ServeHTTP lists the commands the caller may run with their args, as JSON
+func (h *httpCommandsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromRequest(r)
+	commands := []client.CommandInfo{}
+	for _, name := range h.dispatcher.commands.Names() {
+		if identity != nil && !identity.allows(name) {
+			continue
+		}
+		c, ok := h.dispatcher.commands.Get(name)
+		if !ok {
+			continue
+		}
+		args := c.Args
+		if args == nil {
+			args = []string{}
+		}
+		commands = append(commands, client.CommandInfo{Name: name, Args: args, Sensitive: c.SensitiveArgs})
+	}
+	writeJSON(w, commands)
+}
+
+type httpAuditHandler struct {
+	audit *auditLog
+}
+
+// ServeHTTP returns the most recent audit entries as JSON, `?n=` sets how many.
+// Tokens scoped to some commands can't read the log of all of them.
+func (h *httpAuditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if identity := identityFromRequest(r); identity != nil && len(identity.Commands) > 0 {
+		http.Error(w, errCommandNotAllowed.Error(), http.StatusForbidden)
+		return
+	}
+	var args []string
+	if n := r.URL.Query().Get("n"); n != "" {
+		args = []string{n}
+	}
+	n, err := parseCount(args, 50)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := h.audit.Recent(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	writeJSON(w, entries)
+}
+
+type httpHistoryHandler struct {
+	dispatcher *dispatcher
+}
+
+// ServeHTTP serves `/history?n=`, `/last/<command>` and `/rerun/<id>`
+func (h *httpHistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	history := h.dispatcher.history
+	switch {
+	case r.URL.Path == "/history":
+		var args []string
+		if n := r.URL.Query().Get("n"); n != "" {
+			args = []string{n}
+		}
+		n, err := parseCount(args, 50)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Scoped tokens only see the commands they may run
+		allowed := func(string) bool { return true }
+		if identity := identityFromRequest(r); identity != nil {
+			allowed = identity.allows
+		}
+		entries, err := history.RecentAllowed(n, allowed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		writeJSON(w, entries)
+
+	case strings.HasPrefix(r.URL.Path, "/last/"):
+		cmdName := strings.TrimPrefix(r.URL.Path, "/last/")
+		if identity := identityFromRequest(r); identity != nil && !identity.allows(cmdName) {
+			http.Error(w, errCommandNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		e, ok, err := history.Last(cmdName, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, fmt.Sprintf("no history for %q", cmdName), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, e)
+
+	case strings.HasPrefix(r.URL.Path, "/rerun/"):
+		e, err := h.dispatcher.lookupHistory(strings.TrimPrefix(r.URL.Path, "/rerun/"), "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if slices.Contains(e.Args, redacted) {
+			http.Error(w, errSensitiveRerun.Error(), http.StatusBadRequest)
+			return
+		}
+		msg := messaging.Message{
+			Command:   e.Command,
+			Args:      e.Args,
+			Provider:  "http",
+			User:      httpCaller(r),
+			RequestID: newRequestID(),
+		}
+		if identity := identityFromRequest(r); identity != nil && !identity.allows(e.Command) {
+			h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeUnauthorized, errCommandNotAllowed)
+			http.Error(w, errCommandNotAllowed.Error(), http.StatusForbidden)
+			return
+		}
+		output, err := h.dispatcher.run(msg)
+		var limitErr *rateLimitError
+		if errors.As(err, &limitErr) {
+			writeRateLimited(w, limitErr)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = fmt.Fprint(w, output)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error encoding JSON response", "error", err)
+	}
+}
@@ -82,7 +82,7 @@ func TestAuthMiddleware(t *testing.T) {
 				mockNextHandler.ServeHTTP(w, r)
 			})
 
-			handlerToTest := authMiddleware(tt.configuredToken, testHandler)
+			handlerToTest := authMiddleware(newHTTPAuth(HttpdConfig{AuthToken: tt.configuredToken}, nil), testHandler)
 
 			req := httptest.NewRequest("GET", "http://localhost/test", nil)
 			if tt.requestAuthHeader != "" {
@@ -107,7 +107,7 @@ func TestAuthMiddleware(t *testing.T) {
 
 type mockExecutor struct{}
 
-func (e *mockExecutor) execCommand(command string) (string, error) {
+func (e *mockExecutor) execCommand(command string, _ Command) (string, error) {
 	if command == "error" {
 		return "", assert.AnError
 	}
@@ -193,15 +193,27 @@ func TestHttpCommandHandler_ServeHTTP(t *testing.T) {
 			expectedStatusCode: http.StatusBadRequest,
 			expectedBody:       "mismatch between placeholders (%s)=2 and number of args=1\n",
 		},
+		{
+			name:          "arg with whitespace",
+			requestURL:    "/cmd/greet?name=world+--force",
+			requestMethod: http.MethodGet,
+			commands: map[string]Command{
+				"greet": {Command: "echo Hello %s", Args: []string{"name"}},
+			},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedBody:       "name must not contain whitespace\n",
+		},
 	}
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			executor := &mockExecutor{}
 			handler := &httpCommandHandler{
-				commands: tc.commands,
+				dispatcher: &dispatcher{
+					commands: newCommandTable(tc.commands),
+					executor: executor,
+				},
 				// authToken is not directly tested here as it's part of authMiddleware
-				executor: executor,
 			}
 
 			req := httptest.NewRequest(tc.requestMethod, tc.requestURL, nil)
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"rpi-bot/messaging"
+)
+
+const redacted = "[REDACTED]"
+
+// logOutput is where the logs are written, through the terminal of the
+// console provider when it uses one
+var logOutput io.Writer = os.Stderr
+
+// newLogger builds the slog logger described by the config. Every secret is
+// replaced by [REDACTED] in messages and attribute values.
+func newLogger(cfg LoggingConfig, secrets []string, w io.Writer) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return nil, fmt.Errorf("logging: invalid level %q", cfg.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch cfg.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("logging: format %s not supported", cfg.Format)
+	}
+	return slog.New(newRedactingHandler(handler, secrets)), nil
+}
+
+// configSecrets returns every secret of the config that must never be logged
+func configSecrets(cfg *Config) []string {
+	secrets := append([]string{}, cfg.Logging.Redact...)
+	if token, ok := GetSecret("TELEGRAM_APITOKEN", cfg.Telegram.ApiToken); ok {
+		secrets = append(secrets, token)
+	}
+	if token, ok := GetSecret("MATRIX_ACCESSTOKEN", cfg.Matrix.AccessToken); ok {
+		secrets = append(secrets, token)
+	}
+	if password, ok := GetSecret("MQTT_PASSWORD", cfg.MQTT.Password); ok {
+		secrets = append(secrets, password)
+	}
+	if password, ok := GetSecret("EMAIL_IMAP_PASSWORD", cfg.Email.IMAP.Password); ok {
+		secrets = append(secrets, password)
+	}
+	if password, ok := GetSecret("EMAIL_SMTP_PASSWORD", cfg.Email.SMTP.Password); ok {
+		secrets = append(secrets, password)
+	}
+	if cfg.Email.Secret != "" {
+		secrets = append(secrets, cfg.Email.Secret)
+	}
+	if token, ok := GetSecret("SLACK_APPTOKEN", cfg.Slack.AppToken); ok {
+		secrets = append(secrets, token)
+	}
+	if token, ok := GetSecret("SLACK_BOTTOKEN", cfg.Slack.BotToken); ok {
+		secrets = append(secrets, token)
+	}
+	if token, ok := GetSecret("MATTERMOST_TOKEN", cfg.Mattermost.Token); ok {
+		secrets = append(secrets, token)
+	}
+	if token, ok := GetSecret("HTTP_TOKEN_AUTH", cfg.Httpd.AuthToken); ok {
+		secrets = append(secrets, token)
+	}
+	for _, t := range cfg.Httpd.Tokens {
+		secrets = append(secrets, t.Token)
+	}
+	for _, w := range cfg.Webhooks {
+		secrets = append(secrets, w.Auth.Secret)
+	}
+	for _, a := range append(slices.Collect(maps.Values(cfg.Fleet.Agents)), cfg.Fleet.Discovered) {
+		if a.Token != "" {
+			secrets = append(secrets, a.Token)
+		}
+		if a.Secret != "" {
+			secrets = append(secrets, a.Secret)
+		}
+	}
+	for _, r := range cfg.Recipients {
+		switch {
+		case r.Ntfy != nil && r.Ntfy.Token != "":
+			secrets = append(secrets, r.Ntfy.Token)
+		case r.Gotify != nil:
+			secrets = append(secrets, r.Gotify.Token)
+		case r.Webhook != nil:
+			for k, v := range r.Webhook.Headers {
+				if strings.EqualFold(k, "Authorization") && v != "" {
+					secrets = append(secrets, v)
+				}
+			}
+		}
+	}
+	return secrets
+}
+
+// newRequestID returns a short random ID identifying a request in the logs
+// and the audit log
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// messageLogger returns the default logger with the fields identifying the
+// request made by a message
+func messageLogger(m messaging.Message) *slog.Logger {
+	return slog.With(
+		"request_id", m.RequestID,
+		"provider", m.Provider,
+		"caller", m.User,
+		"command", m.Command,
+	)
+}
+
+// redactArgs returns the message args with the values of the command's
+// sensitive args replaced, for logging and auditing
+func redactArgs(c Command, args []string) []string {
+	if len(c.SensitiveArgs) == 0 {
+		return args
+	}
+	out := make([]string, len(args))
+	for i, v := range args {
+		out[i] = v
+		if i < len(c.Args) && slices.Contains(c.SensitiveArgs, c.Args[i]) {
+			out[i] = redacted
+		}
+	}
+	return out
+}
+
+// redactAll returns args with every value replaced, for the commands whose
+// sensitive args aren't known
+func redactAll(args []string) []string {
+	out := make([]string, len(args))
+	for i := range args {
+		out[i] = redacted
+	}
+	return out
+}
+
+// redactArgv replaces the sensitive arg values found in a resolved argv
+func redactArgv(c Command, args []string, argv []string) []string {
+	if len(c.SensitiveArgs) == 0 {
+		return argv
+	}
+	var values []string
+	for i, v := range args {
+		if i < len(c.Args) && slices.Contains(c.SensitiveArgs, c.Args[i]) && v != "" {
+			values = append(values, v)
+		}
+	}
+	r := newReplacer(values)
+	out := make([]string, len(argv))
+	for i, a := range argv {
+		out[i] = r.Replace(a)
+	}
+	return out
+}
+
+func newReplacer(secrets []string) *strings.Replacer {
+	// Longest first, so a secret containing another one is fully replaced
+	sorted := make([]string, 0, len(secrets))
+	for _, s := range secrets {
+		if s != "" {
+			sorted = append(sorted, s)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, s := range sorted {
+		pairs = append(pairs, s, redacted)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// redactingHandler is a slog.Handler removing secrets from records before
+// passing them to the wrapped handler
+type redactingHandler struct {
+	next     slog.Handler
+	replacer *strings.Replacer
+}
+
+func newRedactingHandler(next slog.Handler, secrets []string) *redactingHandler {
+	return &redactingHandler{next: next, replacer: newReplacer(secrets)}
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, h.replacer.Replace(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = h.redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redactedAttrs), replacer: h.replacer}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), replacer: h.replacer}
+}
+
+func (h *redactingHandler) redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, h.replacer.Replace(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		attrs := make([]any, len(group))
+		for i, ga := range group {
+			attrs[i] = h.redactAttr(ga)
+		}
+		return slog.Group(a.Key, attrs...)
+	case slog.KindAny:
+		// errors, slices and other values are logged through their text form
+		return slog.String(a.Key, h.replacer.Replace(fmt.Sprint(v.Any())))
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLogs makes the default logger write JSON lines to the returned buffer
+func captureLogs(t *testing.T, secrets ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := newLogger(LoggingConfig{Level: "debug", Format: "json"}, secrets, &buf)
+	require.NoError(t, err)
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     LoggingConfig
+		wantErr string
+	}{
+		{name: "defaults", cfg: LoggingConfig{}},
+		{name: "json", cfg: LoggingConfig{Level: "warn", Format: "json"}},
+		{name: "invalid level", cfg: LoggingConfig{Level: "loud"}, wantErr: `logging: invalid level "loud"`},
+		{name: "invalid format", cfg: LoggingConfig{Format: "xml"}, wantErr: "logging: format xml not supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newLogger(tt.cfg, nil, &bytes.Buffer{})
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	var buf bytes.Buffer
+	logger, err := newLogger(LoggingConfig{Level: "warn"}, nil, &buf)
+	require.NoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), "level=WARN msg=shown")
+}
+
+func TestRedactingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger(LoggingConfig{Format: "json"}, []string{"s3cr3t", "tok", ""}, &buf)
+	require.NoError(t, err)
+
+	logger.With("token", "tok").WithGroup("req").Info(
+		"calling https://api/bots3cr3t/getMe",
+		"url", "https://api/bots3cr3t/getMe",
+		"error", errors.New(`Post "https://api/bots3cr3t/send": timeout`),
+		"argv", []string{"login", "s3cr3t"},
+		slog.Group("auth", "secret", "s3cr3t"),
+		"count", 3,
+	)
+
+	out := buf.String()
+	assert.NotContains(t, out, "s3cr3t")
+	assert.NotContains(t, out, `"tok"`)
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "calling https://api/bot[REDACTED]/getMe", line["msg"])
+	assert.Equal(t, "[REDACTED]", line["token"])
+	req := line["req"].(map[string]any)
+	assert.Equal(t, "https://api/bot[REDACTED]/getMe", req["url"])
+	assert.Equal(t, `Post "https://api/bot[REDACTED]/send": timeout`, req["error"])
+	assert.Equal(t, "[login [REDACTED]]", req["argv"])
+	assert.Equal(t, map[string]any{"secret": "[REDACTED]"}, req["auth"])
+	assert.Equal(t, 3.0, req["count"])
+}
+
+func TestConfigSecrets(t *testing.T) {
+	t.Setenv("HTTP_TOKEN_AUTH", "env-token")
+	cfg := &Config{
+		Telegram: TelegramConfig{ApiToken: "bot-token"},
+		Httpd:    HttpdConfig{AuthToken: "overridden", Tokens: map[string]APIToken{"ci": {Token: "ci-token"}}},
+		Webhooks: []WebhookConfig{{Auth: WebhookAuth{Secret: "hook-secret"}}},
+		Logging:  LoggingConfig{Redact: []string{"db-password"}},
+	}
+	assert.ElementsMatch(t,
+		[]string{"db-password", "bot-token", "env-token", "ci-token", "hook-secret"},
+		configSecrets(cfg),
+	)
+}
+
+func TestDispatcher_SensitiveArgs(t *testing.T) {
+	buf := captureLogs(t)
+	a := newTestAuditLog(t, AuditConfig{})
+	h := newTestHistory(t, HistoryConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"login": {Command: "login %s %s", Args: []string{"user", "password"}, SensitiveArgs: []string{"password"}},
+		}),
+		executor: &mockExecutor{},
+		audit:    a,
+		history:  h,
+	}
+
+	output, err := d.run(messaging.Message{
+		Command:   "login",
+		Args:      []string{"bob", "hunter2"},
+		Provider:  "telegram",
+		User:      "42",
+		RequestID: "abc123",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "login bob hunter2", output)
+
+	entries, err := a.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "abc123", entries[0].RequestID)
+	assert.Equal(t, []string{"bob", "[REDACTED]"}, entries[0].Args)
+	assert.Equal(t, []string{"login", "bob", "[REDACTED]"}, entries[0].Argv)
+
+	// Neither does the history, so the command can't be rerun
+	stored, err := h.Recent(1, "")
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	assert.Equal(t, []string{"bob", "[REDACTED]"}, stored[0].Args)
+	rerun := messaging.Message{Type: messaging.Command, Command: "rerun", Args: []string{"1"}}
+	assert.Equal(t, "Command rerun failed: sensitive args aren't stored, send the command again", chatReply(d, rerun))
+
+	logs := buf.String()
+	assert.NotContains(t, logs, "hunter2")
+	var line map[string]any
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &line))
+	assert.Equal(t, "command executed", line["msg"])
+	assert.Equal(t, "abc123", line["request_id"])
+	assert.Equal(t, "telegram", line["provider"])
+	assert.Equal(t, "42", line["caller"])
+	assert.Equal(t, "login", line["command"])
+	assert.Equal(t, float64(len(output)), line["output_size"])
+	// Refused attempts are redacted too
+	_, err = d.run(messaging.Message{Command: "login", Args: []string{"bob", "hunter2", "extra"}})
+	require.Error(t, err)
+	entries, err = a.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, outcomeRejected, entries[0].Outcome)
+	assert.Equal(t, []string{"bob", "[REDACTED]", "extra"}, entries[0].Args)
+}
@@ -2,45 +2,372 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"gopkg.in/yaml.v2"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+
+	"rpi-bot/messaging"
 )
 
 type Command struct {
-	Command string   `yaml:"command"`
-	Args    []string `yaml:"args"`
+	Command       string    `yaml:"command"`
+	Args          []string  `yaml:"args"`
+	SensitiveArgs []string  `yaml:"sensitiveArgs"` // Redacted in logs and the audit log
+	RateLimit     RateLimit `yaml:"rateLimit"`     // Shared by every caller of the command
+	Workdir       string    `yaml:"workdir"`       // The bot's working directory if empty
+	// Env is added to the environment, it accepts ${ENV_VAR} and file: references
+	Env        map[string]string `yaml:"env"`
+	ClearEnv   bool              `yaml:"clearEnv"`   // Don't inherit the bot's environment
+	InheritEnv []string          `yaml:"inheritEnv"` // Variables still inherited with clearEnv
+	User       string            `yaml:"user"`       // Run as this user name or uid
+	Group      string            `yaml:"group"`      // Run as this group name or gid
+	Limits     CommandLimits     `yaml:"limits"`
+	Sandbox    SandboxConfig     `yaml:"sandbox"`
+	// ArgSpecs describe the args by name, for the chat prompts asking for them
+	ArgSpecs map[string]ArgSpec `yaml:"argSpecs"`
+}
+
+// ArgSpec describes an arg of a command
+type ArgSpec struct {
+	Description string   `yaml:"description"`
+	Values      []string `yaml:"values"` // The allowed values, any if empty
+}
+
+// PromptsConfig controls how chat users are asked for the args they left out
+type PromptsConfig struct {
+	Disabled       bool `yaml:"disabled"`       // Missing args are an error instead
+	TimeoutSeconds int  `yaml:"timeoutSeconds"` // Per answer, 300 if 0
+}
+
+// CommandLimits bounds the resources of a command, 0 for no limit
+type CommandLimits struct {
+	CPUSeconds  int `yaml:"cpuSeconds"`
+	MemoryMB    int `yaml:"memoryMB"`
+	OpenFiles   int `yaml:"openFiles"`
+	OutputBytes int `yaml:"outputBytes"`
+}
+
+// SandboxConfig restricts what a command can do, Linux only
+type SandboxConfig struct {
+	NoNewPrivileges bool     `yaml:"noNewPrivileges"` // Setuid binaries and file capabilities don't apply
+	ReadOnly        bool     `yaml:"readOnly"`        // Every filesystem read-only, in a private mount namespace
+	Writable        []string `yaml:"writable"`        // Paths kept writable with readOnly
+	NoNetwork       bool     `yaml:"noNetwork"`       // Private network namespace with loopback only
 }
 
 type Config struct {
-	Commands map[string]Command `yaml:"commands"`
-	Signal   SignalConfig       `yaml:"signal"`
-	Telegram TelegramConfig     `yaml:"telegram"`
-	Provider string             `yaml:"provider"`
-	Httpd    HttpdConfig        `yaml:"httpd"`
+	Commands    map[string]Command   `yaml:"commands"`
+	Signal      SignalConfig         `yaml:"signal"`
+	Telegram    TelegramConfig       `yaml:"telegram"`
+	Matrix      MatrixConfig         `yaml:"matrix"`
+	MQTT        MQTTConfig           `yaml:"mqtt"`
+	Email       EmailConfig          `yaml:"email"`
+	Slack       SlackConfig          `yaml:"slack"`
+	Mattermost  MattermostConfig     `yaml:"mattermost"`
+	Console     ConsoleConfig        `yaml:"console"`
+	Provider    string               `yaml:"provider"`
+	Httpd       HttpdConfig          `yaml:"httpd"`
+	Recipients  map[string]Recipient `yaml:"recipients"`
+	Webhooks    []WebhookConfig      `yaml:"webhooks"`
+	Admins      []string             `yaml:"admins"`
+	WatchConfig bool                 `yaml:"watchConfig"`
+	Audit       AuditConfig          `yaml:"audit"`
+	History     HistoryConfig        `yaml:"history"`
+	Metrics     MetricsConfig        `yaml:"metrics"`
+	Logging     LoggingConfig        `yaml:"logging"`
+	Health      HealthConfig         `yaml:"health"`
+	Executor    ExecutorConfig       `yaml:"executor"`
+	RateLimit   RateLimitConfig      `yaml:"rateLimit"`
+	Fleet       FleetConfig          `yaml:"fleet"`
+	Discovery   DiscoveryConfig      `yaml:"discovery"`
+	Prompts     PromptsConfig        `yaml:"prompts"`
 }
 
 type TelegramConfig struct {
 	Debug    bool   `yaml:"debug"`
 	ApiToken string `yaml:"apiToken"`
 }
+type MatrixConfig struct {
+	Homeserver  string   `yaml:"homeserver"` // e.g. https://matrix.example.org
+	AccessToken string   `yaml:"accessToken"`
+	Rooms       []string `yaml:"rooms"` // Allowed room IDs
+	Users       []string `yaml:"users"` // Allowed user IDs
+}
+
+// MQTTConfig connects the bot to an MQTT broker, see mqtt.go for defaults
+type MQTTConfig struct {
+	Broker        string        `yaml:"broker"` // e.g. tcp://localhost:1883 or ssl://broker:8883
+	ClientID      string        `yaml:"clientId"`
+	Username      string        `yaml:"username"`
+	Password      string        `yaml:"password"`
+	RequestTopic  string        `yaml:"requestTopic"`
+	ResponseTopic string        `yaml:"responseTopic"`
+	StatusTopic   string        `yaml:"statusTopic"`
+	QoS           int           `yaml:"qos"`
+	TLS           MQTTTLSConfig `yaml:"tls"`
+}
+
+// MQTTTLSConfig configures the TLS connection to the broker
+type MQTTTLSConfig struct {
+	CAFile             string `yaml:"caFile"`   // Trusted CAs, the system ones if empty
+	CertFile           string `yaml:"certFile"` // Client certificate, optional
+	KeyFile            string `yaml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// EmailConfig reads commands from an IMAP mailbox and replies by SMTP, see
+// email.go for defaults
+type EmailConfig struct {
+	IMAP                MailServerConfig `yaml:"imap"`
+	SMTP                MailServerConfig `yaml:"smtp"`
+	Mailbox             string           `yaml:"mailbox"`
+	From                string           `yaml:"from"` // The IMAP username if empty
+	PollIntervalSeconds int              `yaml:"pollIntervalSeconds"`
+	Idle                bool             `yaml:"idle"`
+	Senders             []string         `yaml:"senders"` // Allowed sender addresses
+	Secret              string           `yaml:"secret"`  // Required first line of the body
+	RequireDKIM         bool             `yaml:"requireDKIM"`
+	AuthservID          string           `yaml:"authservId"` // Trusted Authentication-Results
+}
+
+type MailServerConfig struct {
+	Addr     string `yaml:"addr"` // host:port
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Security string `yaml:"security"` // tls, starttls or none
+}
+
+// SlackConfig connects the bot to a Slack app in Socket Mode
+type SlackConfig struct {
+	AppToken string   `yaml:"appToken"` // xapp-, with the connections:write scope
+	BotToken string   `yaml:"botToken"` // xoxb-
+	Channels []string `yaml:"channels"` // Allowed channel IDs
+	Users    []string `yaml:"users"`    // Allowed user IDs
+}
+
+// MattermostConfig connects the bot to a Mattermost server as a bot account
+type MattermostConfig struct {
+	URL      string   `yaml:"url"` // e.g. https://mattermost.example.org
+	Token    string   `yaml:"token"`
+	Channels []string `yaml:"channels"` // Allowed channel IDs or team/channel names
+	Users    []string `yaml:"users"`    // Allowed user IDs or usernames
+}
+
+// ConsoleConfig reads commands from the terminal the bot runs in and,
+// optionally, from a local unix socket
+type ConsoleConfig struct {
+	Socket  string `yaml:"socket"`  // e.g. /run/rpi-bot/console.sock
+	NoStdin bool   `yaml:"noStdin"` // Only serve the socket, e.g. as a service
+}
 type SignalConfig struct {
 	Sources []string `yaml:"sources"`
 	Socket  string   `yaml:"socket"`
 }
 type HttpdConfig struct {
-	Enabled   bool   `yaml:"enabled"`
-	Addr      string `yaml:"addr"`
-	AuthToken string `yaml:"authToken"`
+	Enabled   bool                `yaml:"enabled"`
+	Addr      string              `yaml:"addr"`
+	AuthToken string              `yaml:"authToken"`
+	Tokens    map[string]APIToken `yaml:"tokens"` // By name, recorded as the caller
+	TLS       TLSConfig           `yaml:"tls"`
+	// Accepted difference between a signed request timestamp and the clock
+	MaxClockSkewSeconds int           `yaml:"maxClockSkewSeconds"`
+	Lockout             LockoutConfig `yaml:"lockout"`
+}
+
+// LockoutConfig blocks clients failing to authenticate too often
+type LockoutConfig struct {
+	MaxFailures     int `yaml:"maxFailures"`     // 0 disables the lockout
+	WindowSeconds   int `yaml:"windowSeconds"`   // Default 300
+	DurationSeconds int `yaml:"durationSeconds"` // Default 900
+}
+
+// APIToken is a named credential of the HTTP API
+type APIToken struct {
+	Token    string   `yaml:"token"`
+	Commands []string `yaml:"commands"` // Allowed commands, all if empty
+	Expires  string   `yaml:"expires"`  // 2006-01-02 or RFC 3339, never if empty
+	Sources  []string `yaml:"sources"`  // Allowed client IPs or CIDRs, any if empty
+	HMAC     bool     `yaml:"hmac"`     // Only accepted as a request signing key
+}
+
+type TLSConfig struct {
+	CertFile          string               `yaml:"certFile"`
+	KeyFile           string               `yaml:"keyFile"`
+	SelfSigned        bool                 `yaml:"selfSigned"` // Generate certFile and keyFile if missing
+	ClientCA          string               `yaml:"clientCA"`   // Enables client certificates (mTLS)
+	RequireClientCert bool                 `yaml:"requireClientCert"`
+	Clients           map[string]TLSClient `yaml:"clients"` // By certificate CN
+}
+
+// TLSClient maps a client certificate to an identity
+type TLSClient struct {
+	Identity string   `yaml:"identity"` // Caller name, the CN if empty
+	Commands []string `yaml:"commands"` // Allowed commands, all if empty
+}
+
+type AuditConfig struct {
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"maxSizeMB"`
+	MaxBackups int    `yaml:"maxBackups"`
+}
+
+type HistoryConfig struct {
+	File       string `yaml:"file"`
+	MaxEntries int    `yaml:"maxEntries"`
+	MaxAgeDays int    `yaml:"maxAgeDays"`
+}
+
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Addr    string `yaml:"addr"` // Separate listener, empty to serve on httpd
+}
+
+type LoggingConfig struct {
+	Level  string   `yaml:"level"`  // debug, info, warn or error
+	Format string   `yaml:"format"` // text or json
+	Redact []string `yaml:"redact"` // Extra values never to be logged
+}
+
+type HealthConfig struct {
+	MaxPollAgeSeconds int `yaml:"maxPollAgeSeconds"` // Not ready if polling stalls longer
+}
+
+type ExecutorConfig struct {
+	MaxConcurrent int `yaml:"maxConcurrent"` // Commands running at once, 0 for no limit
+	// Delegated cgroup v2 directory memory limits are enforced in, rlimits if empty
+	Cgroup string `yaml:"cgroup"`
+}
+
+// RateLimit is a token bucket refilled at perMinute, holding up to burst
+// requests. A zero perMinute disables it.
+type RateLimit struct {
+	PerMinute float64 `yaml:"perMinute"`
+	Burst     int     `yaml:"burst"`
+}
+
+type RateLimitConfig struct {
+	Global    RateLimit `yaml:"global"`    // Every command from every caller
+	PerCaller RateLimit `yaml:"perCaller"` // Each chat user or HTTP identity
+}
+
+// FleetConfig makes the bot a controller, relaying `/command@host` and
+// `/all command` to agent bots through their HTTP API
+type FleetConfig struct {
+	Agents map[string]FleetAgent `yaml:"agents"` // By host name
+	// Discovered holds the credentials of the bots found by discovery that
+	// aren't agents, its url unused. They aren't relayed to if empty.
+	Discovered     FleetAgent `yaml:"discovered"`
+	TimeoutSeconds int        `yaml:"timeoutSeconds"` // Per agent, 30 if 0
+}
+
+// DiscoveryConfig advertises the HTTP server on the local network with
+// mDNS/DNS-SD and browses for the other bots
+type DiscoveryConfig struct {
+	Advertise       bool   `yaml:"advertise"`       // Needs httpd
+	Browse          bool   `yaml:"browse"`          // Lists the bots found with /hosts
+	Service         string `yaml:"service"`         // _rpi-bot._tcp if empty
+	Instance        string `yaml:"instance"`        // The name advertised, the hostname if empty
+	IntervalSeconds int    `yaml:"intervalSeconds"` // Between browses, 60 if 0
+}
+
+// FleetAgent is a bot serving the HTTP API, called with an API token or
+// an HMAC signing key
+type FleetAgent struct {
+	URL      string `yaml:"url"` // e.g. https://pi-garage:8443
+	Token    string `yaml:"token"`
+	Key      string `yaml:"key"` // HMAC key name, with secret
+	Secret   string `yaml:"secret"`
+	CAFile   string `yaml:"caFile"`   // Trusted CAs, e.g. the agent's self-signed certificate
+	CertFile string `yaml:"certFile"` // Client certificate, optional
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// Recipient is a named chat destination or notification sink, e.g. for
+// forwarding webhook results
+type Recipient struct {
+	ChatID  int64  `yaml:"chatId"`  //For telegram
+	Source  string `yaml:"source"`  //For Signal
+	Room    string `yaml:"room"`    // For Matrix
+	Topic   string `yaml:"topic"`   // For MQTT
+	Email   string `yaml:"email"`   // For email
+	Channel string `yaml:"channel"` // For Slack and Mattermost, the channel ID
+	Console string `yaml:"console"` // For the console, the local user
+
+	// Push services notified instead of a chat, without a provider
+	Webhook *WebhookSinkConfig `yaml:"webhook"`
+	Ntfy    *NtfyConfig        `yaml:"ntfy"`
+	Gotify  *GotifyConfig      `yaml:"gotify"`
+	Retry   RetryConfig        `yaml:"retry"`
+}
+
+// WebhookSinkConfig posts notifications to any HTTP endpoint
+type WebhookSinkConfig struct {
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"` // POST if empty
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"` // Template of .Title and .Message, JSON of both if empty
+}
+
+type NtfyConfig struct {
+	URL      string   `yaml:"url"` // The topic URL, e.g. https://ntfy.sh/rpi-alerts
+	Token    string   `yaml:"token"`
+	Priority int      `yaml:"priority"` // 1 to 5, the server default if 0
+	Tags     []string `yaml:"tags"`
+}
+
+type GotifyConfig struct {
+	URL      string `yaml:"url"`   // e.g. https://gotify.example.org
+	Token    string `yaml:"token"` // The application token
+	Priority int    `yaml:"priority"`
+}
+
+// RetryConfig retries failed notifications, waiting backoffSeconds, then
+// twice as long after every attempt
+type RetryConfig struct {
+	Attempts       int `yaml:"attempts"`       // 3 if 0
+	BackoffSeconds int `yaml:"backoffSeconds"` // 1 if 0
+}
+
+// Message returns an empty message addressed to the recipient, usable as replyTo
+func (r Recipient) Message() messaging.Message {
+	return messaging.Message{ChatID: r.ChatID, Source: r.Source, Room: r.Room, Topic: r.Topic, Email: r.Email, Channel: r.Channel, User: r.Console}
+}
+
+type WebhookConfig struct {
+	Path    string            `yaml:"path"`
+	Command string            `yaml:"command"`
+	Auth    WebhookAuth       `yaml:"auth"`
+	Args    map[string]string `yaml:"args"`
+	Filters []WebhookFilter   `yaml:"filters"`
+	Notify  string            `yaml:"notify"`
+}
+type WebhookAuth struct {
+	Type      string `yaml:"type"` // "secret", "hmac" or "none", required
+	Header    string `yaml:"header"`
+	Secret    string `yaml:"secret"`
+	Prefix    string `yaml:"prefix"`
+	Algorithm string `yaml:"algorithm"`
+}
+type WebhookFilter struct {
+	Field   string `yaml:"field"`
+	Equals  string `yaml:"equals"`
+	Matches string `yaml:"matches"`
 }
 
 // NewConfig returns a new decoded Config struct
 func NewConfig(configPath string) (*Config, error) {
+	return loadConfig(configPath, "")
+}
+
+// loadConfig reads and validates a config file. provider, if set, replaces
+// the configured provider before validating, for the -provider flag.
+func loadConfig(configPath, provider string) (*Config, error) {
 	// Create config structure
 	config := &Config{}
 
@@ -51,18 +378,32 @@ func NewConfig(configPath string) (*Config, error) {
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
-			log.Printf("error closing file: %v", err)
+			slog.Warn("error closing file", "file", configPath, "error", err)
 		}
 	}()
 
-	// Init new YAML decode
+	// Init new YAML decode. Unknown keys are rejected to catch typos
 	d := yaml.NewDecoder(file)
+	d.SetStrict(true)
 
 	// Start YAML decoding from file
 	if err := d.Decode(&config); err != nil {
 		return nil, err
 	}
 
+	if provider != "" {
+		config.Provider = provider
+	}
+
+	// Expand ${ENV_VAR} and file: references before validating
+	if err := resolveSecrets(config); err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%w", configPath, err)
+	}
+
+	if err := validateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config %s:\n%w", configPath, err)
+	}
+
 	return config, nil
 }
 
@@ -79,26 +420,71 @@ func ValidateConfigPath(path string) error {
 	return nil
 }
 
+// cliFlags are the command line flags and the subcommand they precede
+type cliFlags struct {
+	configPath string
+	check      bool
+	provider   string
+	command    string   // The subcommand, serve if none
+	args       []string // The args of the subcommand
+}
+
 // ParseFlags will create and parse the CLI flags
-// and return the path to be used elsewhere
-func ParseFlags() (string, error) {
-	// String that contains the configured configuration path
-	var configPath string
+// and return the path to be used elsewhere, whether
+// the config should only be checked, the provider override
+// and the subcommand to run. The flags are accepted before
+// or right after the subcommand.
+func ParseFlags(args []string) (cliFlags, error) {
+	var flags cliFlags
 
+	fs := flag.NewFlagSet("rpi-bot", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), cliUsage)
+		fs.PrintDefaults()
+	}
 	// Set up a CLI flag called "-config" to allow users
 	// to supply the configuration file
-	flag.StringVar(&configPath, "config", "./config.yaml", "path to config file")
+	fs.StringVar(&flags.configPath, "config", "./config.yaml", "path to config file")
+	// "-check" validates the config and exits, for pre-deploy hooks
+	fs.BoolVar(&flags.check, "check", false, "validate the config file and exit, same as validate")
+	// "-provider console" tries the commands locally, whatever the config says
+	fs.StringVar(&flags.provider, "provider", "", "messaging provider replacing the configured one")
 
 	// Actually parse the flags
-	flag.Parse()
+	if err := fs.Parse(args); err != nil {
+		return cliFlags{}, err
+	}
+	flags.command = "serve"
+	if fs.NArg() > 0 {
+		flags.command = fs.Arg(0)
+		flags.args = fs.Args()[1:]
+	}
+	sub, ok := subcommands[flags.command]
+	if !ok {
+		return cliFlags{}, fmt.Errorf("unknown command %q, see -help", flags.command)
+	}
+	if !sub.ownFlags {
+		if err := fs.Parse(flags.args); err != nil {
+			return cliFlags{}, err
+		}
+		flags.args = fs.Args()
+	}
+	if flags.check && flags.command == "serve" {
+		flags.command = "validate"
+	}
+	if len(flags.args) < sub.minArgs {
+		return cliFlags{}, fmt.Errorf("usage: rpi-bot %s %s", flags.command, sub.usage)
+	}
+	if !sub.needsConfig {
+		return flags, nil
+	}
 
 	// Validate the path first
-	if err := ValidateConfigPath(configPath); err != nil {
-		return "", err
+	if err := ValidateConfigPath(flags.configPath); err != nil {
+		return cliFlags{}, err
 	}
 
-	// Return the configuration path
-	return configPath, nil
+	return flags, nil
 }
 
 // Return a secret found in an ENV var or in config.yaml. ENV var has precedence
@@ -119,15 +505,38 @@ func GetSecret(envVar string, cfgSetting string) (string, bool) {
 }
 
 func main() {
-	cfgPath, err := ParseFlags()
+	// The bot re-executes itself to start sandboxed commands
+	maybeRunSandbox()
+
+	flags, err := ParseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if flags.command != "serve" {
+		// Only warnings and errors, the output is the command's
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+		err := runSubcommand(flags, os.Stdin, os.Stdout)
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(cliExitStatus(err))
+		}
+		return
+	}
+
+	cfg, err := loadConfig(flags.configPath, flags.provider)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	cfg, err := NewConfig(cfgPath)
+	logger, err := newLogger(cfg.Logging, configSecrets(cfg), logOutput)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
+	// Also routes the standard log package, used by some dependencies
+	slog.SetDefault(logger)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -135,27 +544,121 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		<-sigs
-		log.Println("Signal received. Terminating")
+		slog.Info("Signal received. Terminating")
 		cancel()
 	}()
 
 	sr, err := MessagingFactory(cfg)
 
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	// The console provider redraws its prompt around the logs
+	if lw, ok := sr.(messaging.LogWriter); ok && lw.LogWriter() != nil {
+		logOutput = lw.LogWriter()
+		if logger, err := newLogger(cfg.Logging, configSecrets(cfg), logOutput); err == nil {
+			slog.SetDefault(logger)
+		}
+	}
+
+	audit, err := newAuditLog(cfg.Audit)
+	if err != nil {
+		fatal(err)
+	}
+	defer func() {
+		if err := audit.Close(); err != nil {
+			slog.Error("error closing audit log", "error", err)
+		}
+	}()
+
+	history, err := newHistoryStore(cfg.History)
+	if err != nil {
+		fatal(err)
+	}
+	defer func() {
+		if err := history.Close(); err != nil {
+			slog.Error("error closing history", "error", err)
+		}
+	}()
+
+	metrics := newBotMetrics()
+	health := newHealthMonitor(cfg.Health)
+	if sr != nil {
+		metrics.watchProvider(cfg.Provider, sr)
+		health.watchProvider(cfg.Provider, sr)
 	}
 
 	var wg sync.WaitGroup
-	exec := &executor{}
+	var disc *discovery
+	if cfg.Discovery.Browse {
+		disc = newDiscovery(cfg.Discovery)
+		wg.Add(1)
+		go disc.Run(ctx, &wg)
+	}
+	fleet, err := newFleet(cfg.Fleet, disc)
+	if err != nil {
+		fatal(err)
+	}
+
+	commands := newCommandTable(cfg.Commands)
+	d := &dispatcher{
+		commands:  commands,
+		executor:  &executor{cgroup: cfg.Executor.Cgroup},
+		audit:     audit,
+		history:   history,
+		metrics:   metrics,
+		health:    health,
+		admins:    adminRecipients(cfg),
+		slots:     newSlots(cfg.Executor.MaxConcurrent),
+		limits:    newRateLimiter(cfg.RateLimit),
+		fleet:     fleet,
+		discovery: disc,
+		prompts:   newPromptStore(cfg.Prompts),
+	}
+
+	reloader := newConfigReloader(flags.configPath, cfg, commands, sr)
+	reloader.provider = flags.provider
+	wg.Add(1)
+	go reloader.Run(ctx, cfg.WatchConfig, &wg)
 
 	if cfg.Httpd.Enabled {
+		if cfg.Httpd.TLS.SelfSigned {
+			if err := ensureSelfSigned(cfg.Httpd.TLS, cfg.Httpd.Addr); err != nil {
+				fatal(err)
+			}
+		}
+		wg.Add(1)
+		go HttpServer(ctx, cfg, d, sr, &wg)
+		if cfg.Discovery.Advertise {
+			wg.Add(1)
+			go Advertise(ctx, cfg, commands, &wg)
+		}
+	}
+	if cfg.Metrics.Enabled && cfg.Metrics.Addr != "" {
 		wg.Add(1)
-		go HttpServer(ctx, cfg, exec, &wg)
+		go MetricsServer(ctx, cfg.Metrics.Addr, metrics, &wg)
 	}
 	if sr != nil {
 		wg.Add(1)
-		go MessagingPoller(ctx, sr, exec, cfg.Commands, &wg)
+		go MessagingPoller(ctx, sr, d, &wg)
+		// The console stops the bot when its input ends. The other providers
+		// only stop with the bot, even if their connection is lost.
+		if f, ok := sr.(messaging.Finite); ok {
+			go func() {
+				select {
+				case <-f.Done():
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
 	}
 	wg.Wait()
 
 }
+
+// fatal logs an error and exits
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
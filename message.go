@@ -2,12 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"os"
 	"rpi-bot/messaging"
+	"strings"
 	"sync"
+	"time"
 )
 
+// slackAPIURL is the base URL of the Slack Web API
+const slackAPIURL = "https://slack.com/api"
+
 func MessagingFactory(cfg *Config) (messaging.MessageClient, error) {
 	var sr messaging.MessageClient
 
@@ -21,6 +27,48 @@ func MessagingFactory(cfg *Config) (messaging.MessageClient, error) {
 	if cfg.Provider == "signal" {
 		return messaging.NewSignalReceiver(cfg.Signal.Socket, cfg.Signal.Sources)
 	}
+	if cfg.Provider == "matrix" {
+		accessToken, exists := GetSecret("MATRIX_ACCESSTOKEN", cfg.Matrix.AccessToken)
+		if !exists {
+			return sr, fmt.Errorf("ENV var `MATRIX_ACCESSTOKEN` not found")
+		}
+		return messaging.NewMatrixReceiver(cfg.Matrix.Homeserver, accessToken, cfg.Matrix.Rooms, cfg.Matrix.Users)
+	}
+	if cfg.Provider == "mqtt" {
+		opts, err := mqttOptions(cfg.MQTT)
+		if err != nil {
+			return sr, err
+		}
+		return messaging.NewMQTTReceiver(opts)
+	}
+	if cfg.Provider == "email" {
+		return messaging.NewEmailReceiver(emailOptions(cfg.Email))
+	}
+	if cfg.Provider == "slack" {
+		appToken, exists := GetSecret("SLACK_APPTOKEN", cfg.Slack.AppToken)
+		if !exists {
+			return sr, fmt.Errorf("ENV var `SLACK_APPTOKEN` not found")
+		}
+		botToken, exists := GetSecret("SLACK_BOTTOKEN", cfg.Slack.BotToken)
+		if !exists {
+			return sr, fmt.Errorf("ENV var `SLACK_BOTTOKEN` not found")
+		}
+		return messaging.NewSlackReceiver(slackAPIURL, appToken, botToken, cfg.Slack.Channels, cfg.Slack.Users)
+	}
+	if cfg.Provider == "mattermost" {
+		token, exists := GetSecret("MATTERMOST_TOKEN", cfg.Mattermost.Token)
+		if !exists {
+			return sr, fmt.Errorf("ENV var `MATTERMOST_TOKEN` not found")
+		}
+		return messaging.NewMattermostReceiver(cfg.Mattermost.URL, token, cfg.Mattermost.Channels, cfg.Mattermost.Users)
+	}
+	if cfg.Provider == "console" {
+		opts := messaging.ConsoleOptions{Out: os.Stdout, Socket: cfg.Console.Socket, Prompt: "rpi-bot> "}
+		if !cfg.Console.NoStdin {
+			opts.In = os.Stdin
+		}
+		return messaging.NewConsoleReceiver(opts)
+	}
 	if cfg.Provider == "" { // No messaging provider
 		return sr, nil
 	}
@@ -30,8 +78,7 @@ func MessagingFactory(cfg *Config) (messaging.MessageClient, error) {
 func MessagingPoller(
 	ctx context.Context,
 	sr messaging.MessageClient,
-	executor commandExecutor,
-	commands map[string]Command,
+	d *dispatcher,
 	wg *sync.WaitGroup,
 ) {
 	defer wg.Done()
@@ -39,33 +86,75 @@ func MessagingPoller(
 	updates := sr.GetUpdates(ctx)
 
 	for update := range updates {
-		if update.Type != messaging.Command {
+		if update.Type != messaging.Command && update.Type != messaging.Chat {
 			continue
 		}
-		command, ok := commands[update.Command]
-
-		var msg string
+		d.metrics.messageReceived(update.Provider)
+		d.health.messageReceived(update.Provider)
+		request := update
+		request.RequestID = newRequestID()
+		r, ok := d.converse(request, time.Now())
 		if !ok {
-			msg = "Command not supported"
-		} else {
-			fmtCommand, err := createCommand(command, update)
-			if err != nil {
-				msg = fmt.Sprintf("Command formatting failed: %v", err)
-
-			} else {
-				output, err := executor.execCommand(fmtCommand)
-				if err != nil {
-					msg = fmt.Sprintf("Command %s failed: %v", fmtCommand, err)
-				} else {
-					msg = output
-				}
+			if update.Type != messaging.Command {
+				continue
 			}
+			r = reply{text: chatReply(d, request)}
 		}
-		err := sr.SendMessage(msg, update)
+		err := sendReply(sr, r, update)
+		d.metrics.messageSent(update.Provider, err)
 
 		if err != nil {
-			log.Printf("Error sending a message: %v", err)
+			messageLogger(request).Error("error sending a message", "error", err)
 		}
 	}
 
 }
+
+// chatReply runs the command requested in a chat message, builtin,
+// configured or, as `/command@host`, on a fleet agent, and returns the text
+// to reply with
+func chatReply(d *dispatcher, update messaging.Message) string {
+	var output string
+	var err error
+	if name, host, ok := strings.Cut(update.Command, "@"); ok && d.fleet != nil {
+		relayed := update
+		relayed.Command = name
+		output, err = d.relay(relayed, host)
+	} else if builtin, ok := builtins[update.Command]; ok {
+		if builtin.adminOnly && !d.isAdmin(update) {
+			d.reject(d.auditEntry(update), outcomeUnauthorized, errors.New("admin only"))
+			return "Command not allowed"
+		}
+		output, err = builtin.run(d, update)
+	} else {
+		output, err = d.run(update)
+	}
+	return replyText(update.Command, output, err)
+}
+
+// replyText returns the reply to a command: its output, or what went wrong
+func replyText(command string, output string, err error) string {
+	var fmtErr *formatError
+	var execErr *execError
+	var limitErr *rateLimitError
+	var stopped *limitError
+	switch {
+	case errors.As(err, &limitErr):
+		return fmt.Sprintf("Rate limited, retry in %d s", limitErr.seconds())
+	case errors.Is(err, errUnknownCommand):
+		return "Command not supported"
+	case errors.Is(err, errUnknownHost):
+		return "Unknown host"
+	case errors.Is(err, errBusy):
+		return "Too many commands running, retry later"
+	case errors.As(err, &fmtErr):
+		return fmt.Sprintf("Command formatting failed: %v", fmtErr.err)
+	case errors.As(err, &stopped):
+		return fmt.Sprintf("Command %s stopped: %v", command, stopped)
+	case errors.As(err, &execErr):
+		return execErr.Error()
+	case err != nil:
+		return fmt.Sprintf("Command %s failed: %v", command, err)
+	}
+	return output
+}
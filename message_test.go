@@ -36,7 +36,7 @@ type MockCommandExecutor struct {
 	mock.Mock
 }
 
-func (m *MockCommandExecutor) execCommand(command string) (string, error) {
+func (m *MockCommandExecutor) execCommand(command string, _ Command) (string, error) {
 	args := m.Called(command)
 	return args.String(0), args.Error(1)
 }
@@ -180,7 +180,8 @@ func TestMessagingPoller(t *testing.T) {
 			defer cancel()
 
 			wg.Add(1)
-			go MessagingPoller(ctx, mockClient, mockExecutor, testCommands, &wg)
+			d := &dispatcher{commands: newCommandTable(testCommands), executor: mockExecutor}
+			go MessagingPoller(ctx, mockClient, d, &wg)
 
 			// Send messages to the channel
 			go func() {
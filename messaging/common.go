@@ -1,6 +1,10 @@
 package messaging
 
-import "context"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 // LLMType is an enum representing the supported LLM providers.
 type MessageType int
@@ -13,13 +17,25 @@ const (
 )
 
 type Message struct {
-	Type    MessageType
-	Command string
-	Args    []string
-	Raw     string
-	Text    string
-	ChatID  int64  //For telegram
-	Source  string //For Signal
+	Type      MessageType
+	Command   string
+	Args      []string
+	Raw       string
+	Text      string // The message as typed, answering a prompt
+	ChatID    int64  //For telegram
+	Source    string //For Signal
+	Room      string // For Matrix
+	Topic     string // For MQTT, the response topic
+	Email     string // For email, the address replies are sent to
+	Channel   string // For Slack and Mattermost
+	Thread    string // For Slack and Mattermost, the thread replied in
+	Session   string // For the console, the terminal or socket connection
+	Provider  string // Provider that received the message
+	User      string // Caller identity, e.g. Telegram user ID or Signal number
+	RequestID string // Correlates the logs and audit entries of a request
+	// CorrelationID ties the reply to the request: the MQTT correlation ID
+	// or the Message-ID of the email replied to
+	CorrelationID string
 }
 
 type MessageReceiver interface {
@@ -29,7 +45,38 @@ type MessageReceiver interface {
 type MessageSender interface {
 	SendMessage(message string, replyTo Message) error
 }
+
+// Finite is implemented by clients whose input can end, like the console
+// reading stdin. The channel returned by Done is closed when it has.
+type Finite interface {
+	Done() <-chan struct{}
+}
+
+// ChoiceSender is implemented by clients that can offer the answers to a
+// question as buttons
+type ChoiceSender interface {
+	SendChoices(message string, choices []string, replyTo Message) error
+}
+
 type MessageClient interface {
 	MessageReceiver
 	MessageSender
 }
+
+// StatusReporter is implemented by clients that can report whether they are
+// connected to their messaging service
+type StatusReporter interface {
+	Connected() bool
+}
+
+// ActivityReporter is implemented by clients that poll their messaging
+// service, reporting when it was last reached successfully
+type ActivityReporter interface {
+	LastActivity() time.Time
+}
+
+// LogWriter is implemented by clients sharing the terminal with the logs,
+// which must be written through the returned writer if not nil
+type LogWriter interface {
+	LogWriter() io.Writer
+}
@@ -0,0 +1,314 @@
+package messaging
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// ConsoleOptions configures a console receiver
+type ConsoleOptions struct {
+	In     io.Reader // Commands typed locally, none if nil
+	Out    io.Writer // Where the replies to In are written
+	Socket string    // Unix socket accepting more sessions, optional
+	Prompt string
+}
+
+// consoleStdin is the session of the commands read from In
+const consoleStdin = "stdin"
+
+type consoleReceiver struct {
+	opts     ConsoleOptions
+	user     string         // The local user, the caller of In
+	term     *term.Terminal // Set if In is a terminal
+	listener net.Listener
+	ch       chan Message
+	done     chan struct{} // Closed when In ends
+
+	// Guards closing ch against the sessions still sending
+	mu     sync.RWMutex
+	closed bool
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*consoleSession
+	next       int // Numbers the socket sessions
+}
+
+// consoleSession is a terminal or a socket connection replies are written to
+type consoleSession struct {
+	user string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+func (s *consoleSession) write(text string) error {
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.w, text)
+	return err
+}
+
+// NewConsoleReceiver returns a client reading commands from opts.In, line
+// by line, and from the connections to opts.Socket. A terminal gets line
+// editing and history.
+func NewConsoleReceiver(opts ConsoleOptions) (*consoleReceiver, error) {
+	c := &consoleReceiver{
+		opts:     opts,
+		user:     "console",
+		ch:       make(chan Message, 10),
+		done:     make(chan struct{}),
+		sessions: map[string]*consoleSession{},
+	}
+	if u, err := user.Current(); err == nil {
+		c.user = u.Username
+	}
+	if opts.In != nil {
+		out := opts.Out
+		if f, ok := opts.In.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+			c.term = term.NewTerminal(struct {
+				io.Reader
+				io.Writer
+			}{opts.In, opts.Out}, opts.Prompt)
+			if width, height, err := term.GetSize(int(f.Fd())); err == nil {
+				_ = c.term.SetSize(width, height)
+			}
+			out = c.term
+		}
+		c.sessions[consoleStdin] = &consoleSession{user: c.user, w: out}
+	}
+	if opts.Socket != "" {
+		ln, err := listenConsole(opts.Socket)
+		if err != nil {
+			return nil, fmt.Errorf("console: %w", err)
+		}
+		c.listener = ln
+	}
+	return c, nil
+}
+
+// listenConsole listens on a unix socket only the owner and the group of
+// the bot can connect to, replacing the one a previous run left behind
+func listenConsole(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// LogWriter returns the terminal, which the logs must be written through
+// to keep the prompt and the line being edited intact
+func (c *consoleReceiver) LogWriter() io.Writer {
+	if c.term == nil {
+		return nil
+	}
+	return c.term
+}
+
+// GetUpdates reads commands until the context is done or, when reading
+// from opts.In, until its end: Ctrl-D or Ctrl-C on a terminal
+func (c *consoleReceiver) GetUpdates(ctx context.Context) <-chan Message {
+	go c.messageReceiver(ctx)
+	return c.ch
+}
+
+// Done is closed when In ends, not when the socket sessions do
+func (c *consoleReceiver) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *consoleReceiver) messageReceiver(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if c.listener != nil {
+		slog.Info("console: listening", "socket", c.opts.Socket)
+		stop := context.AfterFunc(ctx, func() { _ = c.listener.Close() })
+		defer stop()
+		go c.serveSocket(ctx)
+	}
+	inDone := make(chan struct{})
+	if c.opts.In != nil {
+		if c.term != nil {
+			fd := int(c.opts.In.(*os.File).Fd())
+			state, err := term.MakeRaw(fd)
+			if err != nil {
+				slog.Error("console: error setting up the terminal", "error", err)
+			} else {
+				defer func() { _ = term.Restore(fd, state) }()
+			}
+		}
+		go func() {
+			defer close(inDone)
+			c.readInput(ctx)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		slog.Debug("console: context done, returning")
+	case <-inDone:
+		slog.Debug("console: input closed, returning")
+		close(c.done)
+	}
+	cancel()
+	if c.listener != nil {
+		_ = c.listener.Close()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	close(c.ch)
+}
+
+// readInput reads the commands of opts.In until its end
+func (c *consoleReceiver) readInput(ctx context.Context) {
+	if c.term != nil {
+		for {
+			line, err := c.term.ReadLine()
+			if err != nil {
+				return
+			}
+			c.deliver(ctx, line, c.user, consoleStdin)
+		}
+	}
+	scanner := bufio.NewScanner(c.opts.In)
+	for scanner.Scan() {
+		c.deliver(ctx, scanner.Text(), c.user, consoleStdin)
+	}
+}
+
+func (c *consoleReceiver) serveSocket(ctx context.Context) {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				slog.Error("console: error accepting a connection", "error", err)
+			}
+			return
+		}
+		go c.serveConn(ctx, conn)
+	}
+}
+
+// serveConn reads the commands of a socket connection. The caller is the
+// local user at the other end.
+func (c *consoleReceiver) serveConn(ctx context.Context, conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	caller := "socket"
+	if uc, ok := conn.(*net.UnixConn); ok {
+		if name := peerUser(uc); name != "" {
+			caller = name
+		}
+	}
+	c.sessionsMu.Lock()
+	c.next++
+	session := fmt.Sprintf("socket:%d", c.next)
+	c.sessions[session] = &consoleSession{user: caller, w: conn}
+	c.sessionsMu.Unlock()
+	slog.Info("console: session opened", "session", session, "user", caller)
+	defer func() {
+		c.sessionsMu.Lock()
+		delete(c.sessions, session)
+		c.sessionsMu.Unlock()
+		slog.Info("console: session closed", "session", session, "user", caller)
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		c.deliver(ctx, scanner.Text(), caller, session)
+	}
+}
+
+// deliver sends the command of a line, if it has one
+func (c *consoleReceiver) deliver(ctx context.Context, line, caller, session string) {
+	m, ok := parseConsoleLine(line)
+	if !ok {
+		return
+	}
+	m.User = caller
+	m.Session = session
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.ch <- m:
+	case <-ctx.Done():
+	}
+}
+
+// parseConsoleLine parses a command typed with or without the leading
+// slash, e.g. "/df /home" or "df /home". Blank lines are skipped.
+func parseConsoleLine(line string) (Message, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return Message{}, false
+	}
+	return Message{
+		Type:     Command,
+		Command:  strings.TrimPrefix(fields[0], "/"),
+		Args:     fields[1:],
+		Raw:      line,
+		Text:     strings.TrimSpace(line),
+		Provider: "console",
+	}, true
+}
+
+// SendMessage writes the output to the session of replyTo or, without a
+// session, to every open session of replyTo.User
+func (c *consoleReceiver) SendMessage(message string, replyTo Message) error {
+	var targets []*consoleSession
+	c.sessionsMu.Lock()
+	if replyTo.Session != "" {
+		if s, ok := c.sessions[replyTo.Session]; ok {
+			targets = append(targets, s)
+		}
+	} else {
+		for _, s := range c.sessions {
+			if s.user == replyTo.User {
+				targets = append(targets, s)
+			}
+		}
+	}
+	c.sessionsMu.Unlock()
+
+	if len(targets) == 0 {
+		return fmt.Errorf("console: no open session for %s", cmp.Or(replyTo.Session, replyTo.User))
+	}
+	var errs []error
+	for _, s := range targets {
+		errs = append(errs, s.write(message))
+	}
+	return errors.Join(errs...)
+}
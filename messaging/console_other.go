@@ -0,0 +1,10 @@
+//go:build !linux
+
+package messaging
+
+import "net"
+
+// peerUser is only supported on Linux, callers are named "socket" elsewhere
+func peerUser(*net.UnixConn) string {
+	return ""
+}
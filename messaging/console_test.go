@@ -0,0 +1,142 @@
+package messaging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConsoleLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantOK      bool
+		wantCommand string
+		wantArgs    []string
+	}{
+		{line: "/df /home", wantOK: true, wantCommand: "df", wantArgs: []string{"/home"}},
+		{line: "  df   /home ", wantOK: true, wantCommand: "df", wantArgs: []string{"/home"}},
+		{line: "uptime", wantOK: true, wantCommand: "uptime", wantArgs: []string{}},
+		{line: "   "},
+		{line: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			m, ok := parseConsoleLine(tt.line)
+			require.Equal(t, tt.wantOK, ok)
+			if !ok {
+				return
+			}
+			assert.Equal(t, Command, m.Type)
+			assert.Equal(t, tt.wantCommand, m.Command)
+			assert.Equal(t, tt.wantArgs, m.Args)
+			assert.Equal(t, tt.line, m.Raw)
+			assert.Equal(t, "console", m.Provider)
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestConsoleReceiver(t *testing.T) {
+	me, err := user.Current()
+	require.NoError(t, err)
+	socket := filepath.Join(t.TempDir(), "console.sock")
+	// A socket left behind by a previous run is replaced
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	in, typed := io.Pipe()
+	out := &lockedBuffer{}
+	r, err := NewConsoleReceiver(ConsoleOptions{In: in, Out: out, Socket: socket, Prompt: "> "})
+	require.NoError(t, err)
+	assert.Nil(t, r.LogWriter(), "not a terminal")
+	fi, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), fi.Mode().Perm())
+
+	updates := r.GetUpdates(context.Background())
+
+	_, err = io.WriteString(typed, "\n/df /home\n")
+	require.NoError(t, err)
+	m := <-updates
+	assert.Equal(t, "df", m.Command)
+	assert.Equal(t, []string{"/home"}, m.Args)
+	assert.Equal(t, me.Username, m.User)
+	assert.Equal(t, "stdin", m.Session)
+	require.NoError(t, r.SendMessage("/dev/sda1  10G", m))
+	assert.Equal(t, "/dev/sda1  10G\n", out.String())
+
+	conn, err := net.Dial("unix", socket)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	_, err = io.WriteString(conn, "uptime\n")
+	require.NoError(t, err)
+	m = <-updates
+	assert.Equal(t, "uptime", m.Command)
+	assert.Equal(t, "socket:1", m.Session)
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, me.Username, m.User)
+	}
+	require.NoError(t, r.SendMessage("up 3 days\n", m))
+	replies := bufio.NewReader(conn)
+	line, err := replies.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "up 3 days\n", line)
+
+	// Without a session, every session of the user gets the message
+	require.NoError(t, r.SendMessage("backup done", Message{User: me.Username}))
+	if runtime.GOOS == "linux" {
+		line, err = replies.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "backup done\n", line)
+	}
+	assert.Equal(t, "/dev/sda1  10G\nbackup done\n", out.String())
+	assert.ErrorContains(t, r.SendMessage("backup done", Message{User: "nobody"}), "no open session for nobody")
+
+	// The end of the input stops the receiver
+	select {
+	case <-r.Done():
+		t.Fatal("done before the input ends")
+	default:
+	}
+	require.NoError(t, typed.Close())
+	for range updates {
+	}
+	<-r.Done()
+	_, err = replies.ReadString('\n')
+	assert.ErrorIs(t, err, io.EOF)
+	// The commands read before the end are still answered
+	require.NoError(t, r.SendMessage("bye", Message{Session: "stdin"}))
+	assert.Equal(t, "/dev/sda1  10G\nbackup done\nbye\n", out.String())
+	_, err = os.Stat(socket)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,475 @@
+package messaging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-message/mail"
+)
+
+// emailRetryDelay is the wait after failing to reach the IMAP server
+var emailRetryDelay = 30 * time.Second
+
+// emailDialTimeout bounds connecting to the IMAP and SMTP servers
+const emailDialTimeout = 30 * time.Second
+
+// MailServer is an IMAP or SMTP server and the account used on it
+type MailServer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	// Security is "tls" (implicit TLS), "starttls" or "none"
+	Security string
+}
+
+// EmailOptions configures the mailbox commands are read from and how
+// replies are sent
+type EmailOptions struct {
+	IMAP         MailServer
+	SMTP         MailServer
+	Mailbox      string // e.g. INBOX
+	From         string // Address replies are sent from
+	PollInterval time.Duration
+	// Idle waits for new mail with IMAP IDLE, still checking every
+	// PollInterval
+	Idle    bool
+	Senders []string // Allowed sender addresses
+	// Secret must be the first line of the body, if set
+	Secret string
+	// RequireDKIM accepts a message only if the Authentication-Results
+	// header added by AuthservID reports a DKIM pass for the sender domain
+	RequireDKIM bool
+	AuthservID  string
+	TLS         *tls.Config // Used by both servers, the defaults if nil
+}
+
+type emailReceiver struct {
+	opts      EmailOptions
+	ch        chan Message
+	connected atomic.Bool
+	lastCheck atomic.Pointer[time.Time]
+}
+
+// NewEmailReceiver checks the IMAP account and mailbox and returns a
+// client reading commands from it
+func NewEmailReceiver(opts EmailOptions) (*emailReceiver, error) {
+	e := &emailReceiver{
+		opts: opts,
+		ch:   make(chan Message, 10),
+	}
+	c, err := e.connect()
+	if err != nil {
+		return nil, fmt.Errorf("email: %w", err)
+	}
+	_ = c.Logout()
+	return e, nil
+}
+
+func (e *emailReceiver) tlsConfig(addr string) *tls.Config {
+	cfg := &tls.Config{}
+	if e.opts.TLS != nil {
+		cfg = e.opts.TLS.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return cfg
+}
+
+// connect logs in to the IMAP server and selects the mailbox
+func (e *emailReceiver) connect() (*client.Client, error) {
+	s := e.opts.IMAP
+	dialer := &net.Dialer{Timeout: emailDialTimeout}
+	var c *client.Client
+	var err error
+	if s.Security == "tls" {
+		c, err = client.DialWithDialerTLS(dialer, s.Addr, e.tlsConfig(s.Addr))
+	} else {
+		c, err = client.DialWithDialer(dialer, s.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("imap: %w", err)
+	}
+	if s.Security == "starttls" {
+		if err := c.StartTLS(e.tlsConfig(s.Addr)); err != nil {
+			_ = c.Logout()
+			return nil, fmt.Errorf("imap: starttls: %w", err)
+		}
+	}
+	// An IDLE command lasts up to the poll interval
+	c.Timeout = e.opts.PollInterval + time.Minute
+	if err := c.Login(s.Username, s.Password); err != nil {
+		_ = c.Logout()
+		return nil, fmt.Errorf("imap: login: %w", err)
+	}
+	if _, err := c.Select(e.opts.Mailbox, false); err != nil {
+		_ = c.Logout()
+		return nil, fmt.Errorf("imap: select %s: %w", e.opts.Mailbox, err)
+	}
+	return c, nil
+}
+
+func (e *emailReceiver) GetUpdates(ctx context.Context) <-chan Message {
+	go e.messageReceiver(ctx)
+	return e.ch
+}
+
+// Connected reports whether the IMAP connection is up
+func (e *emailReceiver) Connected() bool {
+	return e.connected.Load()
+}
+
+// LastActivity returns the time the mailbox was last checked
+func (e *emailReceiver) LastActivity() time.Time {
+	if last := e.lastCheck.Load(); last != nil {
+		return *last
+	}
+	return time.Time{}
+}
+
+func (e *emailReceiver) messageReceiver(ctx context.Context) {
+	defer close(e.ch)
+	defer e.connected.Store(false)
+	slog.Info("email: checking mailbox", "account", e.opts.IMAP.Username, "mailbox", e.opts.Mailbox, "idle", e.opts.Idle)
+
+	var c *client.Client
+	defer func() {
+		if c != nil {
+			_ = c.Logout()
+		}
+	}()
+	for ctx.Err() == nil {
+		if c == nil {
+			var err error
+			if c, err = e.connect(); err != nil {
+				e.connected.Store(false)
+				slog.Warn("email: error connecting, retrying", "error", err)
+				sleepContext(ctx, emailRetryDelay)
+				continue
+			}
+			e.connected.Store(true)
+		}
+		err := e.check(ctx, c)
+		if err == nil {
+			err = e.wait(ctx, c)
+		}
+		if err != nil && ctx.Err() == nil {
+			slog.Warn("email: connection failed, reconnecting", "error", err)
+			e.connected.Store(false)
+			_ = c.Logout()
+			c = nil
+			sleepContext(ctx, emailRetryDelay)
+		}
+	}
+	slog.Debug("email: context done, returning")
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// check fetches the unseen messages, marking them seen before they are
+// handled so a command is never run twice
+func (e *emailReceiver) check(ctx context.Context, c *client.Client) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e.lastCheck.Store(&now)
+	if len(uids) == 0 {
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	store := imap.FormatFlagsOp(imap.AddFlags, true)
+	if err := c.UidStore(seqset, store, []interface{}{imap.SeenFlag}, nil); err != nil {
+		return err
+	}
+	section := &imap.BodySectionName{Peek: true}
+	messages := make(chan *imap.Message, len(uids))
+	if err := c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+		return err
+	}
+	for msg := range messages {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		m, err := e.parse(body)
+		if err != nil {
+			slog.Warn("email: ignoring message", "uid", msg.Uid, "error", err)
+			continue
+		}
+		select {
+		case e.ch <- m:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// wait returns when the mailbox must be checked again: after the poll
+// interval or, with IDLE, when the server reports a change
+func (e *emailReceiver) wait(ctx context.Context, c *client.Client) error {
+	if !e.opts.Idle {
+		sleepContext(ctx, e.opts.PollInterval)
+		return nil
+	}
+	updates := make(chan client.Update, 100)
+	c.Updates = updates
+	defer func() { c.Updates = nil }()
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, &client.IdleOptions{LogoutTimeout: -1})
+	}()
+	timer := time.NewTimer(e.opts.PollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case update := <-updates:
+			if _, ok := update.(*client.MailboxUpdate); !ok {
+				continue
+			}
+		case <-timer.C:
+		case <-ctx.Done():
+		case err := <-done:
+			return err
+		}
+		close(stop)
+		return <-done
+	}
+}
+
+// parse reads a message, returning an error if it must be ignored
+func (e *emailReceiver) parse(r io.Reader) (Message, error) {
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		return Message{}, err
+	}
+	defer func() { _ = mr.Close() }()
+
+	from, err := mr.Header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return Message{}, fmt.Errorf("invalid From: %v", err)
+	}
+	sender := strings.ToLower(from[0].Address)
+	if !slices.ContainsFunc(e.opts.Senders, func(s string) bool { return strings.EqualFold(s, sender) }) {
+		return Message{}, fmt.Errorf("sender %s not allowed", sender)
+	}
+	if e.opts.RequireDKIM && !dkimPassed(mr.Header.Values("Authentication-Results"), e.opts.AuthservID, sender) {
+		return Message{}, fmt.Errorf("no DKIM pass for %s", sender)
+	}
+	if e.opts.Secret != "" {
+		line, err := firstLine(mr)
+		if err != nil {
+			return Message{}, err
+		}
+		if !hmac.Equal([]byte(line), []byte(e.opts.Secret)) {
+			return Message{}, fmt.Errorf("wrong secret from %s", sender)
+		}
+	}
+
+	subject, err := mr.Header.Subject()
+	if err != nil {
+		return Message{}, err
+	}
+	messageID, _ := mr.Header.MessageID()
+	m := parseEmailSubject(subject)
+	m.User = sender
+	m.Email = sender
+	m.CorrelationID = messageID
+	return m, nil
+}
+
+func parseEmailSubject(subject string) Message {
+	fields := strings.Fields(subject)
+	message := Message{
+		Type:     Chat,
+		Raw:      subject,
+		Text:     subject,
+		Provider: "email",
+	}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+		message.Type = Command
+		message.Command = strings.TrimPrefix(fields[0], "/")
+		message.Args = fields[1:]
+	}
+	return message
+}
+
+// dkimPassed reports whether the first Authentication-Results header added
+// by authservID has a DKIM pass for the domain of sender. Headers of other
+// servers are ignored, as senders can add them.
+func dkimPassed(results []string, authservID, sender string) bool {
+	_, domain, _ := strings.Cut(sender, "@")
+	for _, header := range results {
+		id, results, _ := strings.Cut(header, ";")
+		if fields := strings.Fields(id); len(fields) == 0 || !strings.EqualFold(fields[0], authservID) {
+			continue
+		}
+		for _, result := range strings.Split(results, ";") {
+			fields := strings.Fields(result)
+			if len(fields) == 0 || !strings.EqualFold(fields[0], "dkim=pass") {
+				continue
+			}
+			for _, prop := range fields[1:] {
+				if d, ok := strings.CutPrefix(strings.ToLower(prop), "header.d="); ok && d == domain {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// firstLine returns the first non-empty line of the text body
+func firstLine(mr *mail.Reader) (string, error) {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return "", errors.New("no text body")
+		}
+		if err != nil {
+			return "", err
+		}
+		h, ok := part.Header.(*mail.InlineHeader)
+		if !ok {
+			continue
+		}
+		if t, _, _ := h.ContentType(); t != "" && t != "text/plain" {
+			continue
+		}
+		scanner := bufio.NewScanner(part.Body)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				return line, nil
+			}
+		}
+		return "", scanner.Err()
+	}
+}
+
+// SendMessage replies by mail to the sender of replyTo, in the same thread
+func (e *emailReceiver) SendMessage(message string, replyTo Message) error {
+	subject := "rpi-bot"
+	if replyTo.Raw != "" {
+		subject = "Re: " + replyTo.Raw
+	}
+	msg, err := e.compose(replyTo.Email, subject, replyTo.CorrelationID, message)
+	if err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	if err := e.send(replyTo.Email, msg); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return nil
+}
+
+func (e *emailReceiver) compose(to, subject, inReplyTo, body string) ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	_, domain, _ := strings.Cut(e.opts.From, "@")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.opts.From)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	if inReplyTo != "" {
+		fmt.Fprintf(&b, "In-Reply-To: <%s>\r\nReferences: <%s>\r\n", inReplyTo, inReplyTo)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// send delivers a message through the SMTP server
+func (e *emailReceiver) send(to string, msg []byte) error {
+	s := e.opts.SMTP
+	dialer := &net.Dialer{Timeout: emailDialTimeout}
+	var conn net.Conn
+	var err error
+	if s.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Addr, e.tlsConfig(s.Addr))
+	} else {
+		conn, err = dialer.Dial("tcp", s.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("smtp: %w", err)
+	}
+	defer func() { _ = c.Close() }()
+	if s.Security == "starttls" {
+		if err := c.StartTLS(e.tlsConfig(s.Addr)); err != nil {
+			return fmt.Errorf("smtp: starttls: %w", err)
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return fmt.Errorf("smtp: auth: %w", err)
+		}
+	}
+	if err := c.Mail(e.opts.From); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	return c.Quit()
+}
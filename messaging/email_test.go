@@ -0,0 +1,341 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEmailSubject(t *testing.T) {
+	tests := []struct {
+		subject     string
+		wantType    MessageType
+		wantCommand string
+		wantArgs    []string
+	}{
+		{subject: "/df /home", wantType: Command, wantCommand: "df", wantArgs: []string{"/home"}},
+		{subject: "  /uptime  ", wantType: Command, wantCommand: "uptime", wantArgs: []string{}},
+		{subject: "Re: /df /home", wantType: Chat},
+		{subject: "", wantType: Chat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			m := parseEmailSubject(tt.subject)
+			assert.Equal(t, tt.wantType, m.Type)
+			assert.Equal(t, tt.wantCommand, m.Command)
+			assert.Equal(t, tt.wantArgs, m.Args)
+			assert.Equal(t, tt.subject, m.Raw)
+			assert.Equal(t, "email", m.Provider)
+		})
+	}
+}
+
+func TestDKIMPassed(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []string
+		want    bool
+	}{
+		{
+			name:    "pass",
+			results: []string{"mx.example.org; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com header.s=sel"},
+			want:    true,
+		},
+		{
+			name:    "pass with version",
+			results: []string{"MX.example.org 1; dkim=pass (2048-bit key) header.d=Example.com"},
+			want:    true,
+		},
+		{
+			name:    "fail",
+			results: []string{"mx.example.org; dkim=fail header.d=example.com"},
+		},
+		{
+			name:    "other domain",
+			results: []string{"mx.example.org; dkim=pass header.d=attacker.net"},
+		},
+		{
+			name:    "untrusted server",
+			results: []string{"mx.attacker.net; dkim=pass header.d=example.com"},
+		},
+		{
+			name: "only the first trusted header counts",
+			results: []string{
+				"mx.example.org; dkim=none",
+				"mx.example.org; dkim=pass header.d=example.com",
+			},
+		},
+		{
+			name: "after an untrusted one",
+			results: []string{
+				"mx.attacker.net; dkim=fail",
+				"mx.example.org; dkim=pass header.d=example.com",
+			},
+			want: true,
+		},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dkimPassed(tt.results, "mx.example.org", "alice@example.com"))
+		})
+	}
+}
+
+// lockedMailbox serializes the access to a mailbox of the memory backend,
+// which isn't safe for concurrent use
+type lockedMailbox struct {
+	backend.Mailbox
+	mu *sync.Mutex
+}
+
+func (m lockedMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Mailbox.Status(items)
+}
+
+func (m lockedMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Mailbox.ListMessages(uid, seqSet, items, ch)
+}
+
+func (m lockedMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Mailbox.SearchMessages(uid, criteria)
+}
+
+func (m lockedMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Mailbox.CreateMessage(flags, date, body)
+}
+
+func (m lockedMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Mailbox.UpdateMessagesFlags(uid, seqset, op, flags)
+}
+
+type lockedUser struct {
+	backend.User
+	mu *sync.Mutex
+}
+
+func (u lockedUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return lockedMailbox{Mailbox: mbox, mu: u.mu}, nil
+}
+
+type lockedBackend struct {
+	*memory.Backend
+	mu sync.Mutex
+}
+
+func (b *lockedBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return lockedUser{User: user, mu: &b.mu}, nil
+}
+
+// deliver adds a message to the inbox, as an MTA would
+func (b *lockedBackend) deliver(t *testing.T, msg string) {
+	t.Helper()
+	user, err := b.Login(nil, "username", "password")
+	require.NoError(t, err)
+	inbox, err := user.GetMailbox("INBOX")
+	require.NoError(t, err)
+	require.NoError(t, inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(msg)))
+}
+
+func newIMAPServer(t *testing.T) (*lockedBackend, string) {
+	be := &lockedBackend{Backend: memory.New()}
+	s := imapserver.New(be)
+	s.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return be, ln.Addr().String()
+}
+
+// smtpBackend accepts mail from an authenticated client, sending it to sent
+type smtpBackend struct {
+	sent chan sentMail
+}
+
+type sentMail struct {
+	from, to string
+	data     []byte
+}
+
+type smtpSession struct {
+	be       *smtpBackend
+	from, to string
+}
+
+func (b *smtpBackend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	if username != "pi@example.org" || password != "smtp-secret" {
+		return nil, smtp.ErrAuthRequired
+	}
+	return &smtpSession{be: b}, nil
+}
+
+func (b *smtpBackend) AnonymousLogin(*smtp.ConnectionState) (smtp.Session, error) {
+	return nil, smtp.ErrAuthRequired
+}
+
+func (s *smtpSession) Reset()        {}
+func (s *smtpSession) Logout() error { return nil }
+func (s *smtpSession) Mail(from string, _ smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+func (s *smtpSession) Rcpt(to string) error {
+	s.to = to
+	return nil
+}
+func (s *smtpSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.sent <- sentMail{from: s.from, to: s.to, data: data}
+	return nil
+}
+
+func newSMTPServer(t *testing.T) (*smtpBackend, string) {
+	be := &smtpBackend{sent: make(chan sentMail, 10)}
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = s.Serve(ln) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return be, ln.Addr().String()
+}
+
+func testMail(from, subject, messageID, authResults, body string) string {
+	var b strings.Builder
+	if authResults != "" {
+		b.WriteString("Authentication-Results: " + authResults + "\r\n")
+	}
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: pi@example.org\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("Message-ID: <" + messageID + ">\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(body)
+	return b.String()
+}
+
+func TestEmailReceiver(t *testing.T) {
+	for _, idle := range []bool{false, true} {
+		name := "polling"
+		if idle {
+			name = "idle"
+		}
+		t.Run(name, func(t *testing.T) {
+			imapBackend, imapAddr := newIMAPServer(t)
+			smtpBackend, smtpAddr := newSMTPServer(t)
+			opts := EmailOptions{
+				IMAP:         MailServer{Addr: imapAddr, Username: "username", Password: "password", Security: "none"},
+				SMTP:         MailServer{Addr: smtpAddr, Username: "pi@example.org", Password: "smtp-secret", Security: "none"},
+				Mailbox:      "INBOX",
+				From:         "pi@example.org",
+				PollInterval: 20 * time.Millisecond,
+				Idle:         idle,
+				Senders:      []string{"Alice@example.com"},
+				Secret:       "s3cret",
+				RequireDKIM:  true,
+				AuthservID:   "mx.example.org",
+			}
+
+			wrong := opts
+			wrong.IMAP.Password = "wrong"
+			_, err := NewEmailReceiver(wrong)
+			require.ErrorContains(t, err, "imap: login")
+
+			r, err := NewEmailReceiver(opts)
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			updates := r.GetUpdates(ctx)
+
+			pass := "mx.example.org; dkim=pass header.d=example.com"
+			imapBackend.deliver(t, testMail("Mallory <mallory@example.net>", "/reboot", "1@example.net", pass, "s3cret\r\n"))
+			imapBackend.deliver(t, testMail("alice@example.com", "/reboot", "2@example.com", "mx.example.org; dkim=fail", "s3cret\r\n"))
+			imapBackend.deliver(t, testMail("alice@example.com", "/reboot", "3@example.com", pass, "guess\r\n"))
+			imapBackend.deliver(t, testMail("Alice <ALICE@example.com>", "/df /home", "4@example.com", pass, "\r\n  s3cret  \r\n-- \r\nAlice\r\n"))
+
+			m := <-updates
+			assert.Equal(t, Command, m.Type)
+			assert.Equal(t, "df", m.Command)
+			assert.Equal(t, []string{"/home"}, m.Args)
+			assert.Equal(t, "alice@example.com", m.User)
+			assert.Equal(t, "alice@example.com", m.Email)
+			assert.Equal(t, "4@example.com", m.CorrelationID)
+			assert.True(t, r.Connected())
+			assert.WithinDuration(t, time.Now(), r.LastActivity(), time.Second)
+
+			require.NoError(t, r.SendMessage("/dev/sda1  10G  4G  40%", m))
+			sent := <-smtpBackend.sent
+			assert.Equal(t, "pi@example.org", sent.from)
+			assert.Equal(t, "alice@example.com", sent.to)
+			reply, err := mail.CreateReader(bytes.NewReader(sent.data))
+			require.NoError(t, err)
+			subject, err := reply.Header.Subject()
+			require.NoError(t, err)
+			assert.Equal(t, "Re: /df /home", subject)
+			assert.Equal(t, "<4@example.com>", reply.Header.Get("In-Reply-To"))
+			part, err := reply.NextPart()
+			require.NoError(t, err)
+			body, err := io.ReadAll(part.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "/dev/sda1  10G  4G  40%", strings.TrimSpace(string(body)))
+
+			// Every message was marked seen, the rejected ones included
+			select {
+			case m := <-updates:
+				t.Fatalf("unexpected message %+v", m)
+			case <-time.After(100 * time.Millisecond):
+			}
+			user, err := imapBackend.Login(nil, "username", "password")
+			require.NoError(t, err)
+			inbox, err := user.GetMailbox("INBOX")
+			require.NoError(t, err)
+			criteria := imap.NewSearchCriteria()
+			criteria.WithoutFlags = []string{imap.SeenFlag}
+			unseen, err := inbox.SearchMessages(true, criteria)
+			require.NoError(t, err)
+			assert.Empty(t, unseen)
+
+			cancel()
+			for range updates {
+			}
+			assert.False(t, r.Connected())
+		})
+	}
+}
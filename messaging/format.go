@@ -0,0 +1,76 @@
+package messaging
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// codeBlock wraps text in a Markdown code block, as rendered by Slack and
+// Mattermost. Fences inside the text are broken up so they can't end the
+// block early.
+func codeBlock(text string) string {
+	return fence(escapeFences(text))
+}
+
+// codeBlocks formats text as code blocks of at most max bytes each, the
+// fences and their escapes included
+func codeBlocks(text string, max int) []string {
+	parts := splitMessage(escapeFences(text), max-codeBlockOverhead)
+	for i, part := range parts {
+		parts[i] = fence(part)
+	}
+	return parts
+}
+
+func escapeFences(text string) string {
+	return strings.ReplaceAll(text, "```", "`\u200b``") // Zero width space
+}
+
+func fence(text string) string {
+	return "```\n" + strings.TrimRight(text, "\n") + "\n```"
+}
+
+// codeBlockOverhead is what fence adds to a text
+const codeBlockOverhead = len("```\n\n```")
+
+// splitMessage splits text into parts of at most max bytes, at line breaks
+// when possible and never inside a UTF-8 sequence. Each part is sent as its
+// own message by providers limiting the message size.
+func splitMessage(text string, max int) []string {
+	var parts []string
+	for len(text) > max {
+		cut := strings.LastIndexByte(text[:max], '\n') + 1
+		if cut == 0 {
+			// No line break: cut the line at a rune boundary
+			cut = max
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+		}
+		parts = append(parts, text[:cut])
+		text = text[cut:]
+	}
+	return append(parts, text)
+}
+
+// parseChatCommand parses a message addressed to a bot with a mention, e.g.
+// "@rpibot df /home", or slash-style, "/df /home". Slash-style messages
+// don't need the mention. Mentions are only recognized at the start.
+func parseChatCommand(text, mention string) (MessageType, string, []string) {
+	fields := strings.Fields(text)
+	addressed := false
+	if len(fields) > 0 && mention != "" && fields[0] == mention {
+		fields = fields[1:]
+		addressed = true
+	}
+	if len(fields) == 0 {
+		return Chat, "", nil
+	}
+	if strings.HasPrefix(fields[0], "/") {
+		return Command, strings.TrimPrefix(fields[0], "/"), fields[1:]
+	}
+	if addressed {
+		return Command, fields[0], fields[1:]
+	}
+	return Chat, "", nil
+}
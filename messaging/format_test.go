@@ -0,0 +1,75 @@
+package messaging
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeBlock(t *testing.T) {
+	assert.Equal(t, "```\nup 3 days\n```", codeBlock("up 3 days\n"))
+	assert.Equal(t, "```\na `\u200b`` b\n```", codeBlock("a ``` b"))
+	assert.LessOrEqual(t, len(codeBlock("x"))-len("x"), codeBlockOverhead)
+}
+
+func TestCodeBlocks(t *testing.T) {
+	assert.Equal(t, []string{"```\nup 3 days\n```"}, codeBlocks("up 3 days\n", 100))
+
+	// Escaped fences count against the limit
+	text := strings.Repeat("```\n", 50)
+	parts := codeBlocks(text, 64)
+	require.Greater(t, len(parts), 1)
+	for _, part := range parts {
+		assert.LessOrEqual(t, len(part), 64)
+		assert.Equal(t, 2, strings.Count(part, "```"), "only the fences of the block")
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		max  int
+		want []string
+	}{
+		{name: "short", text: "hello", max: 10, want: []string{"hello"}},
+		{name: "empty", text: "", max: 10, want: []string{""}},
+		{name: "at line breaks", text: "line 1\nline 2\nline 3\n", max: 14, want: []string{"line 1\nline 2\n", "line 3\n"}},
+		{name: "long line", text: "abcdefghij", max: 4, want: []string{"abcd", "efgh", "ij"}},
+		{name: "runes", text: "ééé", max: 3, want: []string{"é", "é", "é"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitMessage(tt.text, tt.max)
+			assert.Equal(t, tt.want, parts)
+			assert.Equal(t, tt.text, strings.Join(parts, ""))
+		})
+	}
+}
+
+func TestParseChatCommand(t *testing.T) {
+	tests := []struct {
+		text        string
+		wantType    MessageType
+		wantCommand string
+		wantArgs    []string
+	}{
+		{text: "/df /home", wantType: Command, wantCommand: "df", wantArgs: []string{"/home"}},
+		{text: "<@U0BOT> df /home", wantType: Command, wantCommand: "df", wantArgs: []string{"/home"}},
+		{text: "<@U0BOT>  /uptime", wantType: Command, wantCommand: "uptime", wantArgs: []string{}},
+		{text: "<@U0BOT>", wantType: Chat},
+		{text: "hello <@U0BOT> df", wantType: Chat},
+		{text: "<@U0OTHER> df", wantType: Chat},
+		{text: "", wantType: Chat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			typ, command, args := parseChatCommand(tt.text, "<@U0BOT>")
+			assert.Equal(t, tt.wantType, typ)
+			assert.Equal(t, tt.wantCommand, command)
+			assert.Equal(t, tt.wantArgs, args)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GotifySink sends notifications as messages of a Gotify application
+type GotifySink struct {
+	url      string // The server URL, e.g. https://gotify.example.org
+	token    string // The application token
+	priority int
+	client   *http.Client
+}
+
+// NewGotifySink returns a sink posting with an application token
+func NewGotifySink(serverURL, token string, priority int) *GotifySink {
+	return &GotifySink{
+		url:      strings.TrimSuffix(serverURL, "/"),
+		token:    token,
+		priority: priority,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *GotifySink) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"title":    n.Title,
+		"message":  n.Message,
+		"priority": s.priority,
+	})
+	if err != nil {
+		return fmt.Errorf("gotify: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url+"/message", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("gotify: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Not in the query string, where it would end up in access logs
+	req.Header.Set("X-Gotify-Key", s.token)
+	return postSink(ctx, s.client, "gotify", req)
+}
@@ -0,0 +1,38 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGotifySink(t *testing.T) {
+	messages := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/message" || r.Header.Get("X-Gotify-Key") != "app-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"Unauthorized","errorCode":401,"errorDescription":"you need to provide a valid access token"}`))
+			return
+		}
+		var m map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&m)
+		messages <- m
+		_, _ = w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+
+	sink := NewGotifySink(srv.URL+"/", "app-token", 8)
+	require.NoError(t, sink.Notify(context.Background(), Notification{Title: "rpi-bot: backup", Message: "disk full"}))
+	assert.Equal(t, map[string]interface{}{"title": "rpi-bot: backup", "message": "disk full", "priority": float64(8)}, <-messages)
+
+	err := NewGotifySink(srv.URL, "wrong", 0).Notify(context.Background(), Notification{Message: "disk full"})
+	require.ErrorContains(t, err, "gotify: 401 Unauthorized")
+	var status *statusError
+	require.ErrorAs(t, err, &status)
+	assert.False(t, status.temporary())
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package messaging
+
+import "net"
+
+// listenUnix listens on a unix socket, its permissions set by the caller
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package messaging
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUnix listens on a unix socket created without any access for
+// others, rather than with the process umask until changed. The umask is
+// process wide: files created meanwhile get the same restriction.
+func listenUnix(path string) (net.Listener, error) {
+	old := unix.Umask(0o117)
+	defer unix.Umask(old)
+	return net.Listen("unix", path)
+}
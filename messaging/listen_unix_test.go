@@ -0,0 +1,28 @@
+//go:build unix
+
+package messaging
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestListenUnix(t *testing.T) {
+	old := unix.Umask(0)
+	defer unix.Umask(old)
+
+	path := filepath.Join(t.TempDir(), "rpi-bot.sock")
+	ln, err := listenUnix(path)
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), fi.Mode().Perm())
+	assert.Equal(t, 0, unix.Umask(0), "the umask is restored")
+}
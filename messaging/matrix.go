@@ -0,0 +1,284 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// matrixRetryDelay is the wait after a failed sync
+var matrixRetryDelay = 3 * time.Second
+
+// matrixSyncFilter keeps the sync responses down to the room timelines
+const matrixSyncFilter = `{"presence":{"types":[]},"account_data":{"types":[]},"room":{"timeline":{"limit":50}}}`
+
+type matrixReceiver struct {
+	homeserver  string
+	accessToken string
+	rooms       []string // Allowed room IDs, any if empty
+	users       []string // Allowed user IDs, any if empty
+	userID      string   // The bot's own user ID
+	client      *http.Client
+	// pollTimeout is how long a sync waits for new events
+	pollTimeout time.Duration
+	ch          chan Message
+	txnID       atomic.Int64
+	polling     atomic.Bool
+	lastPoll    atomic.Pointer[time.Time]
+}
+
+// matrixError is the error body of the client-server API
+type matrixError struct {
+	ErrCode string `json:"errcode"`
+	Err     string `json:"error"`
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	EventID string `json:"event_id"`
+	Content struct {
+		MsgType string `json:"msgtype"`
+		Body    string `json:"body"`
+	} `json:"content"`
+}
+
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// NewMatrixReceiver checks the access token against the homeserver and
+// returns a client for the bot's account
+func NewMatrixReceiver(homeserver, accessToken string, rooms, users []string) (*matrixReceiver, error) {
+	m := &matrixReceiver{
+		homeserver:  strings.TrimSuffix(homeserver, "/"),
+		accessToken: accessToken,
+		rooms:       rooms,
+		users:       users,
+		client:      &http.Client{},
+		pollTimeout: 30 * time.Second,
+		ch:          make(chan Message, 10),
+	}
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.do(ctx, http.MethodGet, "/account/whoami", nil, nil, &whoami); err != nil {
+		return nil, fmt.Errorf("matrix: %w", err)
+	}
+	m.userID = whoami.UserID
+	return m, nil
+}
+
+// do calls an endpoint of the client-server API, decoding the JSON
+// response into out if not nil
+func (m *matrixReceiver) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	u := m.homeserver + "/_matrix/client/v3" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		var e matrixError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.ErrCode != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, path, e.ErrCode, e.Err)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (m *matrixReceiver) GetUpdates(ctx context.Context) <-chan Message {
+	go m.messageReceiver(ctx)
+	return m.ch
+}
+
+// Connected reports whether the sync loop is reaching the homeserver
+func (m *matrixReceiver) Connected() bool {
+	return m.polling.Load()
+}
+
+// LastActivity returns the time of the last successful sync
+func (m *matrixReceiver) LastActivity() time.Time {
+	if last := m.lastPoll.Load(); last != nil {
+		return *last
+	}
+	return time.Time{}
+}
+
+func (m *matrixReceiver) sync(ctx context.Context, since string, timeout time.Duration) (*matrixSyncResponse, error) {
+	query := url.Values{
+		"timeout": {strconv.FormatInt(timeout.Milliseconds(), 10)},
+		"filter":  {matrixSyncFilter},
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	// The homeserver holds the request for up to timeout
+	ctx, cancel := context.WithTimeout(ctx, timeout+30*time.Second)
+	defer cancel()
+	var resp matrixSyncResponse
+	if err := m.do(ctx, http.MethodGet, "/sync", query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (m *matrixReceiver) messageReceiver(ctx context.Context) {
+	defer close(m.ch)
+	defer m.polling.Store(false)
+	slog.Info("matrix: authorized", "account", m.userID)
+
+	since := ""
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Debug("matrix: context done, returning")
+			return
+		default:
+		}
+
+		// The first sync returns right away: it only marks where to start,
+		// messages sent while the bot was down are not run
+		timeout := m.pollTimeout
+		if since == "" {
+			timeout = 0
+		}
+		resp, err := m.sync(ctx, since, timeout)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.polling.Store(false)
+			slog.Warn("matrix: sync failed, retrying", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(matrixRetryDelay):
+			}
+			continue
+		}
+		now := time.Now()
+		m.lastPoll.Store(&now)
+		m.polling.Store(true)
+
+		for roomID := range resp.Rooms.Invite {
+			m.acceptInvite(ctx, roomID)
+		}
+		if since != "" {
+			for roomID, room := range resp.Rooms.Join {
+				for _, ev := range room.Timeline.Events {
+					if msg, ok := m.parseEvent(roomID, ev); ok {
+						m.ch <- msg
+					}
+				}
+			}
+		}
+		since = resp.NextBatch
+	}
+}
+
+// acceptInvite joins the rooms the bot is invited to, if they are allowed
+func (m *matrixReceiver) acceptInvite(ctx context.Context, roomID string) {
+	if len(m.rooms) == 0 || !slices.Contains(m.rooms, roomID) {
+		slog.Info("matrix: ignoring invite to a room not allowed", "room", roomID)
+		return
+	}
+	if err := m.do(ctx, http.MethodPost, "/rooms/"+url.PathEscape(roomID)+"/join", nil, struct{}{}, nil); err != nil {
+		slog.Warn("matrix: error joining room", "room", roomID, "error", err)
+		return
+	}
+	slog.Info("matrix: joined room", "room", roomID)
+}
+
+// parseEvent returns the message of a timeline event, if it's a text
+// message from an allowed user in an allowed room
+func (m *matrixReceiver) parseEvent(roomID string, ev matrixEvent) (Message, bool) {
+	// Notices are sent by bots, the bot's own replies included
+	if ev.Type != "m.room.message" || ev.Content.MsgType != "m.text" || ev.Sender == m.userID {
+		return Message{}, false
+	}
+	if (len(m.rooms) > 0 && !slices.Contains(m.rooms, roomID)) ||
+		(len(m.users) > 0 && !slices.Contains(m.users, ev.Sender)) {
+		slog.Warn("matrix: ignoring message", "room", roomID, "sender", ev.Sender)
+		return Message{}, false
+	}
+	return parseMatrixMessage(roomID, ev), true
+}
+
+func parseMatrixMessage(roomID string, ev matrixEvent) Message {
+	fields := strings.Fields(ev.Content.Body)
+	message := Message{
+		Type:     Chat,
+		Raw:      ev.Content.Body,
+		Text:     ev.Content.Body,
+		Room:     roomID,
+		Provider: "matrix",
+		User:     ev.Sender,
+	}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+		message.Type = Command
+		message.Command = strings.TrimPrefix(fields[0], "/")
+		message.Args = fields[1:]
+	}
+	return message
+}
+
+// SendMessage posts a notice to the room of replyTo, formatted as a code
+// block so command outputs keep their layout
+func (m *matrixReceiver) SendMessage(message string, replyTo Message) error {
+	content := map[string]string{
+		"msgtype":        "m.notice",
+		"body":           message,
+		"format":         "org.matrix.custom.html",
+		"formatted_body": "<pre><code>" + html.EscapeString(message) + "</code></pre>",
+	}
+	txnID := fmt.Sprintf("rpibot-%d-%d", time.Now().UnixNano(), m.txnID.Add(1))
+	path := "/rooms/" + url.PathEscape(replyTo.Room) + "/send/m.room.message/" + txnID
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return m.do(ctx, http.MethodPut, path, nil, content, nil)
+}
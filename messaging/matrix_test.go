@@ -0,0 +1,171 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMatrixMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantType    MessageType
+		wantCommand string
+		wantArgs    []string
+	}{
+		{name: "command with arguments", body: "/df  /home", wantType: Command, wantCommand: "df", wantArgs: []string{"/home"}},
+		{name: "command", body: "/status", wantType: Command, wantCommand: "status", wantArgs: []string{}},
+		{name: "chat message", body: "hello there", wantType: Chat},
+		{name: "empty", body: "", wantType: Chat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ev matrixEvent
+			ev.Sender = "@alice:example.org"
+			ev.Content.Body = tt.body
+			m := parseMatrixMessage("!ops:example.org", ev)
+			assert.Equal(t, tt.wantType, m.Type)
+			assert.Equal(t, tt.wantCommand, m.Command)
+			assert.Equal(t, tt.wantArgs, m.Args)
+			assert.Equal(t, "!ops:example.org", m.Room)
+			assert.Equal(t, "@alice:example.org", m.User)
+			assert.Equal(t, "matrix", m.Provider)
+			assert.Equal(t, tt.body, m.Raw)
+		})
+	}
+}
+
+// fakeHomeserver serves the parts of the client-server API the receiver
+// uses, one scripted sync response per call
+type fakeHomeserver struct {
+	t     *testing.T
+	mu    sync.Mutex
+	syncs []string // Responses, the last one repeats
+	since []string
+	fail  bool
+	joins []string
+	sent  []map[string]string
+}
+
+func (f *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/_matrix/client/v3")
+	switch {
+	case path == "/account/whoami":
+		fmt.Fprint(w, `{"user_id":"@rpibot:example.org"}`)
+	case path == "/sync":
+		if f.fail {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		f.since = append(f.since, r.FormValue("since"))
+		resp := f.syncs[0]
+		if len(f.syncs) > 1 {
+			f.syncs = f.syncs[1:]
+		} else {
+			// Nothing new: hold the long poll a little
+			time.Sleep(5 * time.Millisecond)
+		}
+		fmt.Fprint(w, resp)
+	case strings.HasSuffix(path, "/join"):
+		f.joins = append(f.joins, r.URL.Path)
+		fmt.Fprint(w, `{}`)
+	case strings.Contains(path, "/send/m.room.message/") && r.Method == http.MethodPut:
+		var content map[string]string
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&content))
+		content["path"] = r.URL.Path
+		f.sent = append(f.sent, content)
+		fmt.Fprint(w, `{"event_id":"$reply"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func matrixTextEvent(sender, body string) string {
+	return fmt.Sprintf(`{"type":"m.room.message","sender":%q,"event_id":"$1","content":{"msgtype":"m.text","body":%q}}`, sender, body)
+}
+
+func TestMatrixReceiver(t *testing.T) {
+	hs := &fakeHomeserver{t: t, syncs: []string{
+		// Initial sync: the backlog is skipped, allowed invites accepted
+		`{"next_batch":"s1","rooms":{"join":{"!ops:example.org":{"timeline":{"events":[` +
+			matrixTextEvent("@alice:example.org", "/reboot") + `]}}},` +
+			`"invite":{"!ops:example.org":{},"!spam:example.org":{}}}}`,
+		`{"next_batch":"s2","rooms":{"join":{` +
+			`"!ops:example.org":{"timeline":{"events":[` +
+			matrixTextEvent("@mallory:example.org", "/reboot") + `,` +
+			`{"type":"m.room.message","sender":"@rpibot:example.org","content":{"msgtype":"m.notice","body":"ok"}},` +
+			`{"type":"m.room.member","sender":"@alice:example.org","content":{}},` +
+			matrixTextEvent("@alice:example.org", "/df /home") + `]}},` +
+			`"!spam:example.org":{"timeline":{"events":[` + matrixTextEvent("@alice:example.org", "/status") + `]}}}}}`,
+		`{"next_batch":"s3"}`,
+	}}
+	srv := httptest.NewServer(hs)
+	defer srv.Close()
+
+	_, err := NewMatrixReceiver(srv.URL, "wrong", nil, nil)
+	require.ErrorContains(t, err, "M_UNKNOWN_TOKEN")
+
+	r, err := NewMatrixReceiver(srv.URL+"/", "secret", []string{"!ops:example.org"}, []string{"@alice:example.org"})
+	require.NoError(t, err)
+	r.pollTimeout = 10 * time.Millisecond
+	require.True(t, r.LastActivity().IsZero())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := r.GetUpdates(ctx)
+
+	m := <-updates
+	assert.Equal(t, Command, m.Type)
+	assert.Equal(t, "df", m.Command)
+	assert.Equal(t, []string{"/home"}, m.Args)
+	assert.Equal(t, "@alice:example.org", m.User)
+	assert.True(t, r.Connected())
+	assert.WithinDuration(t, time.Now(), r.LastActivity(), time.Second)
+
+	require.NoError(t, r.SendMessage("Filesystem  Size\n/dev/sda1 <1G>", m))
+	hs.mu.Lock()
+	assert.Equal(t, []string{"", "s1", "s2"}, hs.since[:3])
+	assert.Equal(t, []string{"/_matrix/client/v3/rooms/!ops:example.org/join"}, hs.joins)
+	require.Len(t, hs.sent, 1)
+	assert.Equal(t, "m.notice", hs.sent[0]["msgtype"])
+	assert.Equal(t, "Filesystem  Size\n/dev/sda1 <1G>", hs.sent[0]["body"])
+	assert.Equal(t, "<pre><code>Filesystem  Size\n/dev/sda1 &lt;1G&gt;</code></pre>", hs.sent[0]["formatted_body"])
+	assert.True(t, strings.HasPrefix(hs.sent[0]["path"], "/_matrix/client/v3/rooms/!ops:example.org/send/m.room.message/"))
+	hs.mu.Unlock()
+
+	// Nothing else got through
+	select {
+	case m := <-updates:
+		t.Fatalf("unexpected message %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	prevRetry := matrixRetryDelay
+	matrixRetryDelay = 10 * time.Millisecond
+	defer func() { matrixRetryDelay = prevRetry }()
+	hs.mu.Lock()
+	hs.fail = true
+	hs.mu.Unlock()
+	require.Eventually(t, func() bool { return !r.Connected() }, time.Second, 5*time.Millisecond)
+
+	cancel()
+	for range updates {
+	}
+}
@@ -0,0 +1,312 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// mattermostRetryDelay is the wait after a failed connection
+var mattermostRetryDelay = 3 * time.Second
+
+// mattermostMaxMessage is the size replies are split at, under the 16383
+// characters of a post
+const mattermostMaxMessage = 16000
+
+type mattermostReceiver struct {
+	serverURL string
+	token     string
+	channels  []string // Allowed channel IDs, any if empty
+	users     []string // Allowed user IDs, any if empty
+	userID    string   // The bot's own user ID
+	username  string
+	client    *http.Client
+	ch        chan Message
+	conn      atomic.Bool
+}
+
+// mattermostEvent is a message of the WebSocket API
+type mattermostEvent struct {
+	Event string `json:"event"`
+	Data  struct {
+		Post string `json:"post"` // JSON encoded
+	} `json:"data"`
+}
+
+type mattermostPost struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	RootID    string `json:"root_id"`
+	Message   string `json:"message"`
+	Type      string `json:"type"` // Empty for user posts
+	Props     struct {
+		FromWebhook string `json:"from_webhook"` // Set for incoming webhook posts
+	} `json:"props"`
+}
+
+// NewMattermostReceiver checks the access token against the server and
+// returns a client for the bot's account. The allowed channels are IDs, or
+// team/channel names resolved here: a name alone is ambiguous, every team
+// can have a channel by that name.
+func NewMattermostReceiver(serverURL, token string, channels, users []string) (*mattermostReceiver, error) {
+	m := &mattermostReceiver{
+		serverURL: strings.TrimSuffix(serverURL, "/"),
+		token:     token,
+		client:    &http.Client{},
+		ch:        make(chan Message, 10),
+	}
+	var me struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := m.do(ctx, http.MethodGet, "/users/me", nil, &me); err != nil {
+		return nil, fmt.Errorf("mattermost: %w", err)
+	}
+	m.userID = me.ID
+	m.username = me.Username
+	ids, err := m.channelIDs(ctx, channels)
+	if err != nil {
+		return nil, fmt.Errorf("mattermost: %w", err)
+	}
+	m.channels = ids
+	if m.users, err = m.userIDs(ctx, users); err != nil {
+		return nil, fmt.Errorf("mattermost: %w", err)
+	}
+	return m, nil
+}
+
+// userIDs returns the IDs of users given as IDs or usernames. Posts are
+// matched by user ID only: the sender name of a webhook or bot post can be
+// overridden with any username.
+func (m *mattermostReceiver) userIDs(ctx context.Context, users []string) ([]string, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	var found []struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	// Usernames not found are left out, those entries are IDs
+	if err := m.do(ctx, http.MethodPost, "/users/usernames", users, &found); err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+	byName := make(map[string]string, len(found))
+	for _, u := range found {
+		byName[u.Username] = u.ID
+	}
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		if id, ok := byName[u]; ok {
+			u = id
+		}
+		ids = append(ids, u)
+	}
+	return ids, nil
+}
+
+// channelIDs returns the IDs of channels given as IDs or team/channel names
+func (m *mattermostReceiver) channelIDs(ctx context.Context, channels []string) ([]string, error) {
+	ids := make([]string, 0, len(channels))
+	for _, c := range channels {
+		team, name, ok := strings.Cut(c, "/")
+		if !ok {
+			ids = append(ids, c)
+			continue
+		}
+		var channel struct {
+			ID string `json:"id"`
+		}
+		path := "/teams/name/" + url.PathEscape(team) + "/channels/name/" + url.PathEscape(name)
+		if err := m.do(ctx, http.MethodGet, path, nil, &channel); err != nil {
+			return nil, fmt.Errorf("channel %s: %w", c, err)
+		}
+		ids = append(ids, channel.ID)
+	}
+	return ids, nil
+}
+
+// do calls an endpoint of the REST API, decoding the JSON response into out
+// if not nil
+func (m *mattermostReceiver) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, m.serverURL+"/api/v4"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return fmt.Errorf("%s %s: %s", method, path, e.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (m *mattermostReceiver) GetUpdates(ctx context.Context) <-chan Message {
+	go m.messageReceiver(ctx)
+	return m.ch
+}
+
+// Connected reports whether the WebSocket connection is up
+func (m *mattermostReceiver) Connected() bool {
+	return m.conn.Load()
+}
+
+func (m *mattermostReceiver) messageReceiver(ctx context.Context) {
+	defer close(m.ch)
+	slog.Info("mattermost: authorized", "account", m.username)
+	for ctx.Err() == nil {
+		err := m.connect(ctx)
+		m.conn.Store(false)
+		if ctx.Err() != nil {
+			break
+		}
+		slog.Warn("mattermost: connection failed, retrying", "error", err)
+		sleepContext(ctx, mattermostRetryDelay)
+	}
+	slog.Debug("mattermost: context done, returning")
+}
+
+// websocketURL returns the URL of the WebSocket API of the server
+func (m *mattermostReceiver) websocketURL() (string, error) {
+	u, err := url.Parse(m.serverURL + "/api/v4/websocket")
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	return u.String(), nil
+}
+
+// connect opens a WebSocket connection and reads its events until it fails
+func (m *mattermostReceiver) connect(ctx context.Context) error {
+	wsURL, err := m.websocketURL()
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Authorization": {"Bearer " + m.token}}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	for {
+		var ev mattermostEvent
+		if err := conn.ReadJSON(&ev); err != nil {
+			return err
+		}
+		switch ev.Event {
+		case "hello":
+			m.conn.Store(true)
+		case "posted":
+			msg, ok := m.parseEvent(ev)
+			if !ok {
+				continue
+			}
+			select {
+			case m.ch <- msg:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// parseEvent returns the message of a posted event, if it's a user post
+// from an allowed user in an allowed channel
+func (m *mattermostReceiver) parseEvent(ev mattermostEvent) (Message, bool) {
+	var post mattermostPost
+	if err := json.Unmarshal([]byte(ev.Data.Post), &post); err != nil {
+		slog.Warn("mattermost: invalid post", "error", err)
+		return Message{}, false
+	}
+	// System messages have a type, joins and leaves included. Incoming
+	// webhooks post as the user who created them, under any name.
+	if post.Type != "" || post.Props.FromWebhook != "" || post.UserID == m.userID {
+		return Message{}, false
+	}
+	if (len(m.channels) > 0 && !slices.Contains(m.channels, post.ChannelID)) ||
+		(len(m.users) > 0 && !slices.Contains(m.users, post.UserID)) {
+		slog.Warn("mattermost: ignoring message", "channel", post.ChannelID, "user", post.UserID)
+		return Message{}, false
+	}
+	return parseMattermostPost(post, m.username), true
+}
+
+func parseMattermostPost(post mattermostPost, botUsername string) Message {
+	m := Message{
+		Raw:      post.Message,
+		Text:     post.Message,
+		Provider: "mattermost",
+		User:     post.UserID,
+		Channel:  post.ChannelID,
+		Thread:   post.RootID,
+	}
+	if m.Thread == "" {
+		m.Thread = post.ID
+	}
+	m.Type, m.Command, m.Args = parseChatCommand(post.Message, "@"+botUsername)
+	return m
+}
+
+// SendMessage posts the output as code blocks in the thread of replyTo,
+// split in as many posts as needed
+func (m *mattermostReceiver) SendMessage(message string, replyTo Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, part := range codeBlocks(message, mattermostMaxMessage) {
+		post := map[string]string{
+			"channel_id": replyTo.Channel,
+			"root_id":    replyTo.Thread,
+			"message":    part,
+		}
+		if err := m.do(ctx, http.MethodPost, "/posts", post, nil); err != nil {
+			return fmt.Errorf("mattermost: %w", err)
+		}
+	}
+	return nil
+}
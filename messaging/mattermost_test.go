@@ -0,0 +1,222 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMattermostPost(t *testing.T) {
+	tests := []struct {
+		name        string
+		post        mattermostPost
+		wantType    MessageType
+		wantCommand string
+		wantArgs    []string
+		wantThread  string
+	}{
+		{
+			name:        "mention",
+			post:        mattermostPost{ID: "p1", Message: "@rpibot df /home"},
+			wantType:    Command,
+			wantCommand: "df",
+			wantArgs:    []string{"/home"},
+			wantThread:  "p1",
+		},
+		{
+			name:        "mention in a thread",
+			post:        mattermostPost{ID: "p2", RootID: "p1", Message: "@rpibot uptime"},
+			wantType:    Command,
+			wantCommand: "uptime",
+			wantArgs:    []string{},
+			wantThread:  "p1",
+		},
+		{
+			name:       "other mention",
+			post:       mattermostPost{ID: "p1", Message: "@rpibot2 df"},
+			wantType:   Chat,
+			wantThread: "p1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.post.UserID = "alice-id"
+			tt.post.ChannelID = "ops-id"
+			m := parseMattermostPost(tt.post, "rpibot")
+			assert.Equal(t, tt.wantType, m.Type)
+			assert.Equal(t, tt.wantCommand, m.Command)
+			assert.Equal(t, tt.wantArgs, m.Args)
+			assert.Equal(t, tt.wantThread, m.Thread)
+			assert.Equal(t, "ops-id", m.Channel)
+			assert.Equal(t, "alice-id", m.User)
+			assert.Equal(t, "mattermost", m.Provider)
+			assert.Equal(t, tt.post.Message, m.Raw)
+		})
+	}
+}
+
+// fakeMattermost serves the REST endpoints the receiver calls and a
+// WebSocket endpoint sending the events written to events. Connections are
+// dropped when an empty event is written.
+type fakeMattermost struct {
+	mu       sync.Mutex
+	connects int
+	events   chan string
+	posts    chan map[string]string
+}
+
+func (f *fakeMattermost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"id":"api.context.session_expired.app_error","message":"Invalid or expired session, please login again."}`)
+		return
+	}
+	switch r.Method + " " + r.URL.Path {
+	case "GET /api/v4/users/me":
+		fmt.Fprint(w, `{"id":"bot-id","username":"rpibot"}`)
+	case "POST /api/v4/users/usernames":
+		var names []string
+		if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		users := []map[string]string{}
+		for _, name := range names {
+			if name == "carol" {
+				users = append(users, map[string]string{"id": "carol-id", "username": "carol"})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(users)
+	case "GET /api/v4/teams/name/infra/channels/name/ops":
+		fmt.Fprint(w, `{"id":"ops-id","name":"ops"}`)
+	case "POST /api/v4/posts":
+		var post map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.posts <- post
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"reply-id"}`)
+	case "GET /api/v4/websocket":
+		f.serveSocket(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeMattermost) serveSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	f.mu.Lock()
+	f.connects++
+	f.mu.Unlock()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"hello","data":{"server_version":"9.11.0"}}`)); err != nil {
+		return
+	}
+	for ev := range f.events {
+		if ev == "" {
+			return
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(ev)); err != nil {
+			return
+		}
+	}
+}
+
+func mattermostPosted(t *testing.T, post mattermostPost, sender, channel string) string {
+	t.Helper()
+	data, err := json.Marshal(post)
+	require.NoError(t, err)
+	ev, err := json.Marshal(map[string]interface{}{
+		"event": "posted",
+		"data": map[string]string{
+			"post":         string(data),
+			"sender_name":  "@" + sender,
+			"channel_name": channel,
+		},
+	})
+	require.NoError(t, err)
+	return string(ev)
+}
+
+func TestMattermostReceiver(t *testing.T) {
+	fake := &fakeMattermost{
+		events: make(chan string, 10),
+		posts:  make(chan map[string]string, 10),
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	mattermostRetryDelay = 10 * time.Millisecond
+
+	_, err := NewMattermostReceiver(srv.URL, "wrong", nil, nil)
+	require.ErrorContains(t, err, "Invalid or expired session")
+
+	_, err = NewMattermostReceiver(srv.URL, "secret", []string{"infra/missing"}, nil)
+	require.ErrorContains(t, err, "channel infra/missing")
+
+	// Allowlists accept IDs or names, team/channel for channels
+	r, err := NewMattermostReceiver(srv.URL+"/", "secret", []string{"infra/ops"}, []string{"alice-id", "carol"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := r.GetUpdates(ctx)
+
+	// Ignored: the bot's own post, a system message, another channel, one
+	// by the same name in another team, another user, one posting as an
+	// allowed username and an incoming webhook
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p1", UserID: "bot-id", ChannelID: "ops-id", Message: "@rpibot reboot"}, "rpibot", "ops")
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p2", UserID: "alice-id", ChannelID: "ops-id", Type: "system_join_channel"}, "alice", "ops")
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p3", UserID: "alice-id", ChannelID: "dev-id", Message: "@rpibot reboot"}, "alice", "dev")
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p8", UserID: "alice-id", ChannelID: "sales-ops-id", Message: "@rpibot reboot"}, "alice", "ops")
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p4", UserID: "bob-id", ChannelID: "ops-id", Message: "@rpibot reboot"}, "bob", "ops")
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p9", UserID: "bob-id", ChannelID: "ops-id", Message: "@rpibot reboot"}, "carol", "ops")
+	hook := mattermostPost{ID: "p10", UserID: "alice-id", ChannelID: "ops-id", Message: "@rpibot reboot"}
+	hook.Props.FromWebhook = "true"
+	fake.events <- mattermostPosted(t, hook, "alice", "ops")
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p5", UserID: "alice-id", ChannelID: "ops-id", Message: "@rpibot df /home"}, "alice", "ops")
+
+	m := <-updates
+	assert.Equal(t, Command, m.Type)
+	assert.Equal(t, "df", m.Command)
+	assert.Equal(t, []string{"/home"}, m.Args)
+	assert.Equal(t, "ops-id", m.Channel)
+	assert.Equal(t, "p5", m.Thread)
+	assert.Equal(t, "alice-id", m.User)
+	assert.True(t, r.Connected())
+
+	require.NoError(t, r.SendMessage("/dev/sda1  10G  4G  40%\n", m))
+	post := <-fake.posts
+	assert.Equal(t, map[string]string{
+		"channel_id": "ops-id",
+		"root_id":    "p5",
+		"message":    "```\n/dev/sda1  10G  4G  40%\n```",
+	}, post)
+
+	// The receiver reconnects when the connection drops
+	fake.events <- ""
+	fake.events <- mattermostPosted(t, mattermostPost{ID: "p7", RootID: "p6", UserID: "carol-id", ChannelID: "ops-id", Message: "@rpibot uptime"}, "carol", "ops")
+	m = <-updates
+	assert.Equal(t, "uptime", m.Command)
+	assert.Equal(t, "p6", m.Thread)
+	fake.mu.Lock()
+	assert.Equal(t, 2, fake.connects)
+	fake.mu.Unlock()
+
+	cancel()
+	for range updates {
+	}
+	assert.False(t, r.Connected())
+}
@@ -0,0 +1,233 @@
+package messaging
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Payloads of the retained status topic
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// mqttTimeout bounds the connection, subscriptions and publications
+const mqttTimeout = 30 * time.Second
+
+// MQTTOptions configures the connection to the broker and the topics
+type MQTTOptions struct {
+	Broker        string // e.g. tcp://localhost:1883 or ssl://broker:8883
+	ClientID      string
+	Username      string
+	Password      string
+	RequestTopic  string // Commands are received here, wildcards allowed
+	ResponseTopic string // Results are published here, or under it where the request says
+	StatusTopic   string // Retained online/offline status
+	QoS           byte
+	TLS           *tls.Config // Used by ssl://, tls:// and wss:// brokers
+}
+
+// mqttRequest is the JSON payload of a command request
+type mqttRequest struct {
+	Command       string   `json:"command"`
+	Args          []string `json:"args"`
+	CorrelationID string   `json:"correlationId"`
+	ResponseTopic string   `json:"responseTopic"`
+}
+
+// mqttResponse is the JSON payload of a command result
+type mqttResponse struct {
+	CorrelationID string `json:"correlationId,omitempty"`
+	Command       string `json:"command,omitempty"`
+	Output        string `json:"output,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+type mqttReceiver struct {
+	opts   MQTTOptions
+	client mqtt.Client
+	ch     chan Message
+	done   chan struct{}
+
+	// Guards closing ch against the message handlers still sending
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewMQTTReceiver connects to the broker, subscribes to the request topic
+// and publishes the online status. The broker publishes the offline status
+// if the bot goes away without disconnecting.
+func NewMQTTReceiver(opts MQTTOptions) (*mqttReceiver, error) {
+	m := &mqttReceiver{
+		opts: opts,
+		ch:   make(chan Message, 10),
+		done: make(chan struct{}),
+	}
+	co := mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetTLSConfig(opts.TLS).
+		// Requests sent while the bot was down are not run when it's back
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout).
+		SetMaxReconnectInterval(time.Minute).
+		SetOrderMatters(false).
+		SetWill(opts.StatusTopic, mqttOffline, opts.QoS, true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("mqtt: connection lost, reconnecting", "error", err)
+		})
+	m.client = mqtt.NewClient(co)
+	if err := mqttWait(m.client.Connect()); err != nil {
+		return nil, fmt.Errorf("mqtt: connecting to %s: %w", opts.Broker, err)
+	}
+	return m, nil
+}
+
+// mqttWait waits for an operation to complete, up to mqttTimeout
+func mqttWait(t mqtt.Token) error {
+	if !t.WaitTimeout(mqttTimeout) {
+		return errors.New("timed out")
+	}
+	return t.Error()
+}
+
+// onConnect runs on every connection: the session is clean, so the request
+// topic is subscribed again after reconnecting
+func (m *mqttReceiver) onConnect(c mqtt.Client) {
+	slog.Info("mqtt: connected", "broker", m.opts.Broker, "topic", m.opts.RequestTopic)
+	go func() {
+		if err := mqttWait(c.Subscribe(m.opts.RequestTopic, m.opts.QoS, m.handle)); err != nil {
+			slog.Error("mqtt: error subscribing", "topic", m.opts.RequestTopic, "error", err)
+		}
+		if err := mqttWait(c.Publish(m.opts.StatusTopic, m.opts.QoS, true, mqttOnline)); err != nil {
+			slog.Warn("mqtt: error publishing status", "topic", m.opts.StatusTopic, "error", err)
+		}
+	}()
+}
+
+func (m *mqttReceiver) GetUpdates(ctx context.Context) <-chan Message {
+	go func() {
+		<-ctx.Done()
+		slog.Debug("mqtt: context done, disconnecting")
+		close(m.done)
+		if m.client.IsConnectionOpen() {
+			if err := mqttWait(m.client.Publish(m.opts.StatusTopic, m.opts.QoS, true, mqttOffline)); err != nil {
+				slog.Warn("mqtt: error publishing status", "topic", m.opts.StatusTopic, "error", err)
+			}
+		}
+		m.client.Disconnect(250)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.closed = true
+		close(m.ch)
+	}()
+	return m.ch
+}
+
+// Connected reports whether the connection to the broker is up
+func (m *mqttReceiver) Connected() bool {
+	return m.client.IsConnectionOpen()
+}
+
+// handle turns a request into a command message. Invalid requests are
+// answered with an error right away.
+func (m *mqttReceiver) handle(_ mqtt.Client, msg mqtt.Message) {
+	message, err := parseMQTTRequest(msg.Topic(), msg.Payload(), m.opts.ResponseTopic)
+	if err != nil {
+		slog.Warn("mqtt: invalid request", "topic", msg.Topic(), "error", err)
+		if err := m.publish(message, mqttResponse{CorrelationID: message.CorrelationID, Error: err.Error()}); err != nil {
+			slog.Error("mqtt: error publishing response", "error", err)
+		}
+		return
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.ch <- message:
+	case <-m.done:
+	}
+}
+
+// parseMQTTRequest decodes a request received on topic. The message is
+// returned with an error too, addressed to where the error should go. The
+// request may only name a response topic under responseTopic, publishers
+// can't have the results sent anywhere else.
+func parseMQTTRequest(topic string, payload []byte, responseTopic string) (Message, error) {
+	message := Message{
+		Type:     Command,
+		Raw:      string(payload),
+		Provider: "mqtt",
+		User:     topic,
+	}
+	var req mqttRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return message, fmt.Errorf("invalid JSON: %w", err)
+	}
+	message.CorrelationID = req.CorrelationID
+	if req.ResponseTopic != "" {
+		sub, ok := strings.CutPrefix(req.ResponseTopic, responseTopic+"/")
+		if !ok || sub == "" || strings.ContainsAny(sub, "+#") {
+			return message, fmt.Errorf("responseTopic must be a topic under %s/", responseTopic)
+		}
+		message.Topic = req.ResponseTopic
+	}
+	if req.Command == "" {
+		return message, errors.New("command is required")
+	}
+	message.Command = req.Command
+	// Commands are split on spaces, an arg with some would add args
+	for i, arg := range req.Args {
+		if strings.ContainsFunc(arg, unicode.IsSpace) {
+			return message, fmt.Errorf("args[%d] must not contain whitespace", i)
+		}
+	}
+	message.Args = req.Args
+	if message.Args == nil {
+		message.Args = []string{}
+	}
+	return message, nil
+}
+
+// SendMessage publishes the result to the response topic of replyTo, or
+// the configured one, with the correlation ID of the request
+func (m *mqttReceiver) SendMessage(message string, replyTo Message) error {
+	return m.publish(replyTo, mqttResponse{
+		CorrelationID: replyTo.CorrelationID,
+		Command:       replyTo.Command,
+		Output:        message,
+	})
+}
+
+func (m *mqttReceiver) publish(replyTo Message, resp mqttResponse) error {
+	topic := replyTo.Topic
+	if topic == "" {
+		topic = m.opts.ResponseTopic
+	}
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	if err := mqttWait(m.client.Publish(topic, m.opts.QoS, false, payload)); err != nil {
+		return fmt.Errorf("mqtt: publishing to %s: %w", topic, err)
+	}
+	return nil
+}
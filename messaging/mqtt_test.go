@@ -0,0 +1,454 @@
+package messaging
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMQTTRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    Message
+		wantErr string
+	}{
+		{
+			name:    "command",
+			payload: `{"command":"df","args":["/home"],"correlationId":"42"}`,
+			want:    Message{Type: Command, Command: "df", Args: []string{"/home"}, CorrelationID: "42"},
+		},
+		{
+			name:    "response topic",
+			payload: `{"command":"uptime","responseTopic":"rpi-bot/response/ha"}`,
+			want:    Message{Type: Command, Command: "uptime", Args: []string{}, Topic: "rpi-bot/response/ha"},
+		},
+		{
+			name:    "response topic elsewhere",
+			payload: `{"command":"uptime","correlationId":"44","responseTopic":"home/lights/set"}`,
+			want:    Message{Type: Command, CorrelationID: "44"},
+			wantErr: "responseTopic must be a topic under rpi-bot/response/",
+		},
+		{
+			name:    "response topic wildcard",
+			payload: `{"command":"uptime","responseTopic":"rpi-bot/response/#"}`,
+			want:    Message{Type: Command},
+			wantErr: "responseTopic must be a topic under rpi-bot/response/",
+		},
+		{
+			name:    "arg with whitespace",
+			payload: `{"command":"ping","args":["8.8.8.8 -f"],"correlationId":"45"}`,
+			want:    Message{Type: Command, Command: "ping", CorrelationID: "45"},
+			wantErr: "args[0] must not contain whitespace",
+		},
+		{
+			name:    "missing command",
+			payload: `{"correlationId":"43"}`,
+			want:    Message{Type: Command, CorrelationID: "43"},
+			wantErr: "command is required",
+		},
+		{
+			name:    "invalid JSON",
+			payload: `/df`,
+			want:    Message{Type: Command},
+			wantErr: "invalid JSON",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseMQTTRequest("rpi-bot/request", []byte(tt.payload), "rpi-bot/response")
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			tt.want.Raw = tt.payload
+			tt.want.Provider = "mqtt"
+			tt.want.User = "rpi-bot/request"
+			assert.Equal(t, tt.want, m)
+		})
+	}
+}
+
+// MQTT 3.1.1 packet types
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+type brokerMessage struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// fakeBroker is a minimal MQTT 3.1.1 broker: QoS 0 and 1, retained
+// messages, last will and password authentication. Every publication,
+// wills included, is sent to published.
+type fakeBroker struct {
+	t         *testing.T
+	ln        net.Listener
+	published chan brokerMessage
+
+	mu       sync.Mutex
+	retained map[string]string
+	clients  map[*brokerClient]bool
+}
+
+type brokerClient struct {
+	conn   net.Conn
+	mu     sync.Mutex // Serializes writes
+	topics []string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	b := &fakeBroker{
+		t:         t,
+		ln:        ln,
+		published: make(chan brokerMessage, 100),
+		retained:  map[string]string{},
+		clients:   map[*brokerClient]bool{},
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&brokerClient{conn: conn})
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) url() string { return "tcp://" + b.ln.Addr().String() }
+
+// dropClients closes every connection without a DISCONNECT, as a network
+// failure would
+func (b *fakeBroker) dropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		_ = c.conn.Close()
+	}
+}
+
+// next returns the next publication on topic, skipping the others
+func (b *fakeBroker) next(topic string) brokerMessage {
+	b.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-b.published:
+			if m.topic == topic {
+				return m
+			}
+		case <-timeout:
+			b.t.Fatalf("nothing published on %s", topic)
+		}
+	}
+}
+
+func (b *fakeBroker) serve(c *brokerClient) {
+	r := bufio.NewReader(c.conn)
+	var will *brokerMessage
+	defer func() {
+		_ = c.conn.Close()
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		if will != nil {
+			b.publish(*will)
+		}
+	}()
+	for {
+		typ, flags, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case pktConnect:
+			w, ok := b.connect(body)
+			if !ok {
+				c.write(pktConnack, 0, []byte{0, 5}) // Not authorized
+				return
+			}
+			will = w
+			b.mu.Lock()
+			b.clients[c] = true
+			b.mu.Unlock()
+			c.write(pktConnack, 0, []byte{0, 0})
+		case pktSubscribe:
+			pid, rest := body[:2], body[2:]
+			var granted []byte
+			for len(rest) > 0 {
+				topic := readString(&rest)
+				granted = append(granted, min(rest[0], 1))
+				rest = rest[1:]
+				b.mu.Lock()
+				c.topics = append(c.topics, topic)
+				var retained []brokerMessage
+				for t, p := range b.retained {
+					if topicMatches(topic, t) {
+						retained = append(retained, brokerMessage{topic: t, payload: p, retain: true})
+					}
+				}
+				b.mu.Unlock()
+				for _, m := range retained {
+					c.deliver(m)
+				}
+			}
+			c.write(pktSuback, 0, append(pid, granted...))
+		case pktUnsubscribe:
+			c.write(pktUnsuback, 0, body[:2])
+		case pktPublish:
+			topic := readString(&body)
+			if qos := flags >> 1 & 3; qos > 0 {
+				c.write(pktPuback, 0, body[:2])
+				body = body[2:]
+			}
+			b.publish(brokerMessage{topic: topic, payload: string(body), retain: flags&1 == 1})
+		case pktPingreq:
+			c.write(pktPingresp, 0, nil)
+		case pktDisconnect:
+			will = nil
+			return
+		}
+	}
+}
+
+// connect checks the credentials of a CONNECT packet and returns its will
+func (b *fakeBroker) connect(body []byte) (*brokerMessage, bool) {
+	readString(&body) // Protocol name
+	flags := body[1]
+	body = body[4:] // Level, flags and keep alive
+	readString(&body)
+	var will *brokerMessage
+	if flags&0x04 != 0 {
+		will = &brokerMessage{topic: readString(&body), payload: readString(&body), retain: flags&0x20 != 0}
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		username = readString(&body)
+	}
+	if flags&0x40 != 0 {
+		password = readString(&body)
+	}
+	return will, username == "bot" && password == "secret"
+}
+
+// publish routes a message to the matching subscriptions
+func (b *fakeBroker) publish(m brokerMessage) {
+	b.published <- m
+	b.mu.Lock()
+	if m.retain {
+		b.retained[m.topic] = m.payload
+	}
+	var subscribers []*brokerClient
+	for c := range b.clients {
+		for _, filter := range c.topics {
+			if topicMatches(filter, m.topic) {
+				subscribers = append(subscribers, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	m.retain = false
+	for _, c := range subscribers {
+		c.deliver(m)
+	}
+}
+
+func (c *brokerClient) deliver(m brokerMessage) {
+	var flags byte
+	if m.retain {
+		flags = 1
+	}
+	c.write(pktPublish, flags, append(encodeString(m.topic), m.payload...))
+}
+
+func (c *brokerClient) write(typ, flags byte, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pkt := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		pkt = append(pkt, digit)
+		if n == 0 {
+			break
+		}
+	}
+	_, _ = c.conn.Write(append(pkt, body...))
+}
+
+func readPacket(r *bufio.Reader) (typ, flags byte, body []byte, err error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, shift := 0, 0
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, 0, nil, errors.New("malformed length")
+		}
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header >> 4, header & 0x0f, body, err
+}
+
+func readString(b *[]byte) string {
+	n := int(binary.BigEndian.Uint16(*b))
+	s := string((*b)[2 : 2+n])
+	*b = (*b)[2+n:]
+	return s
+}
+
+func encodeString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// topicMatches matches a topic against a filter with + and # wildcards
+func topicMatches(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func testMQTTOptions(broker string) MQTTOptions {
+	return MQTTOptions{
+		Broker:        broker,
+		ClientID:      "rpi-bot-test",
+		Username:      "bot",
+		Password:      "secret",
+		RequestTopic:  "rpi-bot/request/+",
+		ResponseTopic: "rpi-bot/response",
+		StatusTopic:   "rpi-bot/status",
+		QoS:           1,
+	}
+}
+
+func mqttRequestPayload(t *testing.T, req mqttRequest) string {
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestMQTTReceiver(t *testing.T) {
+	broker := newFakeBroker(t)
+
+	opts := testMQTTOptions(broker.url())
+	opts.Password = "wrong"
+	_, err := NewMQTTReceiver(opts)
+	require.ErrorContains(t, err, "not Authorized")
+
+	r, err := NewMQTTReceiver(testMQTTOptions(broker.url()))
+	require.NoError(t, err)
+	status := broker.next("rpi-bot/status")
+	assert.Equal(t, brokerMessage{topic: "rpi-bot/status", payload: "online", retain: true}, status)
+	assert.True(t, r.Connected())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := r.GetUpdates(ctx)
+
+	broker.publish(brokerMessage{
+		topic:   "rpi-bot/request/kitchen",
+		payload: mqttRequestPayload(t, mqttRequest{Command: "df", Args: []string{"/home"}, CorrelationID: "42"}),
+	})
+	m := <-updates
+	assert.Equal(t, Command, m.Type)
+	assert.Equal(t, "df", m.Command)
+	assert.Equal(t, []string{"/home"}, m.Args)
+	assert.Equal(t, "42", m.CorrelationID)
+	assert.Equal(t, "rpi-bot/request/kitchen", m.User)
+	assert.Equal(t, "mqtt", m.Provider)
+
+	require.NoError(t, r.SendMessage("/dev/sda1 10G", m))
+	resp := broker.next("rpi-bot/response")
+	assert.JSONEq(t, `{"correlationId":"42","command":"df","output":"/dev/sda1 10G"}`, resp.payload)
+	assert.False(t, resp.retain)
+
+	// The request can name where the result goes, under the response topic
+	broker.publish(brokerMessage{
+		topic:   "rpi-bot/request/ha",
+		payload: mqttRequestPayload(t, mqttRequest{Command: "uptime", ResponseTopic: "rpi-bot/response/ha"}),
+	})
+	m = <-updates
+	require.NoError(t, r.SendMessage("up 3 days", m))
+	resp = broker.next("rpi-bot/response/ha")
+	assert.JSONEq(t, `{"command":"uptime","output":"up 3 days"}`, resp.payload)
+
+	// Invalid requests are answered without reaching the dispatcher
+	broker.publish(brokerMessage{topic: "rpi-bot/request/ha", payload: `{"correlationId":"43"}`})
+	resp = broker.next("rpi-bot/response")
+	assert.JSONEq(t, `{"correlationId":"43","error":"command is required"}`, resp.payload)
+
+	// The broker publishes the will when the connection is lost, and the
+	// subscription is restored after reconnecting
+	broker.dropClients()
+	status = broker.next("rpi-bot/status")
+	assert.Equal(t, "offline", status.payload)
+	assert.True(t, status.retain)
+	status = broker.next("rpi-bot/status")
+	assert.Equal(t, "online", status.payload)
+	assert.Eventually(t, r.Connected, 5*time.Second, 10*time.Millisecond)
+	broker.publish(brokerMessage{
+		topic:   "rpi-bot/request/kitchen",
+		payload: mqttRequestPayload(t, mqttRequest{Command: "hostname"}),
+	})
+	m = <-updates
+	assert.Equal(t, "hostname", m.Command)
+
+	// Shutting down publishes the offline status before disconnecting
+	cancel()
+	for range updates {
+	}
+	status = broker.next("rpi-bot/status")
+	assert.Equal(t, brokerMessage{topic: "rpi-bot/status", payload: "offline", retain: true}, status)
+	assert.False(t, r.Connected())
+}
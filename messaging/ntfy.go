@@ -0,0 +1,51 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NtfySink publishes notifications to a topic of an ntfy server
+type NtfySink struct {
+	url      string // The topic URL, e.g. https://ntfy.sh/rpi-alerts
+	token    string // Access token, for protected topics
+	priority int    // 1 (min) to 5 (max), the server default if 0
+	tags     []string
+	client   *http.Client
+}
+
+// NewNtfySink returns a sink publishing to the topic at topicURL
+func NewNtfySink(topicURL, token string, priority int, tags []string) *NtfySink {
+	return &NtfySink{
+		url:      topicURL,
+		token:    token,
+		priority: priority,
+		tags:     tags,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *NtfySink) Notify(ctx context.Context, n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, strings.NewReader(n.Message))
+	if err != nil {
+		return fmt.Errorf("ntfy: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if n.Title != "" {
+		req.Header.Set("Title", n.Title)
+	}
+	if s.priority != 0 {
+		req.Header.Set("Priority", strconv.Itoa(s.priority))
+	}
+	if len(s.tags) > 0 {
+		req.Header.Set("Tags", strings.Join(s.tags, ","))
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return postSink(ctx, s.client, "ntfy", req)
+}
@@ -0,0 +1,44 @@
+package messaging
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNtfySink(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+		_, _ = io.WriteString(w, `{"id":"abc","event":"message"}`)
+	}))
+	defer srv.Close()
+
+	sink := NewNtfySink(srv.URL+"/rpi-alerts", "tk_secret", 4, []string{"warning", "pi"})
+	require.NoError(t, sink.Notify(context.Background(), Notification{Title: "rpi-bot: backup", Message: "disk full"}))
+	r := <-requests
+	assert.Equal(t, http.MethodPost, r.Method)
+	assert.Equal(t, "/rpi-alerts", r.URL.Path)
+	assert.Equal(t, "rpi-bot: backup", r.Header.Get("Title"))
+	assert.Equal(t, "4", r.Header.Get("Priority"))
+	assert.Equal(t, "warning,pi", r.Header.Get("Tags"))
+	assert.Equal(t, "Bearer tk_secret", r.Header.Get("Authorization"))
+	assert.Equal(t, "disk full", <-bodies)
+
+	// Optional headers are left to the server defaults
+	sink = NewNtfySink(srv.URL+"/rpi-alerts", "", 0, nil)
+	require.NoError(t, sink.Notify(context.Background(), Notification{Message: "disk full"}))
+	r = <-requests
+	<-bodies
+	for _, h := range []string{"Title", "Priority", "Tags", "Authorization"} {
+		assert.Empty(t, r.Header.Get(h), h)
+	}
+}
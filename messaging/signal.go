@@ -6,11 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type rpcMessage struct {
@@ -95,6 +96,7 @@ type signalReceiver struct {
 	conn    net.Conn
 	nextID  int
 	mu      sync.Mutex // protects enc.Encode
+	up      atomic.Bool
 }
 
 func NewSignalReceiver(socketPath string, sources []string) (*signalReceiver, error) {
@@ -111,6 +113,7 @@ func NewSignalReceiver(socketPath string, sources []string) (*signalReceiver, er
 		sources: sources,
 		nextID:  1,
 	}
+	r.up.Store(true)
 	return r, nil
 }
 
@@ -139,11 +142,14 @@ func parseMessage(msg *rpcMessage, sources []string) (Message, error) {
 		command = strings.TrimPrefix(command, "/")
 	}
 	message = Message{
-		Type:    messageType,
-		Raw:     string(*msg.Params),
-		Command: command,
-		Source:  recvParams.Envelope.SourceNumber,
-		Args:    commands[1:],
+		Type:     messageType,
+		Raw:      string(*msg.Params),
+		Text:     recvParams.Envelope.SyncMessage.SentMessage.Message,
+		Command:  command,
+		Source:   recvParams.Envelope.SourceNumber,
+		Args:     commands[1:],
+		Provider: "signal",
+		User:     recvParams.Envelope.SourceNumber,
 	}
 	return message, nil
 }
@@ -159,13 +165,20 @@ func parseResponse(msg *rpcMessage) (Message, error) {
 	return message, nil
 
 }
+
+// Connected reports whether the signal-cli socket is still open
+func (s *signalReceiver) Connected() bool {
+	return s.up.Load()
+}
+
 func (s *signalReceiver) messageReceiver(ctx context.Context) {
+	defer s.up.Store(false)
 	go func() {
 		<-ctx.Done()
-		log.Println("messageReceiver: context done, closing connection")
+		slog.Debug("signal: context done, closing connection")
 		err := s.conn.Close()
 		if err != nil {
-			log.Println(err)
+			slog.Warn("signal: error closing connection", "error", err)
 		}
 
 	}()
@@ -174,25 +187,25 @@ func (s *signalReceiver) messageReceiver(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("messageReceiver: context done, exiting loop")
+			slog.Debug("signal: context done, exiting loop")
 			return
 		default:
 		}
 		var msg rpcMessage
 		if err := s.dec.Decode(&msg); err != nil {
 			if errors.Is(err, io.EOF) {
-				log.Println("messageReceiver: socket closed (EOF), exiting")
+				slog.Warn("signal: socket closed (EOF), exiting")
 				return
 			}
 			if errors.Is(err, net.ErrClosed) {
-				log.Printf("messageReceiver: connection closed (net.ErrClosed), exiting")
+				slog.Info("signal: connection closed, exiting")
 				return
 			}
 		}
 
 		// RPC-level error
 		if msg.Error != nil {
-			log.Printf("messageReceiver: RPC error (id=%v): %s", msg.ID, msg.Error.Message)
+			slog.Error("signal: RPC error", "id", msg.ID, "error", msg.Error.Message)
 			continue
 		}
 
@@ -200,7 +213,7 @@ func (s *signalReceiver) messageReceiver(ctx context.Context) {
 		if msg.Params != nil && msg.Method == "receive" {
 			m, err := parseMessage(&msg, s.sources)
 			if err != nil {
-				log.Println(err)
+				slog.Warn("signal: ignoring message", "error", err)
 				continue
 			}
 			s.ch <- m
@@ -211,7 +224,7 @@ func (s *signalReceiver) messageReceiver(ctx context.Context) {
 		if msg.Result != nil {
 			m, err := parseResponse(&msg)
 			if err != nil {
-				log.Println(err)
+				slog.Warn("signal: ignoring message", "error", err)
 				continue
 			}
 			s.ch <- m
@@ -219,7 +232,7 @@ func (s *signalReceiver) messageReceiver(ctx context.Context) {
 		}
 
 		// Everything else
-		log.Printf("messageReceiver: unrecognized message: %+v", msg)
+		slog.Debug("signal: unrecognized message", "method", msg.Method, "id", msg.ID)
 	}
 }
 
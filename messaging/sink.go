@@ -0,0 +1,154 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// Notification is a message pushed to a notification sink
+type Notification struct {
+	Title   string
+	Message string
+}
+
+// NotificationSink delivers notifications to a push service. Unlike a
+// MessageSender, it has no conversation to reply in and needs no provider.
+type NotificationSink interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// statusError is a response of a push service other than a success
+type statusError struct {
+	service string
+	status  int
+	body    string
+}
+
+func (e *statusError) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("%s: %d %s", e.service, e.status, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("%s: %d %s: %s", e.service, e.status, http.StatusText(e.status), e.body)
+}
+
+// temporary reports whether the request may succeed when retried. Other
+// client errors, like a wrong token, won't.
+func (e *statusError) temporary() bool {
+	return e.status >= 500 || e.status == http.StatusTooManyRequests || e.status == http.StatusRequestTimeout
+}
+
+// postSink sends a request to a push service, returning a statusError if
+// it isn't accepted
+func postSink(ctx context.Context, client *http.Client, service string, req *http.Request) error {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("%s: %w", service, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{service: service, status: resp.StatusCode, body: string(bytes.TrimSpace(body))}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// RetrySink retries the notifications a sink fails to deliver, waiting
+// Backoff, then twice as long after every attempt
+type RetrySink struct {
+	Sink     NotificationSink
+	Attempts int // At least 1
+	Backoff  time.Duration
+}
+
+func (r RetrySink) Notify(ctx context.Context, n Notification) error {
+	backoff := r.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = r.Sink.Notify(ctx, n); err == nil {
+			return nil
+		}
+		var status *statusError
+		if attempt >= r.Attempts || (errors.As(err, &status) && !status.temporary()) {
+			return err
+		}
+		slog.Warn("notification failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// DefaultWebhookBody is the JSON body of webhook notifications without a
+// template
+const DefaultWebhookBody = `{"title":{{json .Title}},"message":{{json .Message}}}`
+
+// WebhookSink posts notifications to any HTTP endpoint, the body rendered
+// from a template
+type WebhookSink struct {
+	url     string
+	method  string
+	headers map[string]string
+	body    *template.Template
+	client  *http.Client
+}
+
+// ParseWebhookBody parses a body template. The notification fields are
+// .Title and .Message, and `json` quotes a value as a JSON string.
+func ParseWebhookBody(text string) (*template.Template, error) {
+	return template.New("body").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Option("missingkey=error").Parse(text)
+}
+
+// NewWebhookSink returns a sink sending the body to url, with the JSON
+// content type unless set in headers
+func NewWebhookSink(url, method string, headers map[string]string, body string) (*WebhookSink, error) {
+	if body == "" {
+		body = DefaultWebhookBody
+	}
+	tmpl, err := ParseWebhookBody(body)
+	if err != nil {
+		return nil, fmt.Errorf("webhook: %w", err)
+	}
+	if method == "" {
+		method = http.MethodPost
+	}
+	return &WebhookSink{
+		url:     url,
+		method:  method,
+		headers: headers,
+		body:    tmpl,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *WebhookSink) Notify(ctx context.Context, n Notification) error {
+	var body bytes.Buffer
+	if err := s.body.Execute(&body, n); err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	req, err := http.NewRequest(s.method, s.url, &body)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	return postSink(ctx, s.client, "webhook", req)
+}
@@ -0,0 +1,118 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingSink fails with the errors in errs, in order, then succeeds
+type failingSink struct {
+	errs  []error
+	calls int
+}
+
+func (s *failingSink) Notify(context.Context, Notification) error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func TestRetrySink(t *testing.T) {
+	unavailable := &statusError{service: "ntfy", status: http.StatusServiceUnavailable}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   string
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "retried", errs: []error{errors.New("connection refused"), unavailable}, wantCalls: 3},
+		{name: "attempts exhausted", errs: []error{unavailable, unavailable, unavailable}, wantCalls: 3, wantErr: "503 Service Unavailable"},
+		{
+			name:      "permanent error",
+			errs:      []error{&statusError{service: "ntfy", status: http.StatusForbidden, body: "forbidden"}},
+			wantCalls: 1,
+			wantErr:   "ntfy: 403 Forbidden: forbidden",
+		},
+		{
+			name:      "rate limited",
+			errs:      []error{&statusError{service: "ntfy", status: http.StatusTooManyRequests}},
+			wantCalls: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &failingSink{errs: tt.errs}
+			err := RetrySink{Sink: sink, Attempts: 3, Backoff: time.Millisecond}.Notify(context.Background(), Notification{Message: "disk full"})
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantCalls, sink.calls)
+		})
+	}
+
+	// The backoff is cut short when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sink := &failingSink{errs: []error{unavailable}}
+	err := RetrySink{Sink: sink, Attempts: 3, Backoff: time.Hour}.Notify(ctx, Notification{})
+	require.ErrorIs(t, err, unavailable)
+	assert.Equal(t, 1, sink.calls)
+}
+
+func TestWebhookSink(t *testing.T) {
+	type request struct {
+		method, contentType, auth, body string
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Method, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), string(body)}
+	}))
+	defer srv.Close()
+	n := Notification{Title: "backup", Message: "done in 3\"\n"}
+
+	sink, err := NewWebhookSink(srv.URL, "", nil, "")
+	require.NoError(t, err)
+	require.NoError(t, sink.Notify(context.Background(), n))
+	assert.Equal(t, request{http.MethodPost, "application/json", "", `{"title":"backup","message":"done in 3\"\n"}`}, <-requests)
+
+	sink, err = NewWebhookSink(srv.URL, http.MethodPut, map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"}, "{{.Title}}: {{.Message}}")
+	require.NoError(t, err)
+	require.NoError(t, sink.Notify(context.Background(), n))
+	assert.Equal(t, request{http.MethodPut, "text/plain", "Bearer secret", "backup: done in 3\"\n"}, <-requests)
+
+	_, err = NewWebhookSink(srv.URL, "", nil, "{{.Title")
+	require.ErrorContains(t, err, "webhook: template")
+	sink, err = NewWebhookSink(srv.URL, "", nil, "{{.Host}}")
+	require.NoError(t, err)
+	require.ErrorContains(t, sink.Notify(context.Background(), n), "can't evaluate field Host")
+}
+
+func TestWebhookSink_Status(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such hook", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	sink, err := NewWebhookSink(srv.URL, "", nil, "")
+	require.NoError(t, err)
+	err = sink.Notify(context.Background(), Notification{Message: "done"})
+	var status *statusError
+	require.ErrorAs(t, err, &status)
+	assert.False(t, status.temporary())
+	assert.EqualError(t, err, "webhook: 404 Not Found: no such hook")
+}
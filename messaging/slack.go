@@ -0,0 +1,291 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// slackRetryDelay is the wait after a failed connection
+var slackRetryDelay = 3 * time.Second
+
+// slackMaxMessage is the size replies are split at, under the 4000
+// characters Slack recommends
+const slackMaxMessage = 3900
+
+// slackEnvelope is a Socket Mode message
+type slackEnvelope struct {
+	Type       string          `json:"type"`
+	EnvelopeID string          `json:"envelope_id"`
+	Reason     string          `json:"reason"` // Of a disconnect
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type slackEvent struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	BotID    string `json:"bot_id"`
+	Text     string `json:"text"`
+	Channel  string `json:"channel"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// slackSlashCommand is the payload of a registered slash command, e.g.
+// "/rpi df /home"
+type slackSlashCommand struct {
+	Text      string `json:"text"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+type slackReceiver struct {
+	apiURL   string // https://slack.com/api
+	appToken string // xapp-, opens Socket Mode connections
+	botToken string // xoxb-, calls the Web API
+	channels []string
+	users    []string
+	userID   string // The bot's own user ID
+	client   *http.Client
+	ch       chan Message
+	conn     atomic.Bool
+}
+
+// NewSlackReceiver checks the bot token and returns a client receiving the
+// events of the app over Socket Mode
+func NewSlackReceiver(apiURL, appToken, botToken string, channels, users []string) (*slackReceiver, error) {
+	s := &slackReceiver{
+		apiURL:   strings.TrimSuffix(apiURL, "/"),
+		appToken: appToken,
+		botToken: botToken,
+		channels: channels,
+		users:    users,
+		client:   &http.Client{},
+		ch:       make(chan Message, 10),
+	}
+	var auth struct {
+		UserID string `json:"user_id"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.call(ctx, botToken, "auth.test", nil, &auth); err != nil {
+		return nil, fmt.Errorf("slack: %w", err)
+	}
+	s.userID = auth.UserID
+	return s, nil
+}
+
+// call invokes a Web API method, decoding the response into out if not nil
+func (s *slackReceiver) call(ctx context.Context, token, method string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.apiURL+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, resp.Status)
+	}
+	raw := json.RawMessage{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	// Errors are reported in the body, with a 200
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	if !result.OK {
+		return fmt.Errorf("%s: %s", method, result.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func (s *slackReceiver) GetUpdates(ctx context.Context) <-chan Message {
+	go s.messageReceiver(ctx)
+	return s.ch
+}
+
+// Connected reports whether the Socket Mode connection is up
+func (s *slackReceiver) Connected() bool {
+	return s.conn.Load()
+}
+
+func (s *slackReceiver) messageReceiver(ctx context.Context) {
+	defer close(s.ch)
+	slog.Info("slack: authorized", "account", s.userID)
+	for ctx.Err() == nil {
+		err := s.connect(ctx)
+		s.conn.Store(false)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			slog.Warn("slack: connection failed, retrying", "error", err)
+			sleepContext(ctx, slackRetryDelay)
+		}
+	}
+	slog.Debug("slack: context done, returning")
+}
+
+// connect opens a Socket Mode connection and reads it until it fails or
+// Slack asks to reconnect, which returns a nil error
+func (s *slackReceiver) connect(ctx context.Context) error {
+	var open struct {
+		URL string `json:"url"`
+	}
+	if err := s.call(ctx, s.appToken, "apps.connections.open", nil, &open); err != nil {
+		return err
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, open.URL, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	for {
+		var env slackEnvelope
+		if err := conn.ReadJSON(&env); err != nil {
+			return err
+		}
+		if env.EnvelopeID != "" {
+			// Unacknowledged events are sent again
+			if err := conn.WriteJSON(map[string]string{"envelope_id": env.EnvelopeID}); err != nil {
+				return err
+			}
+		}
+		switch env.Type {
+		case "hello":
+			s.conn.Store(true)
+		case "disconnect":
+			slog.Debug("slack: reconnecting", "reason", env.Reason)
+			return nil
+		case "events_api", "slash_commands":
+			m, ok := s.parseEnvelope(env)
+			if !ok {
+				continue
+			}
+			select {
+			case s.ch <- m:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// parseEnvelope returns the message of an event or slash command, if it
+// comes from an allowed user in an allowed channel
+func (s *slackReceiver) parseEnvelope(env slackEnvelope) (Message, bool) {
+	var m Message
+	if env.Type == "slash_commands" {
+		var cmd slackSlashCommand
+		if err := json.Unmarshal(env.Payload, &cmd); err != nil {
+			slog.Warn("slack: invalid slash command", "error", err)
+			return Message{}, false
+		}
+		m = parseSlackSlashCommand(cmd)
+	} else {
+		var payload struct {
+			Event slackEvent `json:"event"`
+		}
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			slog.Warn("slack: invalid event", "error", err)
+			return Message{}, false
+		}
+		ev := payload.Event
+		// Edits, joins and the bot's own replies have a subtype or bot ID
+		if ev.Type != "message" || ev.Subtype != "" || ev.BotID != "" || ev.User == s.userID {
+			return Message{}, false
+		}
+		m = parseSlackMessage(ev, s.userID)
+	}
+	if (len(s.channels) > 0 && !slices.Contains(s.channels, m.Channel)) ||
+		(len(s.users) > 0 && !slices.Contains(s.users, m.User)) {
+		slog.Warn("slack: ignoring message", "channel", m.Channel, "user", m.User)
+		return Message{}, false
+	}
+	return m, true
+}
+
+// parseSlackSlashCommand parses the text of a slash command. The command
+// registered in the app is only the entry point: "/rpi df /home" runs df.
+func parseSlackSlashCommand(cmd slackSlashCommand) Message {
+	m := Message{
+		Type:     Chat,
+		Raw:      cmd.Text,
+		Text:     cmd.Text,
+		Provider: "slack",
+		User:     cmd.UserID,
+		Channel:  cmd.ChannelID,
+	}
+	if fields := strings.Fields(cmd.Text); len(fields) > 0 {
+		m.Type = Command
+		m.Command = strings.TrimPrefix(fields[0], "/")
+		m.Args = fields[1:]
+	}
+	return m
+}
+
+func parseSlackMessage(ev slackEvent, botID string) Message {
+	m := Message{
+		Raw:      ev.Text,
+		Text:     ev.Text,
+		Provider: "slack",
+		User:     ev.User,
+		Channel:  ev.Channel,
+		Thread:   ev.ThreadTS,
+	}
+	if m.Thread == "" {
+		m.Thread = ev.TS
+	}
+	m.Type, m.Command, m.Args = parseChatCommand(ev.Text, "<@"+botID+">")
+	return m
+}
+
+// SendMessage posts the output as code blocks in the thread of replyTo,
+// split in as many messages as needed
+func (s *slackReceiver) SendMessage(message string, replyTo Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, part := range codeBlocks(message, slackMaxMessage) {
+		body := map[string]string{
+			"channel": replyTo.Channel,
+			"text":    part,
+		}
+		if replyTo.Thread != "" {
+			body["thread_ts"] = replyTo.Thread
+		}
+		if err := s.call(ctx, s.botToken, "chat.postMessage", body, nil); err != nil {
+			return fmt.Errorf("slack: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSlackMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		ev          slackEvent
+		wantType    MessageType
+		wantCommand string
+		wantArgs    []string
+		wantThread  string
+	}{
+		{
+			name:        "mention",
+			ev:          slackEvent{Text: "<@U0BOT> df /home", TS: "1700000000.000100"},
+			wantType:    Command,
+			wantCommand: "df",
+			wantArgs:    []string{"/home"},
+			wantThread:  "1700000000.000100",
+		},
+		{
+			name:        "slash-style in a thread",
+			ev:          slackEvent{Text: "/uptime", TS: "1700000000.000200", ThreadTS: "1700000000.000100"},
+			wantType:    Command,
+			wantCommand: "uptime",
+			wantArgs:    []string{},
+			wantThread:  "1700000000.000100",
+		},
+		{
+			name:       "chat message",
+			ev:         slackEvent{Text: "hello there", TS: "1700000000.000100"},
+			wantType:   Chat,
+			wantThread: "1700000000.000100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.ev.User = "U0ALICE"
+			tt.ev.Channel = "C0OPS"
+			m := parseSlackMessage(tt.ev, "U0BOT")
+			assert.Equal(t, tt.wantType, m.Type)
+			assert.Equal(t, tt.wantCommand, m.Command)
+			assert.Equal(t, tt.wantArgs, m.Args)
+			assert.Equal(t, tt.wantThread, m.Thread)
+			assert.Equal(t, "C0OPS", m.Channel)
+			assert.Equal(t, "U0ALICE", m.User)
+			assert.Equal(t, "slack", m.Provider)
+			assert.Equal(t, tt.ev.Text, m.Raw)
+		})
+	}
+}
+
+func TestParseSlackSlashCommand(t *testing.T) {
+	m := parseSlackSlashCommand(slackSlashCommand{Text: "df  /home", UserID: "U0ALICE", ChannelID: "C0OPS"})
+	assert.Equal(t, Command, m.Type)
+	assert.Equal(t, "df", m.Command)
+	assert.Equal(t, []string{"/home"}, m.Args)
+	assert.Equal(t, "C0OPS", m.Channel)
+	assert.Equal(t, "U0ALICE", m.User)
+
+	m = parseSlackSlashCommand(slackSlashCommand{Text: "", UserID: "U0ALICE", ChannelID: "C0OPS"})
+	assert.Equal(t, Chat, m.Type)
+}
+
+// fakeSlack serves the Web API methods the receiver calls and a Socket Mode
+// endpoint sending the envelopes written to events
+type fakeSlack struct {
+	mu     sync.Mutex
+	opens  int
+	events chan string
+	acks   chan string
+	posts  chan map[string]string
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/auth.test":
+		if r.Header.Get("Authorization") != "Bearer xoxb-bot" {
+			fmt.Fprint(w, `{"ok":false,"error":"invalid_auth"}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true,"user_id":"U0BOT"}`)
+	case "/api/apps.connections.open":
+		if r.Header.Get("Authorization") != "Bearer xapp-app" {
+			fmt.Fprint(w, `{"ok":false,"error":"invalid_auth"}`)
+			return
+		}
+		f.mu.Lock()
+		f.opens++
+		f.mu.Unlock()
+		fmt.Fprintf(w, `{"ok":true,"url":"ws://%s/link"}`, r.Host)
+	case "/api/chat.postMessage":
+		var body map[string]string
+		if r.Header.Get("Authorization") != "Bearer xoxb-bot" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			fmt.Fprint(w, `{"ok":false,"error":"invalid_auth"}`)
+			return
+		}
+		f.posts <- body
+		fmt.Fprint(w, `{"ok":true}`)
+	case "/link":
+		f.serveSocket(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeSlack) serveSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var ack struct {
+				EnvelopeID string `json:"envelope_id"`
+			}
+			if err := conn.ReadJSON(&ack); err != nil {
+				return
+			}
+			f.acks <- ack.EnvelopeID
+		}
+	}()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","num_connections":1}`)); err != nil {
+		return
+	}
+	for {
+		select {
+		case ev := <-f.events:
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(ev)); err != nil {
+				return
+			}
+			if strings.Contains(ev, `"type":"disconnect"`) {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func slackMessageEnvelope(id, event string) string {
+	return `{"type":"events_api","envelope_id":"` + id + `","payload":{"event":` + event + `}}`
+}
+
+func TestSlackReceiver(t *testing.T) {
+	fake := &fakeSlack{
+		events: make(chan string, 10),
+		acks:   make(chan string, 10),
+		posts:  make(chan map[string]string, 10),
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	_, err := NewSlackReceiver(srv.URL+"/api", "xapp-app", "xoxb-wrong", nil, nil)
+	require.ErrorContains(t, err, "invalid_auth")
+
+	r, err := NewSlackReceiver(srv.URL+"/api/", "xapp-app", "xoxb-bot", []string{"C0OPS"}, []string{"U0ALICE"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := r.GetUpdates(ctx)
+
+	// Ignored: the bot's own message, a bot message, an edit, another
+	// channel and another user
+	fake.events <- slackMessageEnvelope("e1", `{"type":"message","user":"U0BOT","channel":"C0OPS","text":"/reboot","ts":"1.1"}`)
+	fake.events <- slackMessageEnvelope("e2", `{"type":"message","bot_id":"B0","channel":"C0OPS","text":"/reboot","ts":"1.2"}`)
+	fake.events <- slackMessageEnvelope("e3", `{"type":"message","subtype":"message_changed","channel":"C0OPS","ts":"1.3"}`)
+	fake.events <- slackMessageEnvelope("e4", `{"type":"message","user":"U0ALICE","channel":"C0OTHER","text":"/reboot","ts":"1.4"}`)
+	fake.events <- slackMessageEnvelope("e5", `{"type":"message","user":"U0BOB","channel":"C0OPS","text":"/reboot","ts":"1.5"}`)
+	fake.events <- slackMessageEnvelope("e6", `{"type":"message","user":"U0ALICE","channel":"C0OPS","text":"<@U0BOT> df /home","ts":"1.7","thread_ts":"1.6"}`)
+
+	m := <-updates
+	assert.Equal(t, Command, m.Type)
+	assert.Equal(t, "df", m.Command)
+	assert.Equal(t, []string{"/home"}, m.Args)
+	assert.Equal(t, "C0OPS", m.Channel)
+	assert.Equal(t, "1.6", m.Thread)
+	assert.Equal(t, "U0ALICE", m.User)
+	assert.True(t, r.Connected())
+	for _, id := range []string{"e1", "e2", "e3", "e4", "e5", "e6"} {
+		assert.Equal(t, id, <-fake.acks)
+	}
+
+	// Long outputs are split at line breaks, every part in the thread
+	output := strings.Repeat(strings.Repeat("x", 99)+"\n", 60)
+	require.NoError(t, r.SendMessage(output, m))
+	var sent strings.Builder
+	for range 2 {
+		post := <-fake.posts
+		assert.Equal(t, "C0OPS", post["channel"])
+		assert.Equal(t, "1.6", post["thread_ts"])
+		assert.LessOrEqual(t, len(post["text"]), slackMaxMessage)
+		require.True(t, strings.HasPrefix(post["text"], "```\n"))
+		sent.WriteString(strings.TrimSuffix(strings.TrimPrefix(post["text"], "```\n"), "```"))
+	}
+	assert.Equal(t, output, sent.String())
+
+	// Slack asks to reconnect before rotating the connection
+	fake.events <- `{"type":"disconnect","reason":"refresh_requested"}`
+	fake.events <- `{"type":"slash_commands","envelope_id":"e7","payload":{"command":"/rpi","text":"uptime","user_id":"U0ALICE","channel_id":"C0OPS"}}`
+	m = <-updates
+	assert.Equal(t, Command, m.Type)
+	assert.Equal(t, "uptime", m.Command)
+	assert.Equal(t, "e7", <-fake.acks)
+	fake.mu.Lock()
+	assert.Equal(t, 2, fake.opens)
+	fake.mu.Unlock()
+
+	cancel()
+	for range updates {
+	}
+	assert.False(t, r.Connected())
+}
@@ -2,8 +2,12 @@ package messaging
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -13,14 +17,50 @@ type telegramReceiver struct {
 	ch       chan Message
 	debug    bool
 	bot      *tgbotapi.BotAPI
+	polling  atomic.Bool
+	lastPoll atomic.Pointer[time.Time]
+}
+
+// telegramRetryDelay is the wait after a failed long poll
+var telegramRetryDelay = 3 * time.Second
+
+// telegramMaxMessage is the size replies are split at, the limit of the
+// Bot API
+const telegramMaxMessage = 4096
+
+// defaultHandler forwards records to the handler of the current default
+// logger, which is replaced when the logging config is reloaded
+type defaultHandler struct{}
+
+func (defaultHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (defaultHandler) Handle(ctx context.Context, r slog.Record) error {
+	return slog.Default().Handler().Handle(ctx, r)
+}
+
+func (defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return slog.Default().Handler().WithAttrs(attrs)
+}
+
+func (defaultHandler) WithGroup(name string) slog.Handler {
+	return slog.Default().Handler().WithGroup(name)
 }
 
 func NewTelegramReceiver(apitoken string, debug bool) (*telegramReceiver, error) {
+	// The library logs raw API traffic when debugging. Route it through the
+	// default logger, at debug level, so secrets get redacted
+	_ = tgbotapi.SetLogger(slog.NewLogLogger(defaultHandler{}, slog.LevelDebug))
+
 	bot, err := tgbotapi.NewBotAPI(apitoken)
 	if err != nil {
 		return nil, err
 	}
+	return newTelegramReceiver(bot, apitoken, debug), nil
+}
 
+func newTelegramReceiver(bot *tgbotapi.BotAPI, apitoken string, debug bool) *telegramReceiver {
 	bot.Debug = debug
 
 	r := &telegramReceiver{
@@ -29,7 +69,7 @@ func NewTelegramReceiver(apitoken string, debug bool) (*telegramReceiver, error)
 		debug:    debug,
 		bot:      bot,
 	}
-	return r, nil
+	return r
 }
 
 func (s *telegramReceiver) GetUpdates(ctx context.Context) <-chan Message {
@@ -37,7 +77,10 @@ func (s *telegramReceiver) GetUpdates(ctx context.Context) <-chan Message {
 	return s.ch
 }
 
-func parseTelegramMessage(update *tgbotapi.Update) Message {
+// parseTelegramMessage converts an update. A `/cmd@name` suffix is dropped
+// when it addresses the bot itself, botName, and kept otherwise, e.g. for a
+// fleet controller to route `/cmd@host`.
+func parseTelegramMessage(update *tgbotapi.Update, botName string) Message {
 	if update.Message == nil {
 		return Message{
 			Type: Update,
@@ -54,50 +97,111 @@ func parseTelegramMessage(update *tgbotapi.Update) Message {
 		args = strings.Split(update.Message.CommandArguments(), " ")
 	}
 
+	var user string
+	if update.Message.From != nil {
+		user = strconv.FormatInt(update.Message.From.ID, 10)
+	}
+
+	command := update.Message.CommandWithAt()
+	if name, at, ok := strings.Cut(command, "@"); ok && strings.EqualFold(at, botName) {
+		command = name
+	}
+
 	m := Message{
-		Type:    messageType,
-		Raw:     update.Message.Text,
-		Command: update.Message.Command(),
-		ChatID:  update.Message.Chat.ID,
-		Args:    args,
+		Type:     messageType,
+		Raw:      update.Message.Text,
+		Text:     update.Message.Text,
+		Command:  command,
+		ChatID:   update.Message.Chat.ID,
+		Args:     args,
+		Provider: "telegram",
+		User:     user,
 	}
 	return m
 }
 
+// Connected reports whether the long poll loop is running
+func (t *telegramReceiver) Connected() bool {
+	return t.polling.Load()
+}
+
+// LastActivity returns the time of the last successful long poll
+func (t *telegramReceiver) LastActivity() time.Time {
+	if last := t.lastPoll.Load(); last != nil {
+		return *last
+	}
+	return time.Time{}
+}
+
 func (t *telegramReceiver) messageReceiver(ctx context.Context) {
 	defer close(t.ch)
-	log.Printf("Authorized on account %s", t.bot.Self.UserName)
+	slog.Info("telegram: authorized", "account", t.bot.Self.UserName)
+	defer t.polling.Store(false)
 
+	// Long poll by hand instead of using GetUpdatesChan, to know when the
+	// API was last reached
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 5
 
-	updates := t.bot.GetUpdatesChan(u)
-
 	for {
 		select {
 		case <-ctx.Done():
-			// If our context is cancelled, bail out immediately.
-			t.bot.StopReceivingUpdates()
-			log.Println("telegramReceiver: context done, returning")
+			slog.Debug("telegram: context done, returning")
 			return
+		default:
+		}
 
-		case update, ok := <-updates:
-			if !ok {
-				// The updates channel has been closed by the library.
-				log.Println("telegramReceiver: updates channel closed, exiting")
-				return
+		updates, err := t.bot.GetUpdates(u)
+		if err != nil {
+			t.polling.Store(false)
+			slog.Warn("telegram: polling failed, retrying", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(telegramRetryDelay):
 			}
-			m := parseTelegramMessage(&update)
-			t.ch <- m
+			continue
 		}
-	}
+		now := time.Now()
+		t.lastPoll.Store(&now)
+		t.polling.Store(true)
 
+		for _, update := range updates {
+			if update.UpdateID >= u.Offset {
+				u.Offset = update.UpdateID + 1
+			}
+			t.ch <- parseTelegramMessage(&update, t.bot.Self.UserName)
+		}
+	}
 }
 
 func (t *telegramReceiver) SendMessage(message string, replyTo Message) error {
-	msg := tgbotapi.NewMessage(replyTo.ChatID, message)
-	if _, err := t.bot.Send(msg); err != nil {
-		return err
+	// Longer messages are rejected
+	for _, part := range splitMessage(message, telegramMaxMessage) {
+		msg := tgbotapi.NewMessage(replyTo.ChatID, part)
+		if _, err := t.bot.Send(msg); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// telegramChoicesPerRow is how many buttons a row of the keyboard holds
+const telegramChoicesPerRow = 3
+
+// SendChoices sends the message with a keyboard of the choices, replacing
+// the user's until one is picked
+func (t *telegramReceiver) SendChoices(message string, choices []string, replyTo Message) error {
+	var rows [][]tgbotapi.KeyboardButton
+	for row := range slices.Chunk(choices, telegramChoicesPerRow) {
+		buttons := make([]tgbotapi.KeyboardButton, len(row))
+		for i, choice := range row {
+			buttons[i] = tgbotapi.NewKeyboardButton(choice)
+		}
+		rows = append(rows, buttons)
+	}
+	keyboard := tgbotapi.NewOneTimeReplyKeyboard(rows...)
+	msg := tgbotapi.NewMessage(replyTo.ChatID, message)
+	msg.ReplyMarkup = keyboard
+	_, err := t.bot.Send(msg)
+	return err
+}
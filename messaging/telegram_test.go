@@ -1,7 +1,16 @@
 package messaging
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/stretchr/testify/require"
@@ -47,6 +56,7 @@ func TestParseTelegramMessage(t *testing.T) {
 		wantArgs    []string
 		wantRaw     string
 		wantChatID  int64
+		wantUser    string
 	}{
 		{
 			name:        "command with arguments",
@@ -57,6 +67,20 @@ func TestParseTelegramMessage(t *testing.T) {
 			wantRaw:     "/greet Alice Bob",
 			wantChatID:  12345,
 		},
+		{
+			name: "command from a user",
+			update: func() *tgbotapi.Update {
+				u := makeCommandMessage("/status", 12345)
+				u.Message.From = &tgbotapi.User{ID: 777, UserName: "alice"}
+				return u
+			}(),
+			wantType:    Command,
+			wantCommand: "status",
+			wantArgs:    []string(nil),
+			wantRaw:     "/status",
+			wantChatID:  12345,
+			wantUser:    "777",
+		},
 		{
 			name: "regular chat message",
 			update: &tgbotapi.Update{
@@ -71,6 +95,24 @@ func TestParseTelegramMessage(t *testing.T) {
 			wantRaw:     "hello world",
 			wantChatID:  98765,
 		},
+		{
+			name:        "command addressed to the bot",
+			update:      makeCommandMessage("/status@RpiBot", 12345),
+			wantType:    Command,
+			wantCommand: "status",
+			wantArgs:    []string(nil),
+			wantRaw:     "/status@RpiBot",
+			wantChatID:  12345,
+		},
+		{
+			name:        "command addressed to a fleet host",
+			update:      makeCommandMessage("/df@pi-garage /home", 12345),
+			wantType:    Command,
+			wantCommand: "df@pi-garage",
+			wantArgs:    []string{"/home"},
+			wantRaw:     "/df@pi-garage /home",
+			wantChatID:  12345,
+		},
 		{
 			name:        "update with nil Message",
 			update:      &tgbotapi.Update{Message: nil},
@@ -85,13 +127,116 @@ func TestParseTelegramMessage(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt // capture range variable
 		t.Run(tt.name, func(t *testing.T) {
-			msg := parseTelegramMessage(tt.update)
+			msg := parseTelegramMessage(tt.update, "rpibot")
 
 			require.Equal(t, tt.wantType, msg.Type, "Type mismatch")
 			require.Equal(t, tt.wantCommand, msg.Command, "Command mismatch")
 			require.Equal(t, tt.wantArgs, msg.Args, "Args mismatch")
 			require.Equal(t, tt.wantRaw, msg.Raw, "Raw mismatch")
 			require.Equal(t, tt.wantChatID, msg.ChatID, "ChatID mismatch")
+			require.Equal(t, tt.wantUser, msg.User, "User mismatch")
 		})
 	}
 }
+
+func TestTelegramReceiver_Polling(t *testing.T) {
+	var mu sync.Mutex
+	failing := false
+	polls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/bottoken/getMe":
+			fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"username":"rpibot"}}`)
+		case "/bottoken/getUpdates":
+			polls++
+			switch {
+			case failing:
+				w.WriteHeader(http.StatusBadGateway)
+				fmt.Fprint(w, `{"ok":false,"error_code":502,"description":"Bad Gateway"}`)
+			case polls == 1:
+				fmt.Fprint(w, `{"ok":true,"result":[{"update_id":7,"message":{"message_id":1,"text":"/status",`+
+					`"chat":{"id":42},"from":{"id":5},"entities":[{"type":"bot_command","offset":0,"length":7}]}}]}`)
+			default:
+				require.Equal(t, "8", r.FormValue("offset"))
+				fmt.Fprint(w, `{"ok":true,"result":[]}`)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", srv.URL+"/bot%s/%s")
+	require.NoError(t, err)
+	r := newTelegramReceiver(bot, "token", false)
+	require.True(t, r.LastActivity().IsZero())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := r.GetUpdates(ctx)
+
+	m := <-updates
+	require.Equal(t, "status", m.Command)
+	require.Equal(t, int64(42), m.ChatID)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return polls > 1
+	}, time.Second, 5*time.Millisecond)
+	require.True(t, r.Connected())
+	require.WithinDuration(t, time.Now(), r.LastActivity(), time.Second)
+
+	prevRetry := telegramRetryDelay
+	telegramRetryDelay = 10 * time.Millisecond
+	defer func() { telegramRetryDelay = prevRetry }()
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	require.Eventually(t, func() bool { return !r.Connected() }, time.Second, 5*time.Millisecond)
+
+	cancel()
+	for range updates {
+	}
+}
+
+func TestTelegramReceiver_SendChoices(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bottoken/getMe":
+			fmt.Fprint(w, `{"ok":true,"result":{"id":1,"is_bot":true,"username":"rpibot"}}`)
+		case "/bottoken/sendMessage":
+			require.NoError(t, r.ParseForm())
+			form = r.PostForm
+			fmt.Fprint(w, `{"ok":true,"result":{"message_id":2,"chat":{"id":42}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("token", srv.URL+"/bot%s/%s")
+	require.NoError(t, err)
+	r := newTelegramReceiver(bot, "token", false)
+	require.NoError(t, r.SendChoices("Send service", []string{"nginx", "ssh", "cron", "docker"}, Message{ChatID: 42}))
+
+	require.Equal(t, "42", form.Get("chat_id"))
+	require.Equal(t, "Send service", form.Get("text"))
+	require.JSONEq(t, `{"keyboard":[[{"text":"nginx"},{"text":"ssh"},{"text":"cron"}],[{"text":"docker"}]],"one_time_keyboard":true,"resize_keyboard":true}`,
+		form.Get("reply_markup"))
+}
+
+func TestDefaultHandler(t *testing.T) {
+	logger := slog.NewLogLogger(defaultHandler{}, slog.LevelDebug)
+
+	// The default logger replaced afterwards, as on a reload, gets the records
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	logger.Print("Endpoint: getUpdates")
+	require.Contains(t, buf.String(), "level=DEBUG msg=\"Endpoint: getUpdates\"")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"rpi-bot/messaging"
+)
+
+// botMetrics holds the Prometheus collectors of the bot. A nil *botMetrics
+// is valid and records nothing.
+type botMetrics struct {
+	registry *prometheus.Registry
+
+	executions   *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	inFlight     prometheus.Gauge
+	received     *prometheus.CounterVec
+	sent         *prometheus.CounterVec
+	sendFailures *prometheus.CounterVec
+	unauthorized *prometheus.CounterVec
+	providerUp   *prometheus.Desc
+	providersMu  sync.Mutex
+	providers    map[string]messaging.StatusReporter
+}
+
+func newBotMetrics() *botMetrics {
+	m := &botMetrics{
+		registry: prometheus.NewRegistry(),
+		executions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpibot_command_executions_total",
+			Help: "Command attempts by command, outcome and provider.",
+		}, []string{"command", "outcome", "provider"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rpibot_command_duration_seconds",
+			Help:    "Duration of executed commands.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}, []string{"command"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rpibot_commands_in_flight",
+			Help: "Commands currently executing.",
+		}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpibot_messages_received_total",
+			Help: "Chat messages received by provider.",
+		}, []string{"provider"}),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpibot_messages_sent_total",
+			Help: "Messages sent by provider.",
+		}, []string{"provider"}),
+		sendFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpibot_send_failures_total",
+			Help: "Messages that couldn't be sent by provider.",
+		}, []string{"provider"}),
+		unauthorized: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rpibot_unauthorized_attempts_total",
+			Help: "Rejected unauthorized attempts by provider.",
+		}, []string{"provider"}),
+		providerUp: prometheus.NewDesc(
+			"rpibot_provider_connected",
+			"Whether the messaging provider is connected (1) or not (0).",
+			[]string{"provider"}, nil,
+		),
+		providers: map[string]messaging.StatusReporter{},
+	}
+	m.registry.MustRegister(
+		m.executions, m.duration, m.inFlight, m.received, m.sent,
+		m.sendFailures, m.unauthorized, m,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Describe implements prometheus.Collector for the provider connection state
+func (m *botMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.providerUp
+}
+
+// Collect implements prometheus.Collector for the provider connection state
+func (m *botMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.providersMu.Lock()
+	defer m.providersMu.Unlock()
+	for name, p := range m.providers {
+		up := 0.0
+		if p.Connected() {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(m.providerUp, prometheus.GaugeValue, up, name)
+	}
+}
+
+// watchProvider exports the connection state of a messaging client, if it
+// reports one
+func (m *botMetrics) watchProvider(name string, client messaging.MessageClient) {
+	if m == nil {
+		return
+	}
+	reporter, ok := client.(messaging.StatusReporter)
+	if !ok {
+		return
+	}
+	m.providersMu.Lock()
+	defer m.providersMu.Unlock()
+	m.providers[name] = reporter
+}
+
+// unknownCommandLabel is the command label of the attempts of commands
+// that aren't configured, whose names come from the callers
+const unknownCommandLabel = "unknown"
+
+// commandLabel returns the command label of an attempt: its name if it's a
+// configured or builtin command, or one an agent listed, and
+// unknownCommandLabel otherwise so callers can't add series at will
+func (d *dispatcher) commandLabel(command string) string {
+	if _, ok := d.commands.Get(command); ok {
+		return command
+	}
+	if _, ok := builtins[command]; ok {
+		return command
+	}
+	if name, host, ok := strings.Cut(command, "@"); ok && d.fleet != nil {
+		if _, ok := d.fleet.command(host, name); ok {
+			return command
+		}
+	}
+	return unknownCommandLabel
+}
+
+// observe records a command attempt described by its audit entry, under
+// the command label
+func (m *botMetrics) observe(command string, e auditEntry, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.executions.WithLabelValues(command, e.Outcome, e.Provider).Inc()
+	switch e.Outcome {
+	case outcomeOK, outcomeFailed, outcomeLimitExceeded:
+		m.duration.WithLabelValues(command).Observe(elapsed.Seconds())
+	case outcomeUnauthorized:
+		m.unauthorized.WithLabelValues(e.Provider).Inc()
+	}
+}
+
+// started and finished track the commands in flight
+func (m *botMetrics) started() {
+	if m != nil {
+		m.inFlight.Inc()
+	}
+}
+
+func (m *botMetrics) finished() {
+	if m != nil {
+		m.inFlight.Dec()
+	}
+}
+
+func (m *botMetrics) messageReceived(provider string) {
+	if m != nil {
+		m.received.WithLabelValues(provider).Inc()
+	}
+}
+
+func (m *botMetrics) messageSent(provider string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.sendFailures.WithLabelValues(provider).Inc()
+		return
+	}
+	m.sent.WithLabelValues(provider).Inc()
+}
+
+func (m *botMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// MetricsServer serves /metrics on its own listener, separate from /cmd/
+func MetricsServer(ctx context.Context, addr string, m *botMetrics, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.handler())
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Metrics server shutdown error", "error", err)
+		}
+	}()
+
+	slog.Info("Starting metrics server", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Metrics server ListenAndServe()", "error", err)
+	}
+}
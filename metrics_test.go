@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"rpi-bot/messaging"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// connectedClient is a MessageClient reporting a fixed connection state
+type connectedClient struct {
+	MockMessageClient
+	up bool
+}
+
+func (c *connectedClient) Connected() bool { return c.up }
+
+func TestBotMetrics_Dispatcher(t *testing.T) {
+	m := newBotMetrics()
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"status": {Command: "uptime"},
+			"fail":   {Command: "error"},
+		}),
+		executor: &mockExecutor{},
+		metrics:  m,
+	}
+
+	_, _ = d.run(messaging.Message{Command: "status", Provider: "telegram"})
+	_, _ = d.run(messaging.Message{Command: "status", Provider: "telegram"})
+	_, _ = d.run(messaging.Message{Command: "fail", Provider: "http"})
+	_, _ = d.run(messaging.Message{Command: "nope", Provider: "signal"})
+	chatReply(d, messaging.Message{Command: "audit", Provider: "signal"})
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(m.executions.WithLabelValues("status", outcomeOK, "telegram")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.executions.WithLabelValues("fail", outcomeFailed, "http")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.executions.WithLabelValues(unknownCommandLabel, outcomeRejected, "signal")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.executions.WithLabelValues("audit", outcomeUnauthorized, "signal")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.unauthorized.WithLabelValues("signal")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(m.inFlight))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.duration))
+}
+
+func TestBotMetrics_Poller(t *testing.T) {
+	m := newBotMetrics()
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"status": {Command: "uptime"}}),
+		executor: &mockExecutor{},
+		metrics:  m,
+	}
+
+	client := new(MockMessageClient)
+	updates := make(chan messaging.Message, 3)
+	updates <- messaging.Message{Type: messaging.Chat, Provider: "telegram", Text: "hi"}
+	updates <- messaging.Message{Type: messaging.Command, Provider: "telegram", Command: "status"}
+	updates <- messaging.Message{Type: messaging.Command, Provider: "telegram", Command: "status", ChatID: 2}
+	close(updates)
+	client.On("GetUpdates", mock.Anything).Return((<-chan messaging.Message)(updates))
+	client.On("SendMessage", "uptime", mock.MatchedBy(func(m messaging.Message) bool { return m.ChatID == 0 })).Return(nil)
+	client.On("SendMessage", "uptime", mock.MatchedBy(func(m messaging.Message) bool { return m.ChatID == 2 })).
+		Return(errors.New("send error"))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	MessagingPoller(context.Background(), client, d, &wg)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(m.received.WithLabelValues("telegram")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.sent.WithLabelValues("telegram")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.sendFailures.WithLabelValues("telegram")))
+}
+
+func TestBotMetrics_Endpoint(t *testing.T) {
+	m := newBotMetrics()
+	m.watchProvider("signal", &connectedClient{up: true})
+	m.watchProvider("telegram", new(MockMessageClient)) // doesn't report a state
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"status": {Command: "uptime"}}),
+		executor: &mockExecutor{},
+		metrics:  m,
+	}
+	cfg := &Config{
+		Httpd:   HttpdConfig{AuthToken: "secret"},
+		Metrics: MetricsConfig{Enabled: true},
+	}
+	mux := setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Token secret")
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	assert.Contains(t, body, `rpibot_provider_connected{provider="signal"} 1`)
+	assert.NotContains(t, body, `rpibot_provider_connected{provider="telegram"}`)
+	assert.Contains(t, body, `rpibot_unauthorized_attempts_total{provider="http"} 1`)
+	assert.Contains(t, body, "rpibot_commands_in_flight 0")
+
+	// With its own listener, /metrics isn't served next to /cmd/
+	cfg.Metrics.Addr = "127.0.0.1:9100"
+	mux = setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil)
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Token secret")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
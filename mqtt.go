@@ -0,0 +1,64 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"slices"
+
+	"rpi-bot/messaging"
+)
+
+// Defaults of the MQTT topics and client ID
+const (
+	defaultMQTTClientID      = "rpi-bot"
+	defaultMQTTRequestTopic  = "rpi-bot/request"
+	defaultMQTTResponseTopic = "rpi-bot/response"
+	defaultMQTTStatusTopic   = "rpi-bot/status"
+)
+
+// mqttSecureSchemes are the broker URL schemes connecting over TLS
+var mqttSecureSchemes = []string{"ssl", "tls", "mqtts", "tcps", "wss"}
+
+// mqttOptions resolves the MQTT configuration, applying the defaults and
+// loading the TLS files
+func mqttOptions(cfg MQTTConfig) (messaging.MQTTOptions, error) {
+	password, _ := GetSecret("MQTT_PASSWORD", cfg.Password)
+	opts := messaging.MQTTOptions{
+		Broker:        cfg.Broker,
+		ClientID:      cmp.Or(cfg.ClientID, defaultMQTTClientID),
+		Username:      cfg.Username,
+		Password:      password,
+		RequestTopic:  cmp.Or(cfg.RequestTopic, defaultMQTTRequestTopic),
+		ResponseTopic: cmp.Or(cfg.ResponseTopic, defaultMQTTResponseTopic),
+		StatusTopic:   cmp.Or(cfg.StatusTopic, defaultMQTTStatusTopic),
+		QoS:           byte(cfg.QoS),
+	}
+	u, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return opts, fmt.Errorf("mqtt: %w", err)
+	}
+	if !slices.Contains(mqttSecureSchemes, u.Scheme) {
+		return opts, nil
+	}
+	t := cfg.TLS
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		if tlsCfg.RootCAs, err = loadCertPool(t.CAFile); err != nil {
+			return opts, fmt.Errorf("mqtt: %w", err)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return opts, fmt.Errorf("mqtt: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	opts.TLS = tlsCfg
+	return opts, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv("MQTT_PASSWORD", "from-env")
+		opts, err := mqttOptions(MQTTConfig{Broker: "tcp://localhost:1883", Username: "bot", Password: "from-config", QoS: 1})
+		require.NoError(t, err)
+		assert.Equal(t, "tcp://localhost:1883", opts.Broker)
+		assert.Equal(t, "rpi-bot", opts.ClientID)
+		assert.Equal(t, "bot", opts.Username)
+		assert.Equal(t, "from-env", opts.Password)
+		assert.Equal(t, "rpi-bot/request", opts.RequestTopic)
+		assert.Equal(t, "rpi-bot/response", opts.ResponseTopic)
+		assert.Equal(t, "rpi-bot/status", opts.StatusTopic)
+		assert.Equal(t, byte(1), opts.QoS)
+		assert.Nil(t, opts.TLS)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		certPEM, keyPEM, err := generateSelfSigned([]string{"localhost"}, time.Now())
+		require.NoError(t, err)
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o644))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+
+		opts, err := mqttOptions(MQTTConfig{
+			Broker:        "ssl://broker:8883",
+			ClientID:      "pi-kitchen",
+			RequestTopic:  "home/pi/+/request",
+			ResponseTopic: "home/pi/response",
+			StatusTopic:   "home/pi/status",
+			TLS:           MQTTTLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "pi-kitchen", opts.ClientID)
+		assert.Equal(t, "home/pi/+/request", opts.RequestTopic)
+		require.NotNil(t, opts.TLS)
+		assert.NotNil(t, opts.TLS.RootCAs)
+		assert.Len(t, opts.TLS.Certificates, 1)
+		assert.False(t, opts.TLS.InsecureSkipVerify)
+
+		_, err = mqttOptions(MQTTConfig{Broker: "mqtts://broker", TLS: MQTTTLSConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")}})
+		require.ErrorContains(t, err, "mqtt: open")
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+const (
+	defaultNotifyAttempts = 3
+	// notifyTimeout bounds the delivery to a sink, retries included
+	notifyTimeout = 2 * time.Minute
+)
+
+// notifyBackoffUnit is what RetryConfig.BackoffSeconds counts, shortened
+// by tests
+var notifyBackoffUnit = time.Second
+
+var errNoProvider = errors.New("no messaging provider to notify")
+
+// recipientSink returns the notification sink of a recipient, nil for a
+// chat recipient
+func recipientSink(r Recipient) (messaging.NotificationSink, error) {
+	var sink messaging.NotificationSink
+	switch {
+	case r.Webhook != nil:
+		webhook, err := messaging.NewWebhookSink(r.Webhook.URL, r.Webhook.Method, r.Webhook.Headers, r.Webhook.Body)
+		if err != nil {
+			return nil, err
+		}
+		sink = webhook
+	case r.Ntfy != nil:
+		sink = messaging.NewNtfySink(r.Ntfy.URL, r.Ntfy.Token, r.Ntfy.Priority, r.Ntfy.Tags)
+	case r.Gotify != nil:
+		sink = messaging.NewGotifySink(r.Gotify.URL, r.Gotify.Token, r.Gotify.Priority)
+	default:
+		return nil, nil
+	}
+	return messaging.RetrySink{
+		Sink:     sink,
+		Attempts: cmp.Or(r.Retry.Attempts, defaultNotifyAttempts),
+		Backoff:  time.Duration(cmp.Or(r.Retry.BackoffSeconds, 1)) * notifyBackoffUnit,
+	}, nil
+}
+
+// notifyRecipient sends text to the sink of a recipient or, for a chat
+// recipient, through the messaging provider
+func notifyRecipient(sender messaging.MessageSender, r Recipient, title, text string) error {
+	sink, err := recipientSink(r)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		return sink.Notify(ctx, messaging.Notification{Title: title, Message: text})
+	}
+	if sender == nil {
+		return errNoProvider
+	}
+	return sender.SendMessage(text, r.Message())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"rpi-bot/messaging"
+)
+
+func TestNotifyRecipient(t *testing.T) {
+	notifyBackoffUnit = time.Millisecond
+	defer func() { notifyBackoffUnit = time.Second }()
+
+	var calls atomic.Int32
+	var title, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first attempt fails and is retried
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		title, body = r.Header.Get("Title"), string(data)
+	}))
+	defer srv.Close()
+
+	r := Recipient{Ntfy: &NtfyConfig{URL: srv.URL + "/rpi-alerts"}}
+	// Sinks need no messaging provider
+	require.NoError(t, notifyRecipient(nil, r, "rpi-bot", "config reloaded"))
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, "rpi-bot", title)
+	assert.Equal(t, "config reloaded", body)
+
+	r = Recipient{Ntfy: &NtfyConfig{URL: srv.URL + "/rpi-alerts"}, Retry: RetryConfig{Attempts: 1}}
+	calls.Store(0)
+	assert.ErrorContains(t, notifyRecipient(nil, r, "rpi-bot", "config reloaded"), "ntfy: 502 Bad Gateway")
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestNotifyRecipient_Chat(t *testing.T) {
+	r := Recipient{ChatID: 42}
+	assert.ErrorIs(t, notifyRecipient(nil, r, "rpi-bot", "config reloaded"), errNoProvider)
+
+	client := new(MockMessageClient)
+	client.On("SendMessage", "config reloaded", mock.MatchedBy(func(m messaging.Message) bool {
+		return m.ChatID == 42
+	})).Return(nil)
+	require.NoError(t, notifyRecipient(client, r, "rpi-bot", "config reloaded"))
+	client.AssertExpectations(t)
+}
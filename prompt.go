@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"rpi-bot/messaging"
+)
+
+const defaultPromptTimeoutSeconds = 300
+
+// reply is what the bot answers a message with, and the answers it offers
+// as buttons where the provider has them
+type reply struct {
+	text    string
+	choices []string
+}
+
+// conversation is a command waiting for the args its caller left out
+type conversation struct {
+	request messaging.Message // The command and the args given so far
+	expires time.Time
+}
+
+// promptStore holds the conversations in progress, one per provider, chat
+// and user. A nil *promptStore is valid and never prompts.
+type promptStore struct {
+	timeout time.Duration
+
+	mu            sync.Mutex
+	conversations map[string]conversation
+}
+
+// newPromptStore returns the conversations of cfg, nil if disabled
+func newPromptStore(cfg PromptsConfig) *promptStore {
+	if cfg.Disabled {
+		return nil
+	}
+	timeout := cfg.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultPromptTimeoutSeconds
+	}
+	return &promptStore{
+		timeout:       time.Duration(timeout) * time.Second,
+		conversations: map[string]conversation{},
+	}
+}
+
+// conversationKey identifies the conversation of a message. chatKey has
+// the provider already.
+func conversationKey(m messaging.Message) string {
+	return chatKey(m) + "/" + m.User
+}
+
+// get returns the request of the conversation of key, unless it timed out
+func (p *promptStore) get(key string, now time.Time) (messaging.Message, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.conversations[key]
+	if !ok {
+		return messaging.Message{}, false
+	}
+	if now.After(c.expires) {
+		delete(p.conversations, key)
+		return messaging.Message{}, false
+	}
+	return c.request, true
+}
+
+// put starts or continues the conversation of key, forgetting the ones
+// that timed out
+func (p *promptStore) put(key string, request messaging.Message, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, c := range p.conversations {
+		if now.After(c.expires) {
+			delete(p.conversations, k)
+		}
+	}
+	p.conversations[key] = conversation{request: request, expires: now.Add(p.timeout)}
+}
+
+// end drops the conversation of key, reporting whether there was one
+func (p *promptStore) end(key string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.conversations[key]
+	delete(p.conversations, key)
+	return ok
+}
+
+// converse handles the messages of a conversation: a configured command
+// missing args starts one, asking for the first, and the next messages of
+// the caller in the chat answer in turn until the command runs. It reports
+// false for the messages that aren't part of one.
+func (d *dispatcher) converse(m messaging.Message, now time.Time) (reply, bool) {
+	// MQTT requests come from programs, which send every arg at once
+	if d.prompts == nil || m.Provider == "mqtt" || (m.Type != messaging.Command && m.Type != messaging.Chat) {
+		return reply{}, false
+	}
+	key := conversationKey(m)
+
+	if m.Type == messaging.Command {
+		if _, ok := builtins[m.Command]; ok {
+			return reply{}, false
+		}
+		if strings.Contains(m.Command, "@") && d.fleet != nil {
+			return reply{}, false
+		}
+		if c, ok := d.commands.Get(m.Command); ok {
+			if len(m.Args) >= len(c.Args) {
+				return reply{}, false
+			}
+			request := m
+			request.Args = slices.Clone(m.Args)
+			d.prompts.put(key, request, now)
+			return ask(c, c.Args[len(request.Args)], ""), true
+		}
+		// Unknown commands may be answers, "/home" for a path
+	}
+
+	request, ok := d.prompts.get(key, now)
+	if !ok {
+		return reply{}, false
+	}
+	c, ok := d.commands.Get(request.Command)
+	if !ok || len(request.Args) >= len(c.Args) {
+		// Removed or changed by a reload since
+		d.prompts.end(key)
+		return reply{text: replyText(request.Command, "", errUnknownCommand)}, true
+	}
+	name := c.Args[len(request.Args)]
+	answer := strings.TrimSpace(m.Text)
+	if answer == "" {
+		return ask(c, name, ""), true
+	}
+	values := c.ArgSpecs[name].Values
+	if len(values) > 0 && !slices.Contains(values, answer) {
+		return ask(c, name, fmt.Sprintf("%s is not one of the choices.", answer)), true
+	}
+	request.Args = append(request.Args, answer)
+	if len(request.Args) < len(c.Args) {
+		d.prompts.put(key, request, now)
+		return ask(c, c.Args[len(request.Args)], ""), true
+	}
+
+	d.prompts.end(key)
+	request.RequestID = m.RequestID
+	output, err := d.run(request)
+	return reply{text: replyText(request.Command, output, err)}, true
+}
+
+// ask returns the question for an arg of c, after a note if any
+func ask(c Command, name string, note string) reply {
+	spec := c.ArgSpecs[name]
+	var b strings.Builder
+	if note != "" {
+		b.WriteString(note + "\n")
+	}
+	b.WriteString("Send " + name)
+	if spec.Description != "" {
+		b.WriteString(": " + spec.Description)
+	}
+	b.WriteString(", or /cancel")
+	return reply{text: b.String(), choices: spec.Values}
+}
+
+// sendReply sends a reply, with its choices as buttons if the provider has
+// them and listed in the text otherwise
+func sendReply(sender messaging.MessageSender, r reply, replyTo messaging.Message) error {
+	if len(r.choices) == 0 {
+		return sender.SendMessage(r.text, replyTo)
+	}
+	if cs, ok := sender.(messaging.ChoiceSender); ok {
+		return cs.SendChoices(r.text, r.choices, replyTo)
+	}
+	return sender.SendMessage(r.text+"\nChoices: "+strings.Join(r.choices, ", "), replyTo)
+}
+
+// cancelCommand implements `/cancel`, ending the caller's conversation
+func cancelCommand(d *dispatcher, m messaging.Message) (string, error) {
+	if !d.prompts.end(conversationKey(m)) {
+		return "Nothing to cancel", nil
+	}
+	return "Cancelled", nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"rpi-bot/messaging"
+)
+
+// newPromptDispatcher returns a dispatcher prompting for the args of
+// service, a command with allowed values
+func newPromptDispatcher() *dispatcher {
+	return &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"service": {
+				Command: "systemctl %s %s",
+				Args:    []string{"action", "unit"},
+				ArgSpecs: map[string]ArgSpec{
+					"action": {Description: "What to do", Values: []string{"start", "stop"}},
+				},
+			},
+			"uptime": {Command: "uptime"},
+		}),
+		executor: &mockExecutor{},
+		prompts:  newPromptStore(PromptsConfig{}),
+	}
+}
+
+func TestConverse(t *testing.T) {
+	d := newPromptDispatcher()
+	alice := messaging.Message{Provider: "telegram", ChatID: 42, User: "5"}
+	command := func(m messaging.Message, name string, args ...string) messaging.Message {
+		m.Type, m.Command, m.Args = messaging.Command, name, args
+		return m
+	}
+	chat := func(m messaging.Message, text string) messaging.Message {
+		m.Type, m.Text = messaging.Chat, text
+		return m
+	}
+	askAction := reply{text: "Send action: What to do, or /cancel", choices: []string{"start", "stop"}}
+
+	steps := []struct {
+		name    string
+		message messaging.Message
+		want    reply
+		handled bool
+	}{
+		{name: "every arg given", message: command(alice, "uptime")},
+		{name: "missing args", message: command(alice, "service"), want: askAction, handled: true},
+		{name: "chat without conversation", message: chat(messaging.Message{Provider: "telegram", ChatID: 42, User: "6"}, "hi")},
+		{
+			name:    "not a choice",
+			message: chat(alice, "restart"),
+			want:    reply{text: "restart is not one of the choices.\n" + askAction.text, choices: askAction.choices},
+			handled: true,
+		},
+		{name: "empty answer", message: chat(alice, " "), want: askAction, handled: true},
+		{name: "next arg", message: chat(alice, "start"), want: reply{text: "Send unit, or /cancel"}, handled: true},
+		{name: "builtins still work", message: command(alice, "history")},
+		{name: "answer as a command", message: command(chat(alice, "/nginx"), "nginx"), want: reply{text: "systemctl start /nginx"}, handled: true},
+		{name: "conversation over", message: chat(alice, "thanks")},
+		{name: "partial args", message: command(alice, "service", "stop"), want: reply{text: "Send unit, or /cancel"}, handled: true},
+		{name: "last arg", message: chat(alice, "ssh"), want: reply{text: "systemctl stop ssh"}, handled: true},
+		{name: "again", message: command(alice, "service", "stop"), want: reply{text: "Send unit, or /cancel"}, handled: true},
+		{
+			name:    "answer with spaces",
+			message: chat(alice, "nginx --now"),
+			want:    reply{text: "Command formatting failed: unit must not contain whitespace"},
+			handled: true,
+		},
+	}
+	for _, tt := range steps {
+		t.Run(tt.name, func(t *testing.T) {
+			r, handled := d.converse(tt.message, time.Now())
+			assert.Equal(t, tt.handled, handled)
+			assert.Equal(t, tt.want, r)
+		})
+	}
+}
+
+func TestConverse_CancelAndTimeout(t *testing.T) {
+	d := newPromptDispatcher()
+	m := messaging.Message{Type: messaging.Command, Command: "service", Provider: "slack", Channel: "C1", User: "U1"}
+	now := time.Now()
+
+	_, handled := d.converse(m, now)
+	require.True(t, handled)
+	// In another channel, the user has no conversation
+	other := messaging.Message{Type: messaging.Command, Command: "cancel", Provider: "slack", Channel: "C2", User: "U1"}
+	assert.Equal(t, "Nothing to cancel", chatReply(d, other))
+	cancel := messaging.Message{Type: messaging.Command, Command: "cancel", Provider: "slack", Channel: "C1", User: "U1"}
+	assert.Equal(t, "Cancelled", chatReply(d, cancel))
+	assert.Equal(t, "Nothing to cancel", chatReply(d, cancel))
+
+	_, handled = d.converse(m, now)
+	require.True(t, handled)
+	answer := messaging.Message{Type: messaging.Chat, Text: "start", Provider: "slack", Channel: "C1", User: "U1"}
+	_, handled = d.converse(answer, now.Add(d.prompts.timeout+time.Second))
+	assert.False(t, handled)
+}
+
+func TestConverse_Disabled(t *testing.T) {
+	d := newPromptDispatcher()
+	d.prompts = newPromptStore(PromptsConfig{Disabled: true})
+	m := messaging.Message{Type: messaging.Command, Command: "service", Provider: "telegram", ChatID: 42}
+	_, handled := d.converse(m, time.Now())
+	assert.False(t, handled)
+	assert.Equal(t, "Command formatting failed: mismatch between command definition args=2 and number of args=0", chatReply(d, m))
+	assert.Equal(t, "Nothing to cancel", chatReply(d, messaging.Message{Type: messaging.Command, Command: "cancel"}))
+}
+
+// choiceRecorder records what is sent, with buttons or not
+type choiceRecorder struct {
+	texts   []string
+	choices [][]string
+}
+
+func (r *choiceRecorder) SendMessage(message string, _ messaging.Message) error {
+	r.texts = append(r.texts, message)
+	r.choices = append(r.choices, nil)
+	return nil
+}
+
+func (r *choiceRecorder) SendChoices(message string, choices []string, _ messaging.Message) error {
+	r.texts = append(r.texts, message)
+	r.choices = append(r.choices, choices)
+	return nil
+}
+
+// textSender only sends text
+type textSender struct{ texts []string }
+
+func (s *textSender) SendMessage(message string, _ messaging.Message) error {
+	s.texts = append(s.texts, message)
+	return nil
+}
+
+func TestSendReply(t *testing.T) {
+	r := reply{text: "Send action", choices: []string{"start", "stop"}}
+
+	buttons := &choiceRecorder{}
+	require.NoError(t, sendReply(buttons, r, messaging.Message{}))
+	require.NoError(t, sendReply(buttons, reply{text: "done"}, messaging.Message{}))
+	assert.Equal(t, []string{"Send action", "done"}, buttons.texts)
+	assert.Equal(t, [][]string{{"start", "stop"}, nil}, buttons.choices)
+
+	text := &textSender{}
+	require.NoError(t, sendReply(text, r, messaging.Message{}))
+	assert.Equal(t, []string{"Send action\nChoices: start, stop"}, text.texts)
+}
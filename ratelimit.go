@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"rpi-bot/messaging"
+)
+
+// maxIdleLimiters is the number of per caller limiters above which the
+// full, idle ones are dropped
+const maxIdleLimiters = 1000
+
+// rateLimitError is returned when a request exceeds a rate limit
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry in %d s", e.seconds())
+}
+
+// seconds returns the wait rounded up, as sent in Retry-After
+func (e *rateLimitError) seconds() int {
+	return int(math.Ceil(e.retryAfter.Seconds()))
+}
+
+// writeRateLimited answers a rate limited HTTP request with 429
+func writeRateLimited(w http.ResponseWriter, e *rateLimitError) {
+	w.Header().Set("Retry-After", strconv.Itoa(e.seconds()))
+	http.Error(w, e.Error(), http.StatusTooManyRequests)
+}
+
+func newLimiter(l RateLimit) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(l.PerMinute/60), l.Burst)
+}
+
+// rateLimiter applies token bucket limits globally, per caller and per
+// command. A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	global    *rate.Limiter
+	perCaller RateLimit
+
+	mu       sync.Mutex
+	callers  map[string]*rate.Limiter
+	commands map[string]commandLimiter
+}
+
+// commandLimiter remembers the limit a command limiter was built with, to
+// build it again when a config reload changes it
+type commandLimiter struct {
+	limit   RateLimit
+	limiter *rate.Limiter
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	r := &rateLimiter{
+		perCaller: cfg.PerCaller,
+		callers:   map[string]*rate.Limiter{},
+		commands:  map[string]commandLimiter{},
+	}
+	if cfg.Global.enabled() {
+		r.global = newLimiter(cfg.Global)
+	}
+	return r
+}
+
+func (l RateLimit) enabled() bool {
+	return l.PerMinute > 0
+}
+
+// callerKey identifies the caller a message is limited as
+func callerKey(m messaging.Message) string {
+	if m.User != "" {
+		return m.Provider + ":" + m.User
+	}
+	return chatKey(m)
+}
+
+// allow takes a token from every limit applying to the message, or none
+// if one of them is exhausted
+func (r *rateLimiter) allow(m messaging.Message, c Command, now time.Time) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limiters := []*rate.Limiter{r.global}
+	if r.perCaller.enabled() {
+		limiters = append(limiters, r.callerLimiter(callerKey(m), now))
+	}
+	if c.RateLimit.enabled() {
+		cl, ok := r.commands[m.Command]
+		if !ok || cl.limit != c.RateLimit {
+			cl = commandLimiter{limit: c.RateLimit, limiter: newLimiter(c.RateLimit)}
+			r.commands[m.Command] = cl
+		}
+		limiters = append(limiters, cl.limiter)
+	}
+
+	var reservations []*rate.Reservation
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		res := l.ReserveN(now, 1)
+		reservations = append(reservations, res)
+		if delay := res.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	// Give the tokens back: a refused request doesn't count
+	for _, res := range reservations {
+		res.CancelAt(now)
+	}
+	return &rateLimitError{retryAfter: wait}
+}
+
+func (r *rateLimiter) callerLimiter(key string, now time.Time) *rate.Limiter {
+	l, ok := r.callers[key]
+	if ok {
+		return l
+	}
+	if len(r.callers) >= maxIdleLimiters {
+		for k, other := range r.callers {
+			if other.TokensAt(now) >= float64(other.Burst()) {
+				delete(r.callers, k)
+			}
+		}
+	}
+	l = newLimiter(r.perCaller)
+	r.callers[key] = l
+	return l
+}
+
+// lockout blocks client addresses after repeated authentication failures.
+// A nil *lockout never blocks.
+type lockout struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*lockoutState
+}
+
+type lockoutState struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newLockout(cfg LockoutConfig) *lockout {
+	if cfg.MaxFailures <= 0 {
+		return nil
+	}
+	window := time.Duration(cfg.WindowSeconds) * time.Second
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	duration := time.Duration(cfg.DurationSeconds) * time.Second
+	if duration <= 0 {
+		duration = 15 * time.Minute
+	}
+	return &lockout{
+		maxFailures: cfg.MaxFailures,
+		window:      window,
+		duration:    duration,
+		clients:     map[string]*lockoutState{},
+	}
+}
+
+// check returns an error while the client is locked out
+func (l *lockout) check(client string, now time.Time) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.clients[client]; ok && now.Before(s.lockedUntil) {
+		return &rateLimitError{retryAfter: s.lockedUntil.Sub(now)}
+	}
+	return nil
+}
+
+// fail records an authentication failure, locking the client out once it
+// reaches maxFailures within the window
+func (l *lockout) fail(client string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, s := range l.clients {
+		if now.Sub(s.first) > l.window && now.After(s.lockedUntil) {
+			delete(l.clients, k)
+		}
+	}
+	s, ok := l.clients[client]
+	if !ok {
+		s = &lockoutState{first: now}
+		l.clients[client] = s
+	}
+	s.failures++
+	if s.failures >= l.maxFailures {
+		s.lockedUntil = now.Add(l.duration)
+		s.failures = 0
+		s.first = now
+	}
+}
+
+// succeed forgets the failures of a client that authenticated
+func (l *lockout) succeed(client string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, client)
+}
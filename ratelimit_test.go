@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	alice := messaging.Message{Provider: "telegram", User: "alice", Command: "status"}
+	bob := messaging.Message{Provider: "telegram", User: "bob", Command: "status"}
+	status := Command{Command: "uptime"}
+	reboot := Command{Command: "reboot", RateLimit: RateLimit{PerMinute: 1, Burst: 1}}
+
+	tests := []struct {
+		name string
+		cfg  RateLimitConfig
+		// calls run in order, wantLimited tells which ones are refused
+		calls       []messaging.Message
+		commands    []Command
+		wantLimited []bool
+	}{
+		{
+			name:        "no limits",
+			calls:       []messaging.Message{alice, alice, alice},
+			commands:    []Command{status, status, status},
+			wantLimited: []bool{false, false, false},
+		},
+		{
+			name:        "global limit shared by callers",
+			cfg:         RateLimitConfig{Global: RateLimit{PerMinute: 1, Burst: 2}},
+			calls:       []messaging.Message{alice, bob, bob},
+			commands:    []Command{status, status, status},
+			wantLimited: []bool{false, false, true},
+		},
+		{
+			name:        "per caller limit",
+			cfg:         RateLimitConfig{PerCaller: RateLimit{PerMinute: 1, Burst: 1}},
+			calls:       []messaging.Message{alice, alice, bob},
+			commands:    []Command{status, status, status},
+			wantLimited: []bool{false, true, false},
+		},
+		{
+			name:        "per command limit",
+			calls:       []messaging.Message{alice, bob, alice},
+			commands:    []Command{reboot, reboot, status},
+			wantLimited: []bool{false, true, false},
+		},
+		{
+			name: "refused request doesn't take a token from the other limits",
+			cfg:  RateLimitConfig{Global: RateLimit{PerMinute: 1, Burst: 2}},
+			// The second reboot is refused by the command limit, leaving a
+			// global token for the status
+			calls:       []messaging.Message{alice, alice, alice, alice},
+			commands:    []Command{reboot, reboot, status, status},
+			wantLimited: []bool{false, true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.cfg)
+			for i, m := range tt.calls {
+				err := l.allow(m, tt.commands[i], now)
+				assert.Equal(t, tt.wantLimited[i], err != nil, "call %d: %v", i, err)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_RetryAfter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(RateLimitConfig{PerCaller: RateLimit{PerMinute: 4, Burst: 1}})
+	m := messaging.Message{Provider: "http", User: "backup-job", Command: "status"}
+
+	require.NoError(t, l.allow(m, Command{}, now))
+	err := l.allow(m, Command{}, now.Add(5*time.Second))
+	var limitErr *rateLimitError
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, 10, limitErr.seconds())
+	assert.EqualError(t, err, "rate limited, retry in 10 s")
+
+	// The token is back once the wait is over
+	require.NoError(t, l.allow(m, Command{}, now.Add(15*time.Second)))
+
+	// A nil limiter allows everything
+	var disabled *rateLimiter
+	assert.NoError(t, disabled.allow(m, Command{}, now))
+}
+
+func TestRateLimiter_CommandLimitReloaded(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(RateLimitConfig{})
+	m := messaging.Message{Provider: "http", User: "ops", Command: "reboot"}
+
+	require.NoError(t, l.allow(m, Command{RateLimit: RateLimit{PerMinute: 1, Burst: 1}}, now))
+	require.Error(t, l.allow(m, Command{RateLimit: RateLimit{PerMinute: 1, Burst: 1}}, now))
+	// A changed limit starts a new bucket
+	assert.NoError(t, l.allow(m, Command{RateLimit: RateLimit{PerMinute: 1, Burst: 2}}, now))
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := newLockout(LockoutConfig{MaxFailures: 3, WindowSeconds: 60, DurationSeconds: 600})
+
+	l.fail("10.0.0.1", now)
+	l.fail("10.0.0.1", now.Add(time.Second))
+	assert.NoError(t, l.check("10.0.0.1", now.Add(2*time.Second)))
+
+	// Failures outside the window are forgotten
+	l.fail("10.0.0.1", now.Add(2*time.Minute))
+	assert.NoError(t, l.check("10.0.0.1", now.Add(2*time.Minute)))
+
+	// A success resets the count
+	l.succeed("10.0.0.1")
+	l.fail("10.0.0.1", now.Add(3*time.Minute))
+	l.fail("10.0.0.1", now.Add(3*time.Minute))
+	assert.NoError(t, l.check("10.0.0.1", now.Add(3*time.Minute)))
+
+	l.fail("10.0.0.1", now.Add(3*time.Minute))
+	err := l.check("10.0.0.1", now.Add(4*time.Minute))
+	assert.EqualError(t, err, "rate limited, retry in 540 s")
+	assert.NoError(t, l.check("10.0.0.2", now.Add(4*time.Minute)), "other clients aren't locked out")
+	assert.NoError(t, l.check("10.0.0.1", now.Add(14*time.Minute)))
+
+	// Disabled when maxFailures is 0
+	assert.Nil(t, newLockout(LockoutConfig{}))
+}
+
+func TestAuthMiddleware_Lockout(t *testing.T) {
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{commands: newCommandTable(nil), audit: audit}
+	auth := newHTTPAuth(HttpdConfig{
+		AuthToken: "secret",
+		Lockout:   LockoutConfig{MaxFailures: 2, DurationSeconds: 60},
+	}, d)
+	handler := authMiddleware(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+		req.Header.Set("Authorization", "Token "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("guess1").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("guess2").Code)
+	rec := get("secret")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "locked out even with the right token")
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	auth.now = func() time.Time { return time.Now().Add(time.Minute) }
+	assert.Equal(t, http.StatusOK, get("secret").Code)
+
+	entries, err := audit.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, outcomeUnauthorized, entries[2].Outcome)
+	assert.Contains(t, entries[2].Error, "locked out")
+}
+
+func TestDispatcher_RateLimited(t *testing.T) {
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"status": {Command: "uptime"}}),
+		executor: &mockExecutor{},
+		audit:    audit,
+		limits:   newRateLimiter(RateLimitConfig{PerCaller: RateLimit{PerMinute: 1, Burst: 1}}),
+	}
+	m := messaging.Message{Provider: "telegram", ChatID: 1, User: "alice", Command: "status"}
+
+	assert.Equal(t, "uptime", chatReply(d, m))
+	assert.Regexp(t, `^Rate limited, retry in \d+ s$`, chatReply(d, m))
+
+	handler := setupMux(&Config{}, &httpCommandHandler{dispatcher: d}, nil)
+	for _, wantCode := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/cmd/status", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, wantCode, rec.Code)
+		if wantCode == http.StatusTooManyRequests {
+			assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+			assert.Contains(t, rec.Body.String(), "rate limited, retry in")
+		}
+	}
+
+	entries, err := audit.Recent(10)
+	require.NoError(t, err)
+	var outcomes []string
+	for _, e := range entries {
+		outcomes = append(outcomes, e.Outcome)
+	}
+	assert.ElementsMatch(t, []string{outcomeOK, outcomeRateLimited, outcomeOK, outcomeRateLimited}, outcomes)
+}
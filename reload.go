@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"rpi-bot/messaging"
+)
+
+// reloadDebounce groups the burst of events editors produce when saving a file
+const reloadDebounce = 500 * time.Millisecond
+
+// commandTable holds the configured commands so they can be swapped at runtime
+// without restarting the messaging providers or the HTTP server
+type commandTable struct {
+	commands atomic.Pointer[map[string]Command]
+}
+
+func newCommandTable(commands map[string]Command) *commandTable {
+	t := &commandTable{}
+	t.Swap(commands)
+	return t
+}
+
+// Get returns the command definition registered under name
+func (t *commandTable) Get(name string) (Command, bool) {
+	c, ok := (*t.commands.Load())[name]
+	return c, ok
+}
+
+// Names returns the names of every command, sorted
+func (t *commandTable) Names() []string {
+	return slices.Sorted(maps.Keys(*t.commands.Load()))
+}
+
+// Swap atomically replaces the whole command table
+func (t *commandTable) Swap(commands map[string]Command) {
+	if commands == nil {
+		commands = map[string]Command{}
+	}
+	t.commands.Store(&commands)
+}
+
+// configReloader re-reads the configuration file on SIGHUP or, optionally,
+// when the file changes, and swaps the command table if the new file is valid
+type configReloader struct {
+	path     string
+	provider string // The -provider flag, replacing the configured one
+	table    *commandTable
+	sender   messaging.MessageSender
+	started  *Config // The settings everything but the commands and logging run with
+	mu       sync.Mutex
+	current  *Config
+}
+
+func newConfigReloader(
+	path string,
+	cfg *Config,
+	table *commandTable,
+	sender messaging.MessageSender,
+) *configReloader {
+	return &configReloader{
+		path:    path,
+		started: cfg,
+		current: cfg,
+		table:   table,
+		sender:  sender,
+	}
+}
+
+// reload loads the config file and applies it. On error the running
+// configuration is kept and admins are notified.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfig(r.path, r.provider)
+	if err != nil {
+		err = fmt.Errorf("config reload rejected, keeping previous configuration: %w", err)
+		slog.Error(err.Error())
+		notifyAdmins(r.sender, r.current, err.Error())
+		return err
+	}
+
+	r.table.Swap(cfg.Commands)
+	r.current = cfg
+	// The logging section was validated with the config, and new secrets
+	// must be redacted from now on
+	if logger, err := newLogger(cfg.Logging, configSecrets(cfg), logOutput); err == nil {
+		slog.SetDefault(logger)
+	}
+	slog.Info("Config reloaded", "file", r.path, "commands", len(cfg.Commands))
+	if sections := restartSections(r.started, cfg); len(sections) > 0 {
+		slog.Warn("config changes not applied until the bot restarts", "sections", sections)
+	}
+	return nil
+}
+
+// restartSections returns the names of the sections of cfg that differ
+// from old, other than the commands and logging reload applies
+func restartSections(old, cfg *Config) []string {
+	var sections []string
+	ov, nv := reflect.ValueOf(*old), reflect.ValueOf(*cfg)
+	for i := range ov.NumField() {
+		name, _, _ := strings.Cut(ov.Type().Field(i).Tag.Get("yaml"), ",")
+		if name == "commands" || name == "logging" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			sections = append(sections, name)
+		}
+	}
+	return sections
+}
+
+// Run reloads on SIGHUP and, if watch is set, on changes to the config file
+// until the context is cancelled
+func (r *configReloader) Run(ctx context.Context, watch bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			slog.Warn("config watch disabled", "error", err)
+		} else {
+			defer func() {
+				if err := watcher.Close(); err != nil {
+					slog.Warn("error closing config watcher", "error", err)
+				}
+			}()
+			// Watch the directory: editors and config management tools usually
+			// replace the file instead of writing to it in place
+			if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+				slog.Warn("config watch disabled", "error", err)
+			} else {
+				events = watcher.Events
+				errs = watcher.Errors
+			}
+		}
+	}
+
+	// Fires after the last file event of a burst
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("SIGHUP received. Reloading config")
+			_ = r.reload()
+		case ev := <-events:
+			if filepath.Clean(ev.Name) != filepath.Clean(r.path) {
+				continue
+			}
+			if ev.Has(fsnotify.Write) || ev.Has(fsnotify.Create) || ev.Has(fsnotify.Rename) {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			slog.Info("Config file changed. Reloading config")
+			_ = r.reload()
+		case err := <-errs:
+			slog.Warn("config watch error", "error", err)
+		}
+	}
+}
+
+// notifyAdmins sends a message to every recipient listed in cfg.Admins.
+// Chat recipients are skipped without a messaging provider.
+func notifyAdmins(sender messaging.MessageSender, cfg *Config, text string) {
+	if cfg == nil {
+		return
+	}
+	for _, name := range cfg.Admins {
+		recipient, ok := cfg.Recipients[name]
+		if !ok {
+			slog.Error("unknown admin recipient", "recipient", name)
+			continue
+		}
+		err := notifyRecipient(sender, recipient, "rpi-bot", text)
+		if err != nil && !errors.Is(err, errNoProvider) {
+			slog.Error("error notifying admin", "recipient", name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestCommandTable(t *testing.T) {
+	table := newCommandTable(map[string]Command{"status": {Command: "uptime"}})
+
+	c, ok := table.Get("status")
+	require.True(t, ok)
+	require.Equal(t, "uptime", c.Command)
+
+	table.Swap(map[string]Command{"disk": {Command: "df -h"}})
+	_, ok = table.Get("status")
+	require.False(t, ok)
+	_, ok = table.Get("disk")
+	require.True(t, ok)
+
+	table.Swap(nil)
+	_, ok = table.Get("disk")
+	require.False(t, ok)
+}
+
+func TestConfigReloader_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+commands:
+  status:
+    command: echo up
+recipients:
+  ops:
+    chatId: 42
+admins: [ops]
+`)
+	cfg, err := NewConfig(path)
+	require.NoError(t, err)
+
+	sender := new(MockMessageClient)
+	sender.On("SendMessage", mock.Anything, messaging.Message{ChatID: 42}).Return(nil)
+
+	table := newCommandTable(cfg.Commands)
+	r := newConfigReloader(path, cfg, table, sender)
+
+	// A valid file swaps the table
+	writeConfig(t, path, `
+commands:
+  disk:
+    command: echo df
+recipients:
+  ops:
+    chatId: 42
+admins: [ops]
+`)
+	require.NoError(t, r.reload())
+	_, ok := table.Get("disk")
+	require.True(t, ok)
+	_, ok = table.Get("status")
+	require.False(t, ok)
+	sender.AssertNotCalled(t, "SendMessage", mock.Anything, mock.Anything)
+
+	// An invalid file keeps the previous table and notifies admins
+	writeConfig(t, path, "commands: [not, a, map")
+	require.Error(t, r.reload())
+	_, ok = table.Get("disk")
+	require.True(t, ok)
+	sender.AssertNumberOfCalls(t, "SendMessage", 1)
+}
+
+func TestRestartSections(t *testing.T) {
+	old := &Config{
+		Commands: map[string]Command{"status": {Command: "uptime"}},
+		Admins:   []string{"ops"},
+		Httpd:    HttpdConfig{Enabled: true, Addr: ":8080"},
+	}
+	cfg := &Config{
+		Commands: map[string]Command{"disk": {Command: "df"}},
+		Admins:   []string{"ops"},
+		Httpd:    HttpdConfig{Enabled: true, Addr: ":8080"},
+		Logging:  LoggingConfig{Level: "debug"},
+	}
+	assert.Empty(t, restartSections(old, cfg), "commands and logging are reloaded")
+
+	cfg.Admins = []string{"ops", "oncall"}
+	cfg.Httpd.Addr = ":9090"
+	assert.Equal(t, []string{"httpd", "admins"}, restartSections(old, cfg))
+}
+
+func TestConfigReloader_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "commands:\n  status:\n    command: echo up\n")
+	cfg, err := NewConfig(path)
+	require.NoError(t, err)
+
+	table := newCommandTable(cfg.Commands)
+	r := newConfigReloader(path, cfg, table, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go r.Run(ctx, true, &wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// Give the watcher time to start before touching the file
+	time.Sleep(100 * time.Millisecond)
+	writeConfig(t, path, "commands:\n  disk:\n    command: echo df\n")
+
+	require.Eventually(t, func() bool {
+		_, ok := table.Get("disk")
+		return ok
+	}, 3*time.Second, 50*time.Millisecond)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// sandboxArg is the hidden first argument the bot re-executes itself with
+// to apply limits and restrictions before executing a command, see
+// runSandbox
+const sandboxArg = "__sandbox"
+
+var errSandboxUnsupported = errors.New("limits and sandboxing are only supported on Linux")
+
+// maybeRunSandbox executes the sandboxed command if the process was
+// started as the sandbox trampoline. It must run before anything else in
+// main, and doesn't return in that case.
+func maybeRunSandbox() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxArg {
+		runSandbox(os.Args[2:])
+	}
+}
+
+// sandboxSpec is what the trampoline applies before executing the command
+type sandboxSpec struct {
+	CPUSeconds      int         `json:"cpuSeconds,omitempty"`
+	MemoryMB        int         `json:"memoryMB,omitempty"`
+	OpenFiles       int         `json:"openFiles,omitempty"`
+	NoNewPrivileges bool        `json:"noNewPrivileges,omitempty"`
+	ReadOnly        bool        `json:"readOnly,omitempty"`
+	Writable        []string    `json:"writable,omitempty"`
+	Credential      *credential `json:"credential,omitempty"`
+}
+
+// sandboxed reports whether the command must be started through the
+// trampoline. The output limit is enforced by the executor itself, and the
+// memory limit too when it's enforced by a cgroup.
+func (c Command) sandboxed(cgroup bool) bool {
+	l, s := c.Limits, c.Sandbox
+	return l.CPUSeconds > 0 || (l.MemoryMB > 0 && !cgroup) || l.OpenFiles > 0 ||
+		s.NoNewPrivileges || s.ReadOnly || s.NoNetwork
+}
+
+// limitError is returned when a command is stopped for exceeding one of
+// its limits, as opposed to failing on its own
+type limitError struct {
+	limit string // e.g. "cpu time limit of 10s"
+}
+
+func (e *limitError) Error() string { return e.limit + " exceeded" }
+
+// outputBuffer collects the combined output of a command up to max bytes,
+// calling exceeded once when more is written. A zero max is unlimited.
+type outputBuffer struct {
+	max      int
+	exceeded func()
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	over bool
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.over {
+		return len(p), nil
+	}
+	if b.max > 0 && b.buf.Len()+len(p) > b.max {
+		b.buf.Write(p[:b.max-b.buf.Len()])
+		b.over = true
+		if b.exceeded != nil {
+			b.exceeded()
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *outputBuffer) overflowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.over
+}
+
+func (b *outputBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func outputLimitError(max int) error {
+	return &limitError{limit: fmt.Sprintf("output limit of %d bytes", max)}
+}
@@ -0,0 +1,319 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxCommand makes cmd start through the trampoline, which applies the
+// limits and restrictions of c and the credential, if any, then executes
+// the original command
+func sandboxCommand(cmd *exec.Cmd, c Command, cred *credential, cgroup bool) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	spec := sandboxSpec{
+		CPUSeconds:      c.Limits.CPUSeconds,
+		OpenFiles:       c.Limits.OpenFiles,
+		NoNewPrivileges: c.Sandbox.NoNewPrivileges,
+		ReadOnly:        c.Sandbox.ReadOnly,
+		Writable:        c.Sandbox.Writable,
+		Credential:      cred,
+	}
+	if !cgroup {
+		spec.MemoryMB = c.Limits.MemoryMB
+	}
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+
+	// The original path is resolved already, with the bot's PATH
+	cmd.Args = append([]string{cmd.Args[0], sandboxArg, string(encoded), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = self
+	attr := &syscall.SysProcAttr{}
+	if c.Sandbox.ReadOnly {
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if c.Sandbox.NoNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// runSandbox is the trampoline: it applies the spec to its own process and
+// executes the command, replacing itself. args are the spec, the command
+// path and its arguments.
+func runSandbox(args []string) {
+	if err := execSandboxed(args); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+		os.Exit(126)
+	}
+}
+
+func execSandboxed(args []string) error {
+	if len(args) < 2 {
+		return errors.New("missing spec or command")
+	}
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(args[0]), &spec); err != nil {
+		return err
+	}
+	// no_new_privs is set per thread, on the one executing the command
+	runtime.LockOSThread()
+
+	if spec.ReadOnly {
+		if err := remountReadOnly(spec.Writable); err != nil {
+			return fmt.Errorf("read-only mounts: %w", err)
+		}
+	}
+	if cred := spec.Credential; cred != nil {
+		if cred.Groups != nil {
+			groups := make([]int, len(cred.Groups))
+			for i, g := range cred.Groups {
+				groups[i] = int(g)
+			}
+			if err := syscall.Setgroups(groups); err != nil {
+				return fmt.Errorf("setgroups: %w", err)
+			}
+		}
+		if err := syscall.Setgid(int(cred.GID)); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+		if err := syscall.Setuid(int(cred.UID)); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	if spec.CPUSeconds > 0 {
+		// SIGXCPU at the soft limit, SIGKILL a second later if it's ignored
+		cpu := uint64(spec.CPUSeconds)
+		if err := unix.Setrlimit(unix.RLIMIT_CPU, &unix.Rlimit{Cur: cpu, Max: cpu + 1}); err != nil {
+			return fmt.Errorf("cpu limit: %w", err)
+		}
+	}
+	if spec.MemoryMB > 0 {
+		memory := uint64(spec.MemoryMB) << 20
+		if err := unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: memory, Max: memory}); err != nil {
+			return fmt.Errorf("memory limit: %w", err)
+		}
+	}
+	if spec.OpenFiles > 0 {
+		files := uint64(spec.OpenFiles)
+		if err := unix.Setrlimit(unix.RLIMIT_NOFILE, &unix.Rlimit{Cur: files, Max: files}); err != nil {
+			return fmt.Errorf("open files limit: %w", err)
+		}
+	}
+	if spec.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("no new privileges: %w", err)
+		}
+	}
+	path, argv := args[1], append([]string{args[1]}, args[2:]...)
+	return syscall.Exec(path, argv, os.Environ())
+}
+
+// remountReadOnly makes every mount of the private mount namespace
+// read-only, except the writable paths. Pseudo filesystems are left alone.
+func remountReadOnly(writable []string) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	// Writable paths become mounts of their own, left as they are below
+	for _, path := range writable {
+		if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m.pseudo() || underAny(m.point, writable) {
+			continue
+		}
+		flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+		for _, opt := range m.options {
+			switch opt {
+			case "nosuid":
+				flags |= unix.MS_NOSUID
+			case "nodev":
+				flags |= unix.MS_NODEV
+			case "noexec":
+				flags |= unix.MS_NOEXEC
+			}
+		}
+		if err := unix.Mount("", m.point, "", flags, ""); err != nil {
+			return fmt.Errorf("%s: %w", m.point, err)
+		}
+	}
+	// The working directory may have been mounted over
+	if wd, err := os.Getwd(); err == nil {
+		_ = os.Chdir(wd)
+	}
+	return nil
+}
+
+type mount struct {
+	point   string
+	options []string
+}
+
+// pseudo reports whether the mount is part of /proc, /sys or /dev
+func (m mount) pseudo() bool {
+	return underAny(m.point, []string{"/proc", "/sys", "/dev"})
+}
+
+// readMounts lists the mounts of the process namespace
+func readMounts() ([]mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	var mounts []mount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mounts = append(mounts, mount{
+			point:   unescapeMount(fields[4]),
+			options: strings.Split(fields[5], ","),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes of mountinfo, e.g. \040 for spaces
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// underAny reports whether path is one of dirs or below one of them
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// commandCgroup is a transient cgroup v2 a single command runs in
+type commandCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newCommandCgroup creates a child of the delegated cgroup parent with the
+// memory limit. Swap is disabled too, when the kernel supports it, so the
+// limit can't be escaped by swapping.
+func newCommandCgroup(parent string, memoryMB int) (*commandCgroup, error) {
+	dir, err := os.MkdirTemp(parent, "cmd-")
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	cg := &commandCgroup{dir: dir}
+	memory := strconv.FormatInt(int64(memoryMB)<<20, 10)
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(memory), 0o644); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	_ = os.WriteFile(filepath.Join(dir, "memory.swap.max"), []byte("0"), 0o644)
+	if cg.fd, err = os.Open(dir); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("cgroup: %w", err)
+	}
+	return cg, nil
+}
+
+// attach makes the command start in the cgroup
+func (cg *commandCgroup) attach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+}
+
+// oomKilled reports whether a process of the cgroup was killed for
+// exceeding the memory limit
+func (cg *commandCgroup) oomKilled() bool {
+	data, err := os.ReadFile(filepath.Join(cg.dir, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if count, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.Atoi(count)
+			return n > 0
+		}
+	}
+	return false
+}
+
+// remove kills what the command left behind and deletes the cgroup
+func (cg *commandCgroup) remove() {
+	if cg.fd != nil {
+		_ = cg.fd.Close()
+	}
+	_ = os.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0o644)
+	for range 10 {
+		// Fails while the killed processes are being reaped
+		if err := os.Remove(cg.dir); err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	slog.Warn("cgroup: could not remove", "dir", cg.dir)
+}
+
+// cpuLimitExceeded reports whether the process was killed by its CPU time
+// limit, SIGXCPU at the soft limit or SIGKILL at the hard one
+func cpuLimitExceeded(state *os.ProcessState, cpuSeconds int) bool {
+	if state == nil || cpuSeconds <= 0 {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	used := state.UserTime() + state.SystemTime()
+	return status.Signal() == syscall.SIGXCPU ||
+		(status.Signal() == syscall.SIGKILL && used >= time.Duration(cpuSeconds)*time.Second)
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecutor_Limits(t *testing.T) {
+	e := &executor{}
+
+	output, err := e.execCommand("cat /proc/self/limits", Command{
+		Limits: CommandLimits{CPUSeconds: 5, MemoryMB: 512, OpenFiles: 64},
+	})
+	require.NoError(t, err)
+	assert.Regexp(t, `Max cpu time\s+5\s+6\s+seconds`, output)
+	assert.Regexp(t, `Max address space\s+536870912\s+536870912\s+bytes`, output)
+	assert.Regexp(t, `Max open files\s+64\s+64\s+files`, output)
+
+	output, err = e.execCommand("grep NoNewPrivs /proc/self/status", Command{
+		Sandbox: SandboxConfig{NoNewPrivileges: true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "NoNewPrivs:\t1", strings.TrimSpace(output))
+
+	var limitErr *limitError
+	_, err = e.execCommand("yes", Command{Limits: CommandLimits{OutputBytes: 1000}})
+	require.True(t, errors.As(err, &limitErr), "got %v", err)
+	assert.EqualError(t, err, "output limit of 1000 bytes exceeded")
+
+	_, err = e.execCommand("sha256sum /dev/zero", Command{Limits: CommandLimits{CPUSeconds: 1}})
+	require.True(t, errors.As(err, &limitErr), "got %v", err)
+	assert.EqualError(t, err, "cpu time limit of 1s exceeded")
+
+	// An ordinary failure isn't reported as a limit
+	_, err = e.execCommand("false", Command{Limits: CommandLimits{CPUSeconds: 1}})
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &limitErr))
+}
+
+func TestExecutor_SandboxedRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running as another user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	output, err := (&executor{}).execCommand("id -u", Command{
+		User:    "nobody",
+		Sandbox: SandboxConfig{NoNewPrivileges: true},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, nobody.Uid, strings.TrimSpace(output))
+}
+
+func TestExecutor_ReadOnly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mount namespaces require root")
+	}
+	dir := t.TempDir()
+	writable := filepath.Join(dir, "writable")
+	require.NoError(t, os.Mkdir(writable, 0o755))
+	e := &executor{}
+
+	_, err := e.execCommand("touch "+filepath.Join(dir, "file"), Command{
+		Sandbox: SandboxConfig{ReadOnly: true, Writable: []string{writable}},
+	})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("mount namespaces not permitted here")
+	}
+	require.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(dir, "file"))
+
+	_, err = e.execCommand("touch "+filepath.Join(writable, "file"), Command{
+		Sandbox: SandboxConfig{ReadOnly: true, Writable: []string{writable}},
+	})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(writable, "file"))
+}
+
+func TestCommandCgroup_OOMKilled(t *testing.T) {
+	dir := t.TempDir()
+	cg := &commandCgroup{dir: dir}
+	assert.False(t, cg.oomKilled(), "no events file")
+
+	events := "low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.events"), []byte(events), 0o644))
+	assert.False(t, cg.oomKilled())
+
+	events = strings.Replace(events, "oom_kill 0", "oom_kill 1", 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "memory.events"), []byte(events), 0o644))
+	assert.True(t, cg.oomKilled())
+}
+
+func TestMountHelpers(t *testing.T) {
+	assert.Equal(t, "/mnt/usb disk", unescapeMount(`/mnt/usb\040disk`))
+	assert.Equal(t, `/odd\path`, unescapeMount(`/odd\path`))
+
+	assert.True(t, underAny("/srv/data", []string{"/srv/data"}))
+	assert.True(t, underAny("/srv/data/cache", []string{"/srv/data/"}))
+	assert.False(t, underAny("/srv/database", []string{"/srv/data"}))
+	assert.True(t, (mount{point: "/proc/sys"}).pseudo())
+}
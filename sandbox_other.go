@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func sandboxCommand(*exec.Cmd, Command, *credential, bool) error {
+	return errSandboxUnsupported
+}
+
+func runSandbox([]string) {
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", errSandboxUnsupported)
+	os.Exit(126)
+}
+
+type commandCgroup struct{}
+
+func newCommandCgroup(string, int) (*commandCgroup, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (*commandCgroup) attach(*exec.Cmd) {}
+func (*commandCgroup) oomKilled() bool  { return false }
+func (*commandCgroup) remove()          {}
+
+func cpuLimitExceeded(*os.ProcessState, int) bool { return false }
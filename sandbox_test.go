@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain lets the test binary act as the sandbox trampoline, as the bot
+// re-executes itself
+func TestMain(m *testing.M) {
+	maybeRunSandbox()
+	os.Exit(m.Run())
+}
+
+func TestOutputBuffer(t *testing.T) {
+	calls := 0
+	b := &outputBuffer{max: 5, exceeded: func() { calls++ }}
+	n, err := b.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.False(t, b.overflowed())
+
+	_, _ = b.Write([]byte("defg"))
+	_, _ = b.Write([]byte("hij"))
+	assert.True(t, b.overflowed())
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "abcde", b.String())
+
+	unlimited := &outputBuffer{}
+	_, _ = unlimited.Write(make([]byte, 1<<20))
+	assert.False(t, unlimited.overflowed())
+}
+
+// limitedExecutor fails every command as stopped by a limit
+type limitedExecutor struct{}
+
+func (limitedExecutor) execCommand(string, Command) (string, error) {
+	return "", outputLimitError(1024)
+}
+
+func TestDispatcher_LimitExceeded(t *testing.T) {
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{"logs": {Command: "journalctl"}}),
+		executor: limitedExecutor{},
+		audit:    audit,
+	}
+	reply := chatReply(d, messaging.Message{Provider: "telegram", Command: "logs"})
+	assert.Equal(t, "Command logs stopped: output limit of 1024 bytes exceeded", reply)
+
+	entries, err := audit.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, outcomeLimitExceeded, entries[0].Outcome)
+	assert.Equal(t, "output limit of 1024 bytes exceeded", entries[0].Error)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// filePrefix marks a config value that must be read from a file, e.g.
+// `apiToken: file:/run/credentials/rpi-bot/telegram`
+const filePrefix = "file:"
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveSecrets walks every string in the config, expanding ${ENV_VAR}
+// references and replacing `file:` references with the content of the file.
+// All problems found are reported at once.
+func resolveSecrets(cfg *Config) error {
+	return errors.Join(resolveValue(reflect.ValueOf(cfg).Elem(), "")...)
+}
+
+func resolveValue(v reflect.Value, path string) []error {
+	switch v.Kind() {
+	case reflect.String:
+		resolved, err := resolveString(v.String())
+		if err != nil {
+			return []error{fmt.Errorf("%s: %w", path, err)}
+		}
+		v.SetString(resolved)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveValue(v.Elem(), path)
+		}
+	case reflect.Struct:
+		var errs []error
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			errs = append(errs, resolveValue(v.Field(i), joinPath(path, yamlName(t.Field(i))))...)
+		}
+		return errs
+	case reflect.Slice:
+		var errs []error
+		for i := 0; i < v.Len(); i++ {
+			errs = append(errs, resolveValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return errs
+	case reflect.Map:
+		var errs []error
+		iter := v.MapRange()
+		for iter.Next() {
+			// Map values aren't addressable: resolve a copy and store it back
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			errs = append(errs, resolveValue(elem, joinPath(path, fmt.Sprint(iter.Key())))...)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+		return errs
+	}
+	return nil
+}
+
+// resolveString expands a single config value
+func resolveString(s string) (string, error) {
+	var missing []string
+	s = envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("ENV var `%s` not found", strings.Join(missing, "`, `"))
+	}
+
+	if strings.HasPrefix(s, filePrefix) {
+		return readSecretFile(strings.TrimPrefix(s, filePrefix))
+	}
+	return s, nil
+}
+
+// readSecretFile returns the content of a secret file without the trailing
+// newline, warning if the file can be read by anyone
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0o004 != 0 {
+		slog.Warn("secret file is world-readable", "file", path, "mode", info.Mode().Perm().String())
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveString(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "telegram")
+	require.NoError(t, os.WriteFile(secretFile, []byte("s3cr3t\n"), 0o600))
+	t.Setenv("RPI_BOT_TEST_HOST", "pi.local")
+	t.Setenv("RPI_BOT_TEST_DIR", dir)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "plain value", value: "plain", want: "plain"},
+		{name: "env var", value: "${RPI_BOT_TEST_HOST}", want: "pi.local"},
+		{name: "env var inside text", value: "ping -c1 ${RPI_BOT_TEST_HOST}", want: "ping -c1 pi.local"},
+		{name: "file", value: "file:" + secretFile, want: "s3cr3t"},
+		{name: "file path from env var", value: "file:${RPI_BOT_TEST_DIR}/telegram", want: "s3cr3t"},
+		{name: "not a reference", value: "$HOME", want: "$HOME"},
+		{
+			name:    "missing env var",
+			value:   "${RPI_BOT_TEST_MISSING}",
+			wantErr: "ENV var `RPI_BOT_TEST_MISSING` not found",
+		},
+		{
+			name:    "missing file",
+			value:   "file:" + filepath.Join(dir, "missing"),
+			wantErr: "no such file or directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveString(tt.value)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(secretFile, []byte("http-token"), 0o600))
+	t.Setenv("RPI_BOT_TEST_TOKEN", "tg-token")
+	t.Setenv("RPI_BOT_TEST_SOURCE", "+15551234567")
+
+	cfg := &Config{
+		Commands: map[string]Command{
+			"ping": {Command: "ping -c1 ${RPI_BOT_TEST_SOURCE}"},
+		},
+		Telegram: TelegramConfig{ApiToken: "${RPI_BOT_TEST_TOKEN}"},
+		Signal:   SignalConfig{Sources: []string{"${RPI_BOT_TEST_SOURCE}"}},
+		Httpd:    HttpdConfig{AuthToken: "file:" + secretFile},
+		Webhooks: []WebhookConfig{{Auth: WebhookAuth{Secret: "${RPI_BOT_TEST_MISSING}"}}},
+	}
+
+	err := resolveSecrets(cfg)
+	require.EqualError(t, err, "webhooks[0].auth.secret: ENV var `RPI_BOT_TEST_MISSING` not found")
+
+	require.Equal(t, "tg-token", cfg.Telegram.ApiToken)
+	require.Equal(t, []string{"+15551234567"}, cfg.Signal.Sources)
+	require.Equal(t, "http-token", cfg.Httpd.AuthToken)
+	require.Equal(t, "ping -c1 +15551234567", cfg.Commands["ping"].Command)
+}
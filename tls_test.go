@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues client certificates for the mTLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	cfg := TLSConfig{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		SelfSigned: true,
+	}
+	require.NoError(t, ensureSelfSigned(cfg, "192.168.1.10:8443"))
+
+	info, err := os.Stat(cfg.KeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	require.NoError(t, err)
+	assert.Contains(t, cert.DNSNames, "localhost")
+	assert.NoError(t, cert.VerifyHostname("192.168.1.10"))
+	assert.NoError(t, cert.VerifyHostname("127.0.0.1"))
+
+	// Existing files are kept
+	before, err := os.ReadFile(cfg.CertFile)
+	require.NoError(t, err)
+	require.NoError(t, ensureSelfSigned(cfg, ":8443"))
+	after, err := os.ReadFile(cfg.CertFile)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(hosts []string, mod time.Time) {
+		certPEM, keyPEM, err := generateSelfSigned(hosts, time.Now())
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(certFile, certPEM, 0o644))
+		require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+		require.NoError(t, os.Chtimes(certFile, mod, mod))
+		require.NoError(t, os.Chtimes(keyFile, mod, mod))
+	}
+	dnsName := func(c *tls.Certificate) string {
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		require.NoError(t, err)
+		return leaf.DNSNames[0]
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write([]string{"first.example"}, start)
+	r, err := newCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	c, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first.example", dnsName(c))
+
+	write([]string{"renewed.example"}, start.Add(time.Minute))
+	c, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "renewed.example", dnsName(c))
+
+	// A broken file keeps the previous certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o644))
+	c, err = r.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "renewed.example", dnsName(c))
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o644))
+
+	cfg := &Config{Httpd: HttpdConfig{
+		AuthToken: "secret",
+		TLS: TLSConfig{
+			CertFile:   filepath.Join(dir, "cert.pem"),
+			KeyFile:    filepath.Join(dir, "key.pem"),
+			SelfSigned: true,
+			ClientCA:   caFile,
+			Clients: map[string]TLSClient{
+				"backup.lan": {Identity: "backup-job", Commands: []string{"status"}},
+			},
+		},
+	}}
+	require.NoError(t, ensureSelfSigned(cfg.Httpd.TLS, "127.0.0.1:0"))
+	tlsCfg, err := serverTLSConfig(cfg.Httpd.TLS)
+	require.NoError(t, err)
+
+	audit := newTestAuditLog(t, AuditConfig{})
+	d := &dispatcher{
+		commands: newCommandTable(map[string]Command{
+			"status": {Command: "uptime"},
+			"disk":   {Command: "df"},
+		}),
+		executor: &mockExecutor{},
+		audit:    audit,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: setupMux(cfg, &httpCommandHandler{dispatcher: d}, nil), TLSConfig: tlsCfg}
+	go func() { _ = srv.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	serverCert, err := os.ReadFile(cfg.Httpd.TLS.CertFile)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(serverCert))
+
+	get := func(clientCert *tls.Certificate, path, token string) (int, error) {
+		tlsClient := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			tlsClient.Certificates = []tls.Certificate{*clientCert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsClient}}
+		req, err := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+path, nil)
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	backup := ca.issue(t, "backup.lan")
+	stranger := ca.issue(t, "stranger.lan")
+	forged := newTestCA(t).issue(t, "backup.lan")
+
+	tests := []struct {
+		name     string
+		cert     *tls.Certificate
+		path     string
+		token    string
+		wantCode int
+		wantErr  bool
+	}{
+		{name: "no certificate nor token", path: "/cmd/status", wantCode: http.StatusUnauthorized},
+		{name: "token without certificate", path: "/cmd/disk", token: "secret", wantCode: http.StatusOK},
+		{name: "mapped certificate", cert: &backup, path: "/cmd/status", wantCode: http.StatusOK},
+		{name: "command not allowed for the identity", cert: &backup, path: "/cmd/disk", wantCode: http.StatusForbidden},
+		{name: "unmapped certificate needs a token", cert: &stranger, path: "/cmd/status", wantCode: http.StatusUnauthorized},
+		{name: "certificate from another CA", cert: &forged, path: "/cmd/status", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := get(tt.cert, tt.path, tt.token)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCode, code)
+		})
+	}
+
+	entries, err := audit.Recent(10)
+	require.NoError(t, err)
+	var callers []string
+	for _, e := range entries {
+		if e.Caller == "backup-job" {
+			callers = append(callers, e.Command+":"+e.Outcome)
+		}
+	}
+	assert.Equal(t, []string{"status:" + outcomeOK, "disk:" + outcomeUnauthorized}, callers)
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"rpi-bot/messaging"
+)
+
+// reservedPaths are served by the HTTP server itself and can't be used by
+// webhooks. Those ending with / are reserved with every path under them.
+var reservedPaths = []string{
+	"/cmd/", "/commands", "/health", "/health/live", "/health/ready", "/audit",
+	"/history", "/last/", "/rerun/", "/metrics",
+}
+
+// validateConfig checks the whole configuration up front and reports every
+// problem found at once, instead of failing at runtime when a command is called
+func validateConfig(cfg *Config) error {
+	var errs []error
+	errs = append(errs, validateCommands(cfg.Commands)...)
+	errs = append(errs, validateProvider(cfg)...)
+	errs = append(errs, validateHttpd(cfg)...)
+	errs = append(errs, validateMetrics(cfg)...)
+	errs = append(errs, validateWebhooks(cfg)...)
+	errs = append(errs, validateFleet(cfg)...)
+	errs = append(errs, validateDiscovery(cfg)...)
+	if _, err := newLogger(cfg.Logging, nil, io.Discard); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Health.MaxPollAgeSeconds < 0 {
+		errs = append(errs, fmt.Errorf("health: maxPollAgeSeconds must not be negative"))
+	}
+	if cfg.Prompts.TimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("prompts: timeoutSeconds must not be negative"))
+	}
+	if cfg.Executor.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("executor: maxConcurrent must not be negative"))
+	}
+	if cfg.Executor.Cgroup != "" {
+		if err := validateCgroup(cfg.Executor.Cgroup); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateRateLimit(cfg.RateLimit.Global); err != nil {
+		errs = append(errs, fmt.Errorf("rateLimit.global: %w", err))
+	}
+	if err := validateRateLimit(cfg.RateLimit.PerCaller); err != nil {
+		errs = append(errs, fmt.Errorf("rateLimit.perCaller: %w", err))
+	}
+	for _, name := range cfg.Admins {
+		if _, ok := cfg.Recipients[name]; !ok {
+			errs = append(errs, fmt.Errorf("admins: unknown recipient %q", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateCommands(commands map[string]Command) []error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(commands)) {
+		c := commands[name]
+		if name == "" || strings.ContainsAny(name, " /@") {
+			errs = append(errs, fmt.Errorf("command %q: name must not be empty or contain spaces, slashes or @", name))
+		}
+		if _, ok := builtins[name]; ok {
+			errs = append(errs, fmt.Errorf("command %q: name is reserved by a builtin command", name))
+		}
+		fields := strings.Fields(c.Command)
+		if len(fields) == 0 {
+			errs = append(errs, fmt.Errorf("command %q: empty command", name))
+			continue
+		}
+		if _, err := exec.LookPath(fields[0]); err != nil {
+			errs = append(errs, fmt.Errorf("command %q: %w", name, err))
+		}
+		if placeholders := strings.Count(c.Command, "%s"); placeholders != len(c.Args) {
+			errs = append(errs, fmt.Errorf(
+				"command %q: mismatch between placeholders (%%s)=%d and number of args=%d",
+				name, placeholders, len(c.Args),
+			))
+		}
+		seen := make(map[string]bool, len(c.Args))
+		for _, arg := range c.Args {
+			if arg == "" {
+				errs = append(errs, fmt.Errorf("command %q: empty arg name", name))
+				continue
+			}
+			if seen[arg] {
+				errs = append(errs, fmt.Errorf("command %q: duplicated arg %q", name, arg))
+			}
+			seen[arg] = true
+		}
+		for _, arg := range c.SensitiveArgs {
+			if !seen[arg] {
+				errs = append(errs, fmt.Errorf("command %q: unknown sensitive arg %q", name, arg))
+			}
+		}
+		for _, arg := range slices.Sorted(maps.Keys(c.ArgSpecs)) {
+			if !seen[arg] {
+				errs = append(errs, fmt.Errorf("command %q: argSpecs: unknown arg %q", name, arg))
+			}
+			if slices.Contains(c.ArgSpecs[arg].Values, "") {
+				errs = append(errs, fmt.Errorf("command %q: argSpecs %q: empty value", name, arg))
+			}
+		}
+		if err := validateRateLimit(c.RateLimit); err != nil {
+			errs = append(errs, fmt.Errorf("command %q: rateLimit: %w", name, err))
+		}
+		if c.Workdir != "" {
+			if info, err := os.Stat(c.Workdir); err != nil {
+				errs = append(errs, fmt.Errorf("command %q: workdir: %w", name, err))
+			} else if !info.IsDir() {
+				errs = append(errs, fmt.Errorf("command %q: workdir %s is not a directory", name, c.Workdir))
+			}
+		}
+		for _, env := range slices.Sorted(maps.Keys(c.Env)) {
+			if env == "" || strings.ContainsAny(env, "= ") {
+				errs = append(errs, fmt.Errorf("command %q: invalid env variable name %q", name, env))
+			}
+		}
+		if len(c.InheritEnv) > 0 && !c.ClearEnv {
+			errs = append(errs, fmt.Errorf("command %q: inheritEnv requires clearEnv", name))
+		}
+		if c.User != "" || c.Group != "" {
+			if _, err := lookupCredential(c.User, c.Group); err != nil {
+				errs = append(errs, fmt.Errorf("command %q: %w", name, err))
+			}
+		}
+		for _, err := range validateSandbox(c) {
+			errs = append(errs, fmt.Errorf("command %q: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// validateSandbox checks the limits and sandbox settings of a command
+func validateSandbox(c Command) []error {
+	var errs []error
+	l := c.Limits
+	if l.CPUSeconds < 0 || l.MemoryMB < 0 || l.OpenFiles < 0 || l.OutputBytes < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+	if c.sandboxed(false) && runtime.GOOS != "linux" {
+		errs = append(errs, errSandboxUnsupported)
+	}
+	if len(c.Sandbox.Writable) > 0 && !c.Sandbox.ReadOnly {
+		errs = append(errs, errors.New("sandbox: writable requires readOnly"))
+	}
+	for _, path := range c.Sandbox.Writable {
+		if !filepath.IsAbs(path) || filepath.Clean(path) == "/" {
+			errs = append(errs, fmt.Errorf("sandbox: writable path %q must be absolute and not /", path))
+		} else if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("sandbox: %w", err))
+		}
+	}
+	return errs
+}
+
+// validateCgroup checks the cgroup commands are created in lets them have
+// a memory limit
+func validateCgroup(dir string) error {
+	controllers, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return fmt.Errorf("executor.cgroup: %w", err)
+	}
+	if !slices.Contains(strings.Fields(string(controllers)), "memory") {
+		return fmt.Errorf("executor.cgroup: the memory controller isn't enabled in %s/cgroup.subtree_control", dir)
+	}
+	return nil
+}
+
+// validateRateLimit checks a token bucket can hold at least one request
+func validateRateLimit(l RateLimit) error {
+	switch {
+	case l.PerMinute < 0 || l.Burst < 0:
+		return errors.New("perMinute and burst must not be negative")
+	case l.PerMinute > 0 && l.Burst == 0:
+		return errors.New("burst must be at least 1")
+	}
+	return nil
+}
+
+func validateProvider(cfg *Config) []error {
+	var errs []error
+	switch cfg.Provider {
+	case "":
+	case "telegram":
+		if _, exists := GetSecret("TELEGRAM_APITOKEN", cfg.Telegram.ApiToken); !exists {
+			errs = append(errs, fmt.Errorf("telegram: no apiToken set and ENV var `TELEGRAM_APITOKEN` not found"))
+		}
+	case "signal":
+		if cfg.Signal.Socket == "" {
+			errs = append(errs, fmt.Errorf("signal: socket is required"))
+		}
+		if len(cfg.Signal.Sources) == 0 {
+			errs = append(errs, fmt.Errorf("signal: at least one source is required"))
+		}
+	case "matrix":
+		if u, err := url.Parse(cfg.Matrix.Homeserver); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("matrix: homeserver must be an http(s) URL"))
+		}
+		if _, exists := GetSecret("MATRIX_ACCESSTOKEN", cfg.Matrix.AccessToken); !exists {
+			errs = append(errs, fmt.Errorf("matrix: no accessToken set and ENV var `MATRIX_ACCESSTOKEN` not found"))
+		}
+		if len(cfg.Matrix.Rooms) == 0 && len(cfg.Matrix.Users) == 0 {
+			errs = append(errs, fmt.Errorf("matrix: at least one allowed room or user is required"))
+		}
+	case "mqtt":
+		errs = append(errs, validateMQTT(cfg.MQTT)...)
+	case "email":
+		errs = append(errs, validateEmail(cfg.Email)...)
+	case "slack":
+		if _, exists := GetSecret("SLACK_APPTOKEN", cfg.Slack.AppToken); !exists {
+			errs = append(errs, fmt.Errorf("slack: no appToken set and ENV var `SLACK_APPTOKEN` not found"))
+		}
+		if _, exists := GetSecret("SLACK_BOTTOKEN", cfg.Slack.BotToken); !exists {
+			errs = append(errs, fmt.Errorf("slack: no botToken set and ENV var `SLACK_BOTTOKEN` not found"))
+		}
+		if len(cfg.Slack.Channels) == 0 && len(cfg.Slack.Users) == 0 {
+			errs = append(errs, fmt.Errorf("slack: at least one allowed channel or user is required"))
+		}
+	case "mattermost":
+		if u, err := url.Parse(cfg.Mattermost.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("mattermost: url must be an http(s) URL"))
+		}
+		if _, exists := GetSecret("MATTERMOST_TOKEN", cfg.Mattermost.Token); !exists {
+			errs = append(errs, fmt.Errorf("mattermost: no token set and ENV var `MATTERMOST_TOKEN` not found"))
+		}
+		if len(cfg.Mattermost.Channels) == 0 && len(cfg.Mattermost.Users) == 0 {
+			errs = append(errs, fmt.Errorf("mattermost: at least one allowed channel or user is required"))
+		}
+	case "console":
+		if cfg.Console.NoStdin && cfg.Console.Socket == "" {
+			errs = append(errs, fmt.Errorf("console: noStdin needs a socket"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("provider %s not supportted", cfg.Provider))
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Recipients)) {
+		r := cfg.Recipients[name]
+		chat := r.ChatID != 0 || r.Source != "" || r.Room != "" || r.Topic != "" || r.Email != "" || r.Channel != "" || r.Console != ""
+		if !chat && r.Webhook == nil && r.Ntfy == nil && r.Gotify == nil {
+			errs = append(errs, fmt.Errorf("recipient %q: chatId, source, room, topic, email, channel, console or a notification sink is required", name))
+		}
+		for _, err := range validateSink(r) {
+			errs = append(errs, fmt.Errorf("recipient %q: %w", name, err))
+		}
+		if strings.ContainsAny(r.Topic, "+#") {
+			errs = append(errs, fmt.Errorf("recipient %q: topic must not contain wildcards", name))
+		}
+	}
+	return errs
+}
+
+func validateFleet(cfg *Config) []error {
+	var errs []error
+	fleet := cfg.Fleet
+	if fleet.TimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("fleet: timeoutSeconds must not be negative"))
+	}
+	for _, host := range slices.Sorted(maps.Keys(fleet.Agents)) {
+		a := fleet.Agents[host]
+		prefix := fmt.Sprintf("fleet.agents %q", host)
+		if host == "" || strings.ContainsAny(host, " /@") {
+			errs = append(errs, fmt.Errorf("%s: host name must not be empty or contain spaces, slashes or @", prefix))
+		}
+		if !isHTTPURL(a.URL) {
+			errs = append(errs, fmt.Errorf("%s: url must be an http(s) URL", prefix))
+		}
+		if !a.hasCredentials() && a.Key == "" {
+			errs = append(errs, fmt.Errorf("%s: token or key and secret are required", prefix))
+		}
+		for _, err := range validateAgentCredentials(a) {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+	}
+	if d := fleet.Discovered; d.hasCredentials() || d.Key != "" || d.CAFile != "" || d.CertFile != "" {
+		if !cfg.Discovery.Browse {
+			errs = append(errs, fmt.Errorf("fleet.discovered: needs discovery.browse"))
+		}
+		if d.CAFile == "" {
+			errs = append(errs, fmt.Errorf("fleet.discovered: caFile is required, credentials only go to discovered bots over verified TLS"))
+		}
+		for _, err := range validateAgentCredentials(d) {
+			errs = append(errs, fmt.Errorf("fleet.discovered: %w", err))
+		}
+	}
+	return errs
+}
+
+// validateAgentCredentials checks the credentials and TLS files of an agent
+func validateAgentCredentials(a FleetAgent) []error {
+	var errs []error
+	switch {
+	case (a.Key == "") != (a.Secret == ""):
+		errs = append(errs, fmt.Errorf("key and secret must be set together"))
+	case a.Token != "" && a.Secret != "":
+		errs = append(errs, fmt.Errorf("only one of token or secret can be set"))
+	}
+	if (a.CertFile == "") != (a.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("certFile and keyFile must be set together"))
+	} else if _, err := agentClient(a); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// discoveryService is a DNS-SD service type, e.g. _rpi-bot._tcp
+var discoveryService = regexp.MustCompile(`^_[A-Za-z0-9-]+\._(tcp|udp)$`)
+
+func validateDiscovery(cfg *Config) []error {
+	var errs []error
+	d := cfg.Discovery
+	if d.Advertise && !cfg.Httpd.Enabled {
+		errs = append(errs, fmt.Errorf("discovery: advertise needs httpd"))
+	}
+	if d.Service != "" && !discoveryService.MatchString(d.Service) {
+		errs = append(errs, fmt.Errorf("discovery: service must be a DNS-SD service type like _rpi-bot._tcp"))
+	}
+	if strings.ContainsAny(d.Instance, " ./@") {
+		errs = append(errs, fmt.Errorf("discovery: instance must not contain spaces, dots, slashes or @"))
+	}
+	if d.IntervalSeconds < 0 {
+		errs = append(errs, fmt.Errorf("discovery: intervalSeconds must not be negative"))
+	}
+	return errs
+}
+
+// validateSink checks the notification sink of a recipient, if it has one
+func validateSink(r Recipient) []error {
+	var errs []error
+	sinks := 0
+	if r.Webhook != nil {
+		sinks++
+		if !isHTTPURL(r.Webhook.URL) {
+			errs = append(errs, fmt.Errorf("webhook: url must be an http(s) URL"))
+		}
+		if _, err := messaging.ParseWebhookBody(cmp.Or(r.Webhook.Body, messaging.DefaultWebhookBody)); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: invalid body: %w", err))
+		}
+	}
+	if r.Ntfy != nil {
+		sinks++
+		if u, err := url.Parse(r.Ntfy.URL); err != nil || !isHTTPURL(r.Ntfy.URL) || strings.Trim(u.Path, "/") == "" {
+			errs = append(errs, fmt.Errorf("ntfy: url must be the http(s) URL of a topic, e.g. https://ntfy.sh/rpi-alerts"))
+		}
+		if r.Ntfy.Priority < 0 || r.Ntfy.Priority > 5 {
+			errs = append(errs, fmt.Errorf("ntfy: priority must be between 1 and 5"))
+		}
+	}
+	if r.Gotify != nil {
+		sinks++
+		if !isHTTPURL(r.Gotify.URL) {
+			errs = append(errs, fmt.Errorf("gotify: url must be an http(s) URL"))
+		}
+		if r.Gotify.Token == "" {
+			errs = append(errs, fmt.Errorf("gotify: token is required"))
+		}
+		if r.Gotify.Priority < 0 {
+			errs = append(errs, fmt.Errorf("gotify: priority must not be negative"))
+		}
+	}
+	if sinks > 1 {
+		errs = append(errs, fmt.Errorf("only one of webhook, ntfy or gotify can be set"))
+	}
+	if r.Retry.Attempts < 0 || r.Retry.BackoffSeconds < 0 {
+		errs = append(errs, fmt.Errorf("retry: attempts and backoffSeconds must not be negative"))
+	}
+	return errs
+}
+
+// isHTTPURL reports whether s is an absolute http or https URL
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+func validateEmail(cfg EmailConfig) []error {
+	var errs []error
+	for _, s := range []struct {
+		name   string
+		server MailServerConfig
+	}{{"imap", cfg.IMAP}, {"smtp", cfg.SMTP}} {
+		if _, _, err := net.SplitHostPort(s.server.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("email.%s: addr must be host:port", s.name))
+		}
+		if !slices.Contains(mailSecurities, s.server.Security) {
+			errs = append(errs, fmt.Errorf("email.%s: security must be tls, starttls or none", s.name))
+		}
+	}
+	if cfg.IMAP.Username == "" {
+		errs = append(errs, fmt.Errorf("email.imap: username is required"))
+	}
+	if _, exists := GetSecret("EMAIL_IMAP_PASSWORD", cfg.IMAP.Password); !exists {
+		errs = append(errs, fmt.Errorf("email.imap: no password set and ENV var `EMAIL_IMAP_PASSWORD` not found"))
+	}
+	if !strings.Contains(cmp.Or(cfg.From, cfg.IMAP.Username), "@") {
+		errs = append(errs, fmt.Errorf("email: from must be an address, required if the IMAP username isn't one"))
+	}
+	if len(cfg.Senders) == 0 {
+		errs = append(errs, fmt.Errorf("email: at least one sender is required"))
+	}
+	if cfg.PollIntervalSeconds < 0 {
+		errs = append(errs, fmt.Errorf("email: pollIntervalSeconds must not be negative"))
+	}
+	if cfg.RequireDKIM && cfg.AuthservID == "" {
+		errs = append(errs, fmt.Errorf("email: requireDKIM needs the authservId of the receiving server"))
+	}
+	return errs
+}
+
+func validateMQTT(cfg MQTTConfig) []error {
+	var errs []error
+	schemes := append([]string{"tcp", "mqtt", "ws"}, mqttSecureSchemes...)
+	if u, err := url.Parse(cfg.Broker); err != nil || !slices.Contains(schemes, u.Scheme) || u.Host == "" {
+		errs = append(errs, fmt.Errorf("mqtt: broker must be a URL like tcp://host:1883 or ssl://host:8883"))
+	} else if _, err := mqttOptions(cfg); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.QoS < 0 || cfg.QoS > 2 {
+		errs = append(errs, fmt.Errorf("mqtt: qos must be 0, 1 or 2"))
+	}
+	if strings.ContainsAny(cfg.ResponseTopic, "+#") || strings.ContainsAny(cfg.StatusTopic, "+#") {
+		errs = append(errs, fmt.Errorf("mqtt: responseTopic and statusTopic must not contain wildcards"))
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("mqtt.tls: certFile and keyFile must be set together"))
+	}
+	return errs
+}
+
+func validateHttpd(cfg *Config) []error {
+	httpd := cfg.Httpd
+	if !httpd.Enabled {
+		return nil
+	}
+	var errs []error
+	if err := validateAddr(httpd.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("httpd: %w", err))
+	}
+	if httpd.MaxClockSkewSeconds < 0 {
+		errs = append(errs, fmt.Errorf("httpd: maxClockSkewSeconds must not be negative"))
+	}
+	lockout := httpd.Lockout
+	if lockout.MaxFailures < 0 || lockout.WindowSeconds < 0 || lockout.DurationSeconds < 0 {
+		errs = append(errs, fmt.Errorf("httpd.lockout: values must not be negative"))
+	}
+	errs = append(errs, validateTokens(cfg)...)
+	return append(errs, validateTLS(cfg)...)
+}
+
+func validateTokens(cfg *Config) []error {
+	var errs []error
+	seen := map[string]string{}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Httpd.Tokens)) {
+		t := cfg.Httpd.Tokens[name]
+		prefix := fmt.Sprintf("httpd.tokens %q", name)
+		if _, err := parseAPIToken(name, t); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+		if other, ok := seen[t.Token]; ok && t.Token != "" {
+			errs = append(errs, fmt.Errorf("%s: same token as %q", prefix, other))
+		}
+		seen[t.Token] = name
+		for _, command := range t.Commands {
+			if _, ok := cfg.Commands[command]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown command %q", prefix, command))
+			}
+		}
+	}
+	return errs
+}
+
+func validateTLS(cfg *Config) []error {
+	t := cfg.Httpd.TLS
+	var errs []error
+	if t.enabled() {
+		switch {
+		case t.CertFile == "" || t.KeyFile == "":
+			errs = append(errs, fmt.Errorf("httpd.tls: certFile and keyFile are required"))
+		case t.SelfSigned && !fileExists(t.CertFile) && !fileExists(t.KeyFile):
+			// Generated on start
+		default:
+			if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+				errs = append(errs, fmt.Errorf("httpd.tls: %w", err))
+			}
+		}
+	}
+	if t.ClientCA == "" {
+		if t.RequireClientCert || len(t.Clients) > 0 {
+			errs = append(errs, fmt.Errorf("httpd.tls: client certificates require clientCA"))
+		}
+	} else {
+		if !t.enabled() {
+			errs = append(errs, fmt.Errorf("httpd.tls: clientCA requires a certificate"))
+		}
+		if _, err := loadCertPool(t.ClientCA); err != nil {
+			errs = append(errs, fmt.Errorf("httpd.tls: clientCA: %w", err))
+		}
+	}
+	for _, cn := range slices.Sorted(maps.Keys(t.Clients)) {
+		for _, name := range t.Clients[cn].Commands {
+			if _, ok := cfg.Commands[name]; !ok {
+				errs = append(errs, fmt.Errorf("httpd.tls: client %q: unknown command %q", cn, name))
+			}
+		}
+	}
+	return errs
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func validateMetrics(cfg *Config) []error {
+	if !cfg.Metrics.Enabled {
+		return nil
+	}
+	if cfg.Metrics.Addr == "" {
+		if !cfg.Httpd.Enabled {
+			return []error{fmt.Errorf("metrics: require httpd to be enabled or an addr")}
+		}
+		return nil
+	}
+	if err := validateAddr(cfg.Metrics.Addr); err != nil {
+		return []error{fmt.Errorf("metrics: %w", err)}
+	}
+	return nil
+}
+
+// validateAddr checks a host:port listen address
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %q: %w", addr, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		return fmt.Errorf("invalid port %q in addr %q", port, addr)
+	}
+	return nil
+}
+
+func validateWebhooks(cfg *Config) []error {
+	var errs []error
+	if len(cfg.Webhooks) > 0 && !cfg.Httpd.Enabled {
+		errs = append(errs, fmt.Errorf("webhooks: require httpd to be enabled"))
+	}
+	paths := make(map[string]bool, len(cfg.Webhooks))
+	for _, w := range cfg.Webhooks {
+		prefix := fmt.Sprintf("webhook %q", w.Path)
+		if !strings.HasPrefix(w.Path, "/") {
+			errs = append(errs, fmt.Errorf("%s: path must start with /", prefix))
+		}
+		for _, reserved := range reservedPaths {
+			if w.Path == reserved || (strings.HasSuffix(reserved, "/") && strings.HasPrefix(w.Path, reserved)) {
+				errs = append(errs, fmt.Errorf("%s: path %s is reserved", prefix, reserved))
+			}
+		}
+		if paths[w.Path] {
+			errs = append(errs, fmt.Errorf("%s: duplicated path", prefix))
+		}
+		paths[w.Path] = true
+
+		if c, ok := cfg.Commands[w.Command]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown command %q", prefix, w.Command))
+		} else {
+			for _, arg := range c.Args {
+				if _, ok := w.Args[arg]; !ok {
+					errs = append(errs, fmt.Errorf("%s: no extraction rule for arg %q", prefix, arg))
+				}
+			}
+		}
+
+		switch w.Auth.Type {
+		case "":
+			errs = append(errs, fmt.Errorf("%s: auth.type is required, none for unauthenticated requests", prefix))
+		case "none":
+		case "secret", "hmac":
+			if w.Auth.Header == "" || w.Auth.Secret == "" {
+				errs = append(errs, fmt.Errorf("%s: auth %s requires header and secret", prefix, w.Auth.Type))
+			}
+			if w.Auth.Type == "hmac" && w.Auth.Algorithm != "" &&
+				w.Auth.Algorithm != "sha256" && w.Auth.Algorithm != "sha1" {
+				errs = append(errs, fmt.Errorf("%s: unsupported hmac algorithm %q", prefix, w.Auth.Algorithm))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: auth type %s not supported", prefix, w.Auth.Type))
+		}
+
+		for _, f := range w.Filters {
+			if f.Field == "" {
+				errs = append(errs, fmt.Errorf("%s: filter without field", prefix))
+			}
+			if f.Matches != "" {
+				if _, err := regexp.Compile(f.Matches); err != nil {
+					errs = append(errs, fmt.Errorf("%s: invalid filter regexp %q: %w", prefix, f.Matches, err))
+				}
+			}
+		}
+
+		if w.Notify != "" {
+			if _, ok := cfg.Recipients[w.Notify]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown recipient %q", prefix, w.Notify))
+			}
+		}
+	}
+	return errs
+}
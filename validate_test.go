@@ -0,0 +1,489 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Config
+		wantErrs []string
+	}{
+		{
+			name: "valid config",
+			cfg: Config{
+				Commands: map[string]Command{
+					"echo": {Command: "echo %s", Args: []string{"text"}},
+				},
+				Httpd:      HttpdConfig{Enabled: true, Addr: ":8080"},
+				Recipients: map[string]Recipient{"ops": {ChatID: 1}},
+				Admins:     []string{"ops"},
+				Webhooks: []WebhookConfig{{
+					Path:    "/hooks/echo",
+					Command: "echo",
+					Args:    map[string]string{"text": "message"},
+					Auth:    WebhookAuth{Type: "hmac", Header: "X-Signature", Secret: "key"},
+					Notify:  "ops",
+				}},
+			},
+		},
+		{
+			name: "command errors are all reported",
+			cfg: Config{
+				Commands: map[string]Command{
+					"bad name": {Command: "echo"},
+					"empty":    {Command: ""},
+					"missing":  {Command: "surely-not-a-binary-in-path"},
+					"mismatch": {Command: "echo %s %s", Args: []string{"a"}},
+					"dupes":    {Command: "echo %s %s", Args: []string{"a", "a"}},
+					"secret":   {Command: "echo %s", Args: []string{"a"}, SensitiveArgs: []string{"b"}},
+					"specs": {Command: "echo %s", Args: []string{"a"}, ArgSpecs: map[string]ArgSpec{
+						"a": {Values: []string{"x", ""}},
+						"b": {Description: "Not an arg"},
+					}},
+				},
+			},
+			wantErrs: []string{
+				`command "bad name": name must not be empty or contain spaces, slashes or @`,
+				`command "empty": empty command`,
+				`command "missing": exec: "surely-not-a-binary-in-path": executable file not found in $PATH`,
+				`command "mismatch": mismatch between placeholders (%s)=2 and number of args=1`,
+				`command "dupes": duplicated arg "a"`,
+				`command "secret": unknown sensitive arg "b"`,
+				`command "specs": argSpecs "a": empty value`,
+				`command "specs": argSpecs: unknown arg "b"`,
+			},
+		},
+		{
+			name: "provider errors",
+			cfg: Config{
+				Provider:   "signal",
+				Recipients: map[string]Recipient{"nobody": {}},
+				Admins:     []string{"ghost"},
+			},
+			wantErrs: []string{
+				"signal: socket is required",
+				"signal: at least one source is required",
+				`recipient "nobody": chatId, source, room, topic, email, channel, console or a notification sink is required`,
+				`admins: unknown recipient "ghost"`,
+			},
+		},
+		{
+			name: "matrix errors",
+			cfg:  Config{Provider: "matrix", Matrix: MatrixConfig{Homeserver: "matrix.example.org"}},
+			wantErrs: []string{
+				"matrix: homeserver must be an http(s) URL",
+				"matrix: no accessToken set and ENV var `MATRIX_ACCESSTOKEN` not found",
+				"matrix: at least one allowed room or user is required",
+			},
+		},
+		{
+			name: "slack errors",
+			cfg:  Config{Provider: "slack"},
+			wantErrs: []string{
+				"slack: no appToken set and ENV var `SLACK_APPTOKEN` not found",
+				"slack: no botToken set and ENV var `SLACK_BOTTOKEN` not found",
+				"slack: at least one allowed channel or user is required",
+			},
+		},
+		{
+			name: "mattermost errors",
+			cfg:  Config{Provider: "mattermost", Mattermost: MattermostConfig{URL: "mattermost.example.org"}},
+			wantErrs: []string{
+				"mattermost: url must be an http(s) URL",
+				"mattermost: no token set and ENV var `MATTERMOST_TOKEN` not found",
+				"mattermost: at least one allowed channel or user is required",
+			},
+		},
+		{
+			name:     "console errors",
+			cfg:      Config{Provider: "console", Console: ConsoleConfig{NoStdin: true}},
+			wantErrs: []string{"console: noStdin needs a socket"},
+		},
+		{
+			name: "mqtt errors",
+			cfg: Config{
+				Provider: "mqtt",
+				MQTT: MQTTConfig{
+					Broker:        "localhost:1883",
+					QoS:           3,
+					ResponseTopic: "rpi-bot/+",
+					TLS:           MQTTTLSConfig{CertFile: "client.pem"},
+				},
+				Recipients: map[string]Recipient{"all": {Topic: "alerts/#"}},
+			},
+			wantErrs: []string{
+				"mqtt: broker must be a URL like tcp://host:1883 or ssl://host:8883",
+				"mqtt: qos must be 0, 1 or 2",
+				"mqtt: responseTopic and statusTopic must not contain wildcards",
+				"mqtt.tls: certFile and keyFile must be set together",
+				`recipient "all": topic must not contain wildcards`,
+			},
+		},
+		{
+			name: "email errors",
+			cfg: Config{
+				Provider: "email",
+				Email: EmailConfig{
+					IMAP:                MailServerConfig{Addr: "imap.example.org", Username: "pi", Security: "ssl"},
+					SMTP:                MailServerConfig{Addr: "smtp.example.org:587"},
+					PollIntervalSeconds: -1,
+					RequireDKIM:         true,
+				},
+			},
+			wantErrs: []string{
+				"email.imap: addr must be host:port",
+				"email.imap: security must be tls, starttls or none",
+				"email.imap: no password set and ENV var `EMAIL_IMAP_PASSWORD` not found",
+				"email: from must be an address, required if the IMAP username isn't one",
+				"email: at least one sender is required",
+				"email: pollIntervalSeconds must not be negative",
+				"email: requireDKIM needs the authservId of the receiving server",
+			},
+		},
+		{
+			name:     "mqtt missing CA file",
+			cfg:      Config{Provider: "mqtt", MQTT: MQTTConfig{Broker: "ssl://broker:8883", TLS: MQTTTLSConfig{CAFile: "/nonexistent/ca.pem"}}},
+			wantErrs: []string{"mqtt: open /nonexistent/ca.pem: no such file or directory"},
+		},
+		{
+			name:     "unknown provider",
+			cfg:      Config{Provider: "irc"},
+			wantErrs: []string{"provider irc not supportted"},
+		},
+		{
+			name:     "invalid httpd addr",
+			cfg:      Config{Httpd: HttpdConfig{Enabled: true, Addr: "8080"}},
+			wantErrs: []string{`httpd: invalid addr "8080"`},
+		},
+		{
+			name:     "invalid httpd port",
+			cfg:      Config{Httpd: HttpdConfig{Enabled: true, Addr: ":http-alt"}},
+			wantErrs: []string{`httpd: invalid port "http-alt" in addr ":http-alt"`},
+		},
+		{
+			name:     "invalid logging",
+			cfg:      Config{Logging: LoggingConfig{Level: "verbose"}},
+			wantErrs: []string{`logging: invalid level "verbose"`},
+		},
+		{
+			name: "token errors",
+			cfg: Config{
+				Commands: map[string]Command{"echo": {Command: "echo"}},
+				Httpd: HttpdConfig{Enabled: true, Addr: ":8080", Tokens: map[string]APIToken{
+					"a": {Token: "same", Commands: []string{"reboot"}},
+					"b": {Token: "same", Expires: "tomorrow"},
+					"c": {Token: "other", Sources: []string{"10.0.0.0/33"}},
+					"d": {},
+				}},
+			},
+			wantErrs: []string{
+				`httpd.tokens "a": unknown command "reboot"`,
+				`httpd.tokens "b": invalid expires "tomorrow", use 2006-01-02 or RFC 3339`,
+				`httpd.tokens "b": same token as "a"`,
+				`httpd.tokens "c": invalid source "10.0.0.0/33"`,
+				`httpd.tokens "d": empty token`,
+			},
+		},
+		{
+			name: "tls errors",
+			cfg: Config{
+				Commands: map[string]Command{"echo": {Command: "echo"}},
+				Httpd: HttpdConfig{Enabled: true, Addr: ":8443", TLS: TLSConfig{
+					CertFile: "/nonexistent/cert.pem",
+					Clients:  map[string]TLSClient{"backup": {Commands: []string{"echo", "reboot"}}},
+				}},
+			},
+			wantErrs: []string{
+				"httpd.tls: certFile and keyFile are required",
+				"httpd.tls: client certificates require clientCA",
+				`httpd.tls: client "backup": unknown command "reboot"`,
+			},
+		},
+		{
+			name: "tls certificate not found",
+			cfg: Config{
+				Httpd: HttpdConfig{Enabled: true, Addr: ":8443", TLS: TLSConfig{
+					CertFile: "/nonexistent/cert.pem",
+					KeyFile:  "/nonexistent/key.pem",
+					ClientCA: "/nonexistent/ca.pem",
+				}},
+			},
+			wantErrs: []string{
+				"httpd.tls: open /nonexistent/cert.pem: no such file or directory",
+				"httpd.tls: clientCA: open /nonexistent/ca.pem: no such file or directory",
+			},
+		},
+		{
+			name: "self-signed certificate generated on start",
+			cfg: Config{
+				Httpd: HttpdConfig{Enabled: true, Addr: ":8443", TLS: TLSConfig{
+					CertFile:   "/nonexistent/cert.pem",
+					KeyFile:    "/nonexistent/key.pem",
+					SelfSigned: true,
+				}},
+			},
+		},
+		{
+			name: "negative limits",
+			cfg: Config{
+				Health:   HealthConfig{MaxPollAgeSeconds: -1},
+				Executor: ExecutorConfig{MaxConcurrent: -1},
+				Prompts:  PromptsConfig{TimeoutSeconds: -1},
+			},
+			wantErrs: []string{
+				"health: maxPollAgeSeconds must not be negative",
+				"prompts: timeoutSeconds must not be negative",
+				"executor: maxConcurrent must not be negative",
+			},
+		},
+		{
+			name: "command execution settings",
+			cfg: Config{
+				Commands: map[string]Command{
+					"ok": {
+						Command: "env", Workdir: "/", ClearEnv: true, InheritEnv: []string{"PATH"},
+						Env: map[string]string{"MODE": "prod"}, User: "0",
+					},
+					"bad": {
+						Command: "env", Workdir: "/nonexistent", InheritEnv: []string{"PATH"},
+						Env: map[string]string{"A=B": "c"}, User: "surely-not-a-user", Group: "0",
+					},
+				},
+			},
+			wantErrs: []string{
+				`command "bad": workdir: stat /nonexistent: no such file or directory`,
+				`command "bad": invalid env variable name "A=B"`,
+				`command "bad": inheritEnv requires clearEnv`,
+				`command "bad": unknown user "surely-not-a-user"`,
+			},
+		},
+		{
+			name: "limit and sandbox errors",
+			cfg: Config{
+				Commands: map[string]Command{
+					"backup": {
+						Command: "env",
+						Limits:  CommandLimits{CPUSeconds: -1},
+						Sandbox: SandboxConfig{Writable: []string{"relative", "/nonexistent"}},
+					},
+				},
+				Executor: ExecutorConfig{Cgroup: "/nonexistent"},
+			},
+			wantErrs: []string{
+				`command "backup": limits must not be negative`,
+				`command "backup": sandbox: writable requires readOnly`,
+				`command "backup": sandbox: writable path "relative" must be absolute and not /`,
+				`command "backup": sandbox: stat /nonexistent: no such file or directory`,
+				"executor.cgroup: open /nonexistent/cgroup.subtree_control: no such file or directory",
+			},
+		},
+		{
+			name: "rate limit errors",
+			cfg: Config{
+				Commands: map[string]Command{
+					"uptime": {Command: "uptime", RateLimit: RateLimit{PerMinute: 1}},
+				},
+				Httpd: HttpdConfig{Enabled: true, Addr: ":8080", Lockout: LockoutConfig{MaxFailures: -1}},
+				RateLimit: RateLimitConfig{
+					Global:    RateLimit{PerMinute: -1, Burst: 1},
+					PerCaller: RateLimit{PerMinute: 10, Burst: 5},
+				},
+			},
+			wantErrs: []string{
+				`command "uptime": rateLimit: burst must be at least 1`,
+				"httpd.lockout: values must not be negative",
+				"rateLimit.global: perMinute and burst must not be negative",
+			},
+		},
+		{
+			name: "fleet errors",
+			cfg: Config{
+				Fleet: FleetConfig{
+					TimeoutSeconds: -1,
+					Agents: map[string]FleetAgent{
+						"pi@garage":  {URL: "pi-garage:8443", Token: "t"},
+						"pi-attic":   {URL: "https://pi-attic:8443", Key: "controller"},
+						"pi-cellar":  {URL: "https://pi-cellar:8443"},
+						"pi-den":     {URL: "https://pi-den:8443", Token: "t", Key: "controller", Secret: "s"},
+						"pi-hall":    {URL: "https://pi-hall:8443", Token: "t", CAFile: "/nonexistent/ca.pem"},
+						"pi-kitchen": {URL: "https://pi-kitchen:8443", Key: "controller", Secret: "s", CertFile: "client.pem"},
+						"pi-office":  {URL: "http://pi-office:8080", Token: "t"},
+					},
+				},
+			},
+			wantErrs: []string{
+				"fleet: timeoutSeconds must not be negative",
+				`fleet.agents "pi-attic": key and secret must be set together`,
+				`fleet.agents "pi-cellar": token or key and secret are required`,
+				`fleet.agents "pi-den": only one of token or secret can be set`,
+				`fleet.agents "pi-hall": open /nonexistent/ca.pem: no such file or directory`,
+				`fleet.agents "pi-kitchen": certFile and keyFile must be set together`,
+				`fleet.agents "pi@garage": host name must not be empty or contain spaces, slashes or @`,
+				`fleet.agents "pi@garage": url must be an http(s) URL`,
+			},
+		},
+		{
+			name: "discovery errors",
+			cfg: Config{
+				Discovery: DiscoveryConfig{Advertise: true, Service: "rpi-bot", Instance: "pi.garage", IntervalSeconds: -1},
+				Fleet:     FleetConfig{Discovered: FleetAgent{Token: "t", Key: "controller", Secret: "s"}},
+			},
+			wantErrs: []string{
+				"fleet.discovered: needs discovery.browse",
+				"fleet.discovered: caFile is required, credentials only go to discovered bots over verified TLS",
+				"fleet.discovered: only one of token or secret can be set",
+				"discovery: advertise needs httpd",
+				"discovery: service must be a DNS-SD service type like _rpi-bot._tcp",
+				"discovery: instance must not contain spaces, dots, slashes or @",
+				"discovery: intervalSeconds must not be negative",
+			},
+		},
+		{
+			name: "notification sink errors",
+			cfg: Config{
+				Recipients: map[string]Recipient{
+					"gotify": {Gotify: &GotifyConfig{URL: "https://gotify.example.org", Priority: -1}},
+					"hook": {
+						Webhook: &WebhookSinkConfig{URL: "hooks.example.org", Body: "{{.Tittle"},
+						Retry:   RetryConfig{Attempts: -1},
+					},
+					"ntfy": {Ntfy: &NtfyConfig{URL: "https://ntfy.sh", Priority: 6}},
+					"ok": {
+						Ntfy:  &NtfyConfig{URL: "https://ntfy.sh/rpi-alerts", Tags: []string{"warning"}},
+						Retry: RetryConfig{Attempts: 5, BackoffSeconds: 2},
+					},
+					"two": {
+						Ntfy:   &NtfyConfig{URL: "https://ntfy.sh/rpi-alerts"},
+						Gotify: &GotifyConfig{URL: "https://gotify.example.org", Token: "token"},
+					},
+				},
+			},
+			wantErrs: []string{
+				`recipient "gotify": gotify: token is required`,
+				`recipient "gotify": gotify: priority must not be negative`,
+				`recipient "hook": webhook: url must be an http(s) URL`,
+				`recipient "hook": webhook: invalid body: template: body:1: unclosed action`,
+				`recipient "hook": retry: attempts and backoffSeconds must not be negative`,
+				`recipient "ntfy": ntfy: url must be the http(s) URL of a topic, e.g. https://ntfy.sh/rpi-alerts`,
+				`recipient "ntfy": ntfy: priority must be between 1 and 5`,
+				`recipient "two": only one of webhook, ntfy or gotify can be set`,
+			},
+		},
+		{
+			name: "webhook errors",
+			cfg: Config{
+				Commands: map[string]Command{
+					"echo": {Command: "echo %s", Args: []string{"text"}},
+				},
+				Webhooks: []WebhookConfig{
+					{Path: "/cmd/echo", Command: "echo", Args: map[string]string{"text": "a"}},
+					{Path: "hooks", Command: "nope"},
+					{
+						Path:    "/hooks/echo",
+						Command: "echo",
+						Auth:    WebhookAuth{Type: "hmac", Algorithm: "md5"},
+						Filters: []WebhookFilter{{Matches: "("}},
+						Notify:  "ops",
+					},
+				},
+			},
+			wantErrs: []string{
+				"webhooks: require httpd to be enabled",
+				`webhook "/cmd/echo": path /cmd/ is reserved`,
+				`webhook "/cmd/echo": auth.type is required, none for unauthenticated requests`,
+				`webhook "hooks": path must start with /`,
+				`webhook "hooks": unknown command "nope"`,
+				`webhook "hooks": auth.type is required, none for unauthenticated requests`,
+				`webhook "/hooks/echo": no extraction rule for arg "text"`,
+				`webhook "/hooks/echo": auth hmac requires header and secret`,
+				`webhook "/hooks/echo": unsupported hmac algorithm "md5"`,
+				`webhook "/hooks/echo": filter without field`,
+				`webhook "/hooks/echo": invalid filter regexp "("`,
+				`webhook "/hooks/echo": unknown recipient "ops"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&tt.cfg)
+			if len(tt.wantErrs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, want := range tt.wantErrs {
+				require.Contains(t, err.Error(), want)
+			}
+		})
+	}
+}
+
+func TestNewConfig_Strict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	// `arg` is a typo of `args`
+	writeConfig(t, path, "commands:\n  echo:\n    command: echo %s\n    arg: [text]\n")
+	_, err := NewConfig(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "field arg not found")
+
+	writeConfig(t, path, "commands:\n  echo:\n    command: echo %s\n    args: [text]\n")
+	cfg, err := NewConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"text"}, cfg.Commands["echo"].Args)
+
+	writeConfig(t, path, "commands:\n  echo:\n    command: echo %s\n")
+	_, err = NewConfig(path)
+	require.ErrorContains(t, err, "invalid config "+path)
+}
+
+func TestLoadConfig_ProviderOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "provider: telegram\ncommands:\n  uptime:\n    command: uptime\n")
+
+	_, err := loadConfig(path, "")
+	require.ErrorContains(t, err, "telegram: no apiToken set")
+
+	// The telegram section isn't needed to try the commands locally
+	cfg, err := loadConfig(path, "console")
+	require.NoError(t, err)
+	require.Equal(t, "console", cfg.Provider)
+}
+
+func TestValidateWebhooks_ReservedPaths(t *testing.T) {
+	tests := []struct {
+		path     string
+		reserved bool
+	}{
+		{path: "/health", reserved: true},
+		{path: "/health/ready", reserved: true},
+		{path: "/cmd/echo", reserved: true},
+		{path: "/rerun/", reserved: true},
+		{path: "/healthz"},
+		{path: "/commandsx"},
+		{path: "/metrics-hook"},
+		{path: "/hooks/audit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			cfg := &Config{
+				Commands: map[string]Command{"echo": {Command: "echo"}},
+				Httpd:    HttpdConfig{Enabled: true},
+				Webhooks: []WebhookConfig{{Path: tt.path, Command: "echo", Auth: WebhookAuth{Type: "none"}}},
+			}
+			err := errors.Join(validateWebhooks(cfg)...)
+			if tt.reserved {
+				require.ErrorContains(t, err, "is reserved")
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"rpi-bot/messaging"
+)
+
+// maxWebhookBody caps the size of the JSON payload accepted by a webhook route
+const maxWebhookBody = 1 << 20
+
+type webhookHandler struct {
+	route      WebhookConfig
+	matchers   []*regexp.Regexp // Compiled filter regexps, nil for filters without one
+	dispatcher *dispatcher
+	recipients map[string]Recipient
+	sender     messaging.MessageSender
+}
+
+func newWebhookHandlers(
+	cfg *Config,
+	d *dispatcher,
+	sender messaging.MessageSender,
+) []*webhookHandler {
+	handlers := make([]*webhookHandler, 0, len(cfg.Webhooks))
+	for _, route := range cfg.Webhooks {
+		handlers = append(handlers, newWebhookHandler(route, d, cfg.Recipients, sender))
+	}
+	return handlers
+}
+
+// newWebhookHandler returns the handler of a route, its filter regexps
+// compiled once. They were checked when validating the config.
+func newWebhookHandler(
+	route WebhookConfig,
+	d *dispatcher,
+	recipients map[string]Recipient,
+	sender messaging.MessageSender,
+) *webhookHandler {
+	matchers := make([]*regexp.Regexp, len(route.Filters))
+	for i, f := range route.Filters {
+		if f.Matches != "" {
+			matchers[i] = regexp.MustCompile(f.Matches)
+		}
+	}
+	return &webhookHandler{
+		route:      route,
+		matchers:   matchers,
+		dispatcher: d,
+		recipients: recipients,
+		sender:     sender,
+	}
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxWebhookBody {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	msg := messaging.Message{
+		Command:   h.route.Command,
+		Provider:  "webhook",
+		User:      h.route.Path,
+		RequestID: newRequestID(),
+	}
+	if err := verifyWebhook(h.route.Auth, r.Header, body); err != nil {
+		h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeUnauthorized, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payload, err := decodeWebhookPayload(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !h.matchFilters(payload) {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("ignored"))
+		return
+	}
+
+	cmdDef, ok := h.dispatcher.commands.Get(h.route.Command)
+	if !ok {
+		h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeRejected, errUnknownCommand)
+		http.Error(w, fmt.Sprintf("unknown command %q", h.route.Command), http.StatusNotFound)
+		return
+	}
+
+	values := make([]string, 0, len(cmdDef.Args))
+	for _, argKey := range cmdDef.Args {
+		path, ok := h.route.Args[argKey]
+		if !ok {
+			err := fmt.Errorf("no extraction rule for arg %q", argKey)
+			h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeRejected, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, err := extractJSONField(payload, path)
+		if err != nil {
+			h.dispatcher.reject(h.dispatcher.auditEntry(msg), outcomeRejected, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values = append(values, v)
+	}
+	msg.Args = values
+
+	output, err := h.dispatcher.run(msg)
+	var execErr *execError
+	var limitErr *rateLimitError
+	var stopped *limitError
+	switch {
+	case errors.As(err, &limitErr):
+		writeRateLimited(w, limitErr)
+		return
+	case errors.Is(err, errUnknownCommand):
+		http.Error(w, fmt.Sprintf("unknown command %q", h.route.Command), http.StatusNotFound)
+		return
+	case errors.Is(err, errBusy):
+		// Senders usually retry on 5xx
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.As(err, &stopped):
+		go h.forward(fmt.Sprintf("Command %s stopped: %v", h.route.Command, stopped))
+		http.Error(w, stopped.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.As(err, &execErr):
+		go h.forward(execErr.Error())
+		http.Error(w, execErr.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	go h.forward(output)
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = fmt.Fprint(w, output)
+}
+
+// forward sends the command output to the route's notify recipient, if any.
+// It runs in the background, the sender doesn't wait for the notification.
+func (h *webhookHandler) forward(output string) {
+	if h.route.Notify == "" {
+		return
+	}
+	logger := slog.With("webhook", h.route.Path, "recipient", h.route.Notify)
+	recipient, ok := h.recipients[h.route.Notify]
+	if !ok {
+		logger.Error("webhook: unknown recipient")
+		return
+	}
+	if err := notifyRecipient(h.sender, recipient, "rpi-bot: "+h.route.Command, output); err != nil {
+		logger.Error("webhook: error notifying", "error", err)
+	}
+}
+
+// verifyWebhook authenticates a webhook request according to the route auth settings
+func verifyWebhook(auth WebhookAuth, header http.Header, body []byte) error {
+	switch auth.Type {
+	case "none":
+		return nil
+	case "secret":
+		got := header.Get(auth.Header)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(auth.Secret)) != 1 {
+			return fmt.Errorf("shared secret mismatch in header %s", auth.Header)
+		}
+		return nil
+	case "hmac":
+		got := header.Get(auth.Header)
+		if !strings.HasPrefix(got, auth.Prefix) {
+			return fmt.Errorf("signature header %s missing prefix %q", auth.Header, auth.Prefix)
+		}
+		sig, err := hex.DecodeString(strings.TrimPrefix(got, auth.Prefix))
+		if err != nil {
+			return fmt.Errorf("malformed signature in header %s: %w", auth.Header, err)
+		}
+		var newHash func() hash.Hash
+		switch auth.Algorithm {
+		case "", "sha256":
+			newHash = sha256.New
+		case "sha1":
+			newHash = sha1.New
+		default:
+			return fmt.Errorf("unsupported hmac algorithm %q", auth.Algorithm)
+		}
+		mac := hmac.New(newHash, []byte(auth.Secret))
+		mac.Write(body)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return fmt.Errorf("signature mismatch in header %s", auth.Header)
+		}
+		return nil
+	}
+	return fmt.Errorf("auth type %s not supported", auth.Type)
+}
+
+func decodeWebhookPayload(body []byte) (interface{}, error) {
+	var payload interface{}
+	d := json.NewDecoder(strings.NewReader(string(body)))
+	d.UseNumber()
+	if err := d.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// matchFilters reports whether the payload satisfies every filter of the route
+func (h *webhookHandler) matchFilters(payload interface{}) bool {
+	for i, f := range h.route.Filters {
+		v, err := extractJSONField(payload, f.Field)
+		if err != nil {
+			return false
+		}
+		if f.Equals != "" && v != f.Equals {
+			return false
+		}
+		if re := h.matchers[i]; re != nil && !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// extractJSONField resolves a JSONPath-like expression such as
+// `$.repository.full_name` or `commits[0].id` against a decoded payload
+// and returns the scalar value found as a string.
+func extractJSONField(payload interface{}, path string) (string, error) {
+	expr := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	expr = strings.NewReplacer("[", ".", "]", "").Replace(expr)
+
+	current := payload
+	if expr != "" {
+		for _, key := range strings.Split(expr, ".") {
+			switch node := current.(type) {
+			case map[string]interface{}:
+				v, ok := node[key]
+				if !ok {
+					return "", fmt.Errorf("field %q not found in payload", path)
+				}
+				current = v
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", fmt.Errorf("invalid index %q for field %q", key, path)
+				}
+				current = node[i]
+			default:
+				return "", fmt.Errorf("field %q not found in payload", path)
+			}
+		}
+	}
+
+	switch v := current.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", fmt.Errorf("field %q is null", path)
+	}
+	return "", fmt.Errorf("field %q is not a scalar value", path)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi-bot/messaging"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestExtractJSONField(t *testing.T) {
+	payload, err := decodeWebhookPayload([]byte(`{
+		"ref": "refs/heads/main",
+		"repository": {"full_name": "jvdiago/rpi-bot", "private": false},
+		"commits": [{"id": "abc"}, {"id": "def"}],
+		"size": 2,
+		"pusher": null
+	}`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{name: "top level", path: "ref", want: "refs/heads/main"},
+		{name: "jsonpath root", path: "$.repository.full_name", want: "jvdiago/rpi-bot"},
+		{name: "array index", path: "commits[1].id", want: "def"},
+		{name: "dotted index", path: "commits.0.id", want: "abc"},
+		{name: "number", path: "size", want: "2"},
+		{name: "bool", path: "repository.private", want: "false"},
+		{name: "missing", path: "repository.owner", wantErr: `field "repository.owner" not found in payload`},
+		{name: "out of range", path: "commits[5].id", wantErr: `invalid index "5" for field "commits[5].id"`},
+		{name: "null", path: "pusher", wantErr: `field "pusher" is null`},
+		{name: "object", path: "repository", wantErr: `field "repository" is not a scalar value`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractJSONField(payload, tt.path)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	body := `{"ref":"refs/heads/main"}`
+
+	tests := []struct {
+		name    string
+		auth    WebhookAuth
+		headers map[string]string
+		wantErr bool
+	}{
+		{name: "no auth", auth: WebhookAuth{Type: "none"}},
+		{name: "auth type required", auth: WebhookAuth{}, wantErr: true},
+		{
+			name:    "shared secret ok",
+			auth:    WebhookAuth{Type: "secret", Header: "X-Token", Secret: "s3cr3t"},
+			headers: map[string]string{"X-Token": "s3cr3t"},
+		},
+		{
+			name:    "shared secret wrong",
+			auth:    WebhookAuth{Type: "secret", Header: "X-Token", Secret: "s3cr3t"},
+			headers: map[string]string{"X-Token": "nope"},
+			wantErr: true,
+		},
+		{
+			name:    "hmac ok",
+			auth:    WebhookAuth{Type: "hmac", Header: "X-Gitea-Signature", Secret: "key"},
+			headers: map[string]string{"X-Gitea-Signature": sign("key", body)},
+		},
+		{
+			name:    "hmac with prefix ok",
+			auth:    WebhookAuth{Type: "hmac", Header: "X-Hub-Signature-256", Secret: "key", Prefix: "sha256="},
+			headers: map[string]string{"X-Hub-Signature-256": "sha256=" + sign("key", body)},
+		},
+		{
+			name:    "hmac wrong secret",
+			auth:    WebhookAuth{Type: "hmac", Header: "X-Gitea-Signature", Secret: "key"},
+			headers: map[string]string{"X-Gitea-Signature": sign("other", body)},
+			wantErr: true,
+		},
+		{
+			name:    "hmac missing header",
+			auth:    WebhookAuth{Type: "hmac", Header: "X-Gitea-Signature", Secret: "key"},
+			wantErr: true,
+		},
+		{name: "unknown type", auth: WebhookAuth{Type: "basic"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.headers {
+				header.Set(k, v)
+			}
+			err := verifyWebhook(tt.auth, header, []byte(body))
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestWebhookHandler_ServeHTTP(t *testing.T) {
+	commands := map[string]Command{
+		"deploy": {Command: "deploy.sh %s %s", Args: []string{"repo", "branch"}},
+		"fail":   {Command: "error"},
+	}
+	route := WebhookConfig{
+		Path:    "/hooks/gitea",
+		Command: "deploy",
+		Auth:    WebhookAuth{Type: "secret", Header: "X-Token", Secret: "s3cr3t"},
+		Args: map[string]string{
+			"repo":   "$.repository.full_name",
+			"branch": "ref",
+		},
+		Filters: []WebhookFilter{{Field: "ref", Matches: "^refs/heads/"}},
+	}
+
+	tests := []struct {
+		name           string
+		route          func(WebhookConfig) WebhookConfig
+		method         string
+		token          string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "command executed with extracted args",
+			token:          "s3cr3t",
+			body:           `{"ref":"refs/heads/main","repository":{"full_name":"jvdiago/rpi-bot"}}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "deploy.sh jvdiago/rpi-bot refs/heads/main",
+		},
+		{
+			name:           "wrong secret",
+			token:          "bad",
+			body:           `{}`,
+			expectedStatus: http.StatusUnauthorized,
+			expectedBody:   "unauthorized\n",
+		},
+		{
+			name:           "wrong method",
+			method:         http.MethodGet,
+			token:          "s3cr3t",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedBody:   "method not allowed\n",
+		},
+		{
+			name:           "filtered out",
+			token:          "s3cr3t",
+			body:           `{"ref":"refs/tags/v1","repository":{"full_name":"jvdiago/rpi-bot"}}`,
+			expectedStatus: http.StatusAccepted,
+			expectedBody:   "ignored",
+		},
+		{
+			name:           "invalid json",
+			token:          "s3cr3t",
+			body:           `{"ref":`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid JSON payload: unexpected EOF\n",
+		},
+		{
+			name:           "missing field",
+			token:          "s3cr3t",
+			body:           `{"ref":"refs/heads/main"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "field \"$.repository.full_name\" not found in payload\n",
+		},
+		{
+			name:           "value with whitespace",
+			token:          "s3cr3t",
+			body:           `{"ref":"refs/heads/main","repository":{"full_name":"jvdiago/rpi-bot --force"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "repo must not contain whitespace\n",
+		},
+		{
+			name: "unknown command",
+			route: func(r WebhookConfig) WebhookConfig {
+				r.Command = "missing"
+				return r
+			},
+			token:          "s3cr3t",
+			body:           `{"ref":"refs/heads/main"}`,
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "unknown command \"missing\"\n",
+		},
+		{
+			name: "execution failure",
+			route: func(r WebhookConfig) WebhookConfig {
+				r.Command = "fail"
+				return r
+			},
+			token:          "s3cr3t",
+			body:           `{"ref":"refs/heads/main"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "Command error failed: assert.AnError general error for testing\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := route
+			if tt.route != nil {
+				r = tt.route(r)
+			}
+			d := &dispatcher{commands: newCommandTable(commands), executor: &mockExecutor{}}
+			handler := newWebhookHandler(r, d, nil, nil)
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, r.Path, strings.NewReader(tt.body))
+			req.Header.Set("X-Token", tt.token)
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Equal(t, tt.expectedBody, rr.Body.String())
+		})
+	}
+}
+
+func TestWebhookHandler_Notify(t *testing.T) {
+	sender := new(MockMessageClient)
+	sent := make(chan struct{})
+	sender.On("SendMessage", "uptime", messaging.Message{ChatID: 42}).Return(nil).Run(func(mock.Arguments) { close(sent) })
+
+	cfg := &Config{
+		Commands:   map[string]Command{"status": {Command: "uptime"}},
+		Recipients: map[string]Recipient{"ops": {ChatID: 42}},
+		Webhooks:   []WebhookConfig{{Path: "/hooks/grafana", Command: "status", Auth: WebhookAuth{Type: "none"}, Notify: "ops"}},
+	}
+	d := &dispatcher{commands: newCommandTable(cfg.Commands), executor: &mockExecutor{}}
+	mux := setupMux(cfg, &httpCommandHandler{dispatcher: d}, newWebhookHandlers(cfg, d, sender))
+
+	req := httptest.NewRequest(http.MethodPost, "/hooks/grafana", strings.NewReader(`{"state":"alerting"}`))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "uptime", rr.Body.String())
+	// The notification is sent after replying
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("the recipient wasn't notified")
+	}
+	sender.AssertCalled(t, "SendMessage", "uptime", mock.Anything)
+}